@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"strings"
+	"sync"
+)
+
+// Admin usernames allowed to use operator endpoints
+var (
+	admins      = make(map[string]bool)
+	adminsMutex sync.RWMutex
+)
+
+// SetAdmins replaces the set of admin usernames
+func SetAdmins(usernames []string) {
+	adminsMutex.Lock()
+	defer adminsMutex.Unlock()
+
+	admins = make(map[string]bool)
+	for _, username := range usernames {
+		username = strings.TrimSpace(username)
+		if username != "" {
+			admins[username] = true
+		}
+	}
+}
+
+// IsAdmin checks if a username has the admin role
+func IsAdmin(username string) bool {
+	adminsMutex.RLock()
+	defer adminsMutex.RUnlock()
+	return admins[username]
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"log"
+
+	"chapp/pkg/database"
+)
+
+// Audit event names (never include session IDs or key material in audit records)
+const (
+	AuditRegistrationStarted   = "registration_started"
+	AuditRegistrationCompleted = "registration_completed"
+	AuditLoginSuccess          = "login_success"
+	AuditLoginFailure          = "login_failure"
+	AuditLogout                = "logout"
+	AuditSessionCreated        = "session_created"
+	AuditSessionDeleted        = "session_deleted"
+	AuditCredentialRevoked     = "credential_revoked"
+)
+
+// RecordAuditEvent writes an authentication event to the audit log
+func RecordAuditEvent(event, username, remoteIP string) {
+	db := database.GetDatabase()
+	if db == nil {
+		return
+	}
+
+	if err := db.RecordAuditEvent(event, username, remoteIP); err != nil {
+		log.Printf("Failed to record audit event in database: %v", err)
+	}
+}
+
+// GetRecentAuditEvents returns the most recent audit events, newest first
+func GetRecentAuditEvents(limit int) []*database.AuditEvent {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil
+	}
+
+	events, err := db.GetRecentAuditEvents(limit)
+	if err != nil {
+		log.Printf("Failed to get audit events from database: %v", err)
+		return nil
+	}
+	return events
+}
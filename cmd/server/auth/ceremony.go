@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ceremonyTimeout is how long a WebAuthn registration or login may take between its begin and finish requests
+var ceremonyTimeout = 5 * time.Minute
+
+// pendingCeremony is the session data of a begun WebAuthn ceremony
+type pendingCeremony struct {
+	session *webauthn.SessionData
+	expires time.Time
+}
+
+var (
+	ceremonies      = make(map[string]pendingCeremony) // Pending ceremonies by challenge
+	ceremoniesMutex sync.Mutex
+)
+
+// SaveCeremony remembers a begun registration or login until its finish request arrives
+func SaveCeremony(session *webauthn.SessionData) {
+	ceremoniesMutex.Lock()
+	defer ceremoniesMutex.Unlock()
+
+	now := time.Now()
+	for challenge, pending := range ceremonies {
+		if now.After(pending.expires) {
+			delete(ceremonies, challenge)
+		}
+	}
+	ceremonies[session.Challenge] = pendingCeremony{session: session, expires: now.Add(ceremonyTimeout)}
+}
+
+// TakeCeremony returns and forgets the pending ceremony for a challenge, or nil if there is none
+// or it expired, so each ceremony can be finished only once
+func TakeCeremony(challenge string) *webauthn.SessionData {
+	ceremoniesMutex.Lock()
+	defer ceremoniesMutex.Unlock()
+
+	pending, ok := ceremonies[challenge]
+	if !ok {
+		return nil
+	}
+	delete(ceremonies, challenge)
+	if time.Now().After(pending.expires) {
+		return nil
+	}
+	return pending.session
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+
+	"chapp/pkg/credentials"
+	"chapp/pkg/database"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Credential revocation errors
+var (
+	ErrLastCredential      = errors.New("cannot remove the last credential")
+	ErrAmbiguousCredential = errors.New("credential ID prefix matches more than one credential")
+)
+
+// MaxDeviceLabelLength caps the length of a credential's device label
+const MaxDeviceLabelLength = 64
+
+// revokeMutex serializes revocations so two requests can't both remove a user's second-to-last credential
+var revokeMutex sync.Mutex
+
+// StoreCredential encodes and stores a WebAuthn credential for a user, with an optional device label
+func StoreCredential(username string, cred *webauthn.Credential, deviceLabel string) error {
+	db := database.GetDatabase()
+	if db == nil {
+		return fmt.Errorf("database not available")
+	}
+
+	user, err := db.GetUser(username)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %v", err)
+	}
+	if user == nil {
+		return fmt.Errorf("user not found: %s", username)
+	}
+
+	credentialID, data, err := credentials.EncodeCredential(cred)
+	if err != nil {
+		return err
+	}
+
+	return db.StoreCredential(user.ID, credentialID, data, cleanDeviceLabel(deviceLabel))
+}
+
+// UpdateCredential stores a credential's data again after a login, keeping its sign count current
+func UpdateCredential(cred *webauthn.Credential) error {
+	db := database.GetDatabase()
+	if db == nil {
+		return fmt.Errorf("database not available")
+	}
+
+	credentialID, data, err := credentials.EncodeCredential(cred)
+	if err != nil {
+		return err
+	}
+
+	return db.UpdateCredential(credentialID, data)
+}
+
+// cleanDeviceLabel turns control characters and runs of space in a client-supplied label into single spaces
+// and caps its length
+func cleanDeviceLabel(label string) string {
+	label = strings.Join(strings.Fields(strings.Map(func(char rune) rune {
+		if unicode.IsControl(char) {
+			return ' '
+		}
+		return char
+	}, label)), " ")
+	if runes := []rune(label); len(runes) > MaxDeviceLabelLength {
+		label = strings.TrimSpace(string(runes[:MaxDeviceLabelLength]))
+	}
+	return label
+}
+
+// ListCredentials returns the stored WebAuthn credentials of a user
+func ListCredentials(username string) ([]*database.WebAuthnCredential, error) {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil, fmt.Errorf("database not available")
+	}
+
+	user, err := db.GetUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	return db.GetCredentialsByUserID(user.ID)
+}
+
+// RevokeCredential deletes the user's credential whose ID starts with idPrefix.
+// It refuses to delete the user's last credential, which would lock them out.
+func RevokeCredential(username, idPrefix string) error {
+	revokeMutex.Lock()
+	defer revokeMutex.Unlock()
+
+	stored, err := ListCredentials(username)
+	if err != nil {
+		return err
+	}
+
+	var match *database.WebAuthnCredential
+	for _, cred := range stored {
+		if idPrefix == "" || !strings.HasPrefix(cred.CredentialID, idPrefix) {
+			continue
+		}
+		if match != nil {
+			return ErrAmbiguousCredential
+		}
+		match = cred
+	}
+	if match == nil {
+		return database.ErrCredentialNotFound
+	}
+	if len(stored) == 1 {
+		return ErrLastCredential
+	}
+
+	return database.GetDatabase().DeleteCredential(match.CredentialID)
+}
+
+// LoadCredentials loads and decodes the WebAuthn credentials of a user
+func LoadCredentials(username string) []webauthn.Credential {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil
+	}
+
+	user, err := db.GetUser(username)
+	if err != nil {
+		log.Printf("Failed to get user from database: %v", err)
+		return nil
+	}
+	if user == nil {
+		return nil
+	}
+
+	stored, err := db.GetCredentialsByUserID(user.ID)
+	if err != nil {
+		log.Printf("Failed to get credentials from database: %v", err)
+		return nil
+	}
+
+	var creds []webauthn.Credential
+	for _, s := range stored {
+		cred, err := credentials.DecodeCredential(s.PublicKey)
+		if err != nil {
+			log.Printf("Skipping undecodable credential %s: %v", s.CredentialID, err)
+			continue
+		}
+		creds = append(creds, *cred)
+	}
+	return creds
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"chapp/pkg/database"
+)
+
+// InviteTTL is how long a new invite link stays valid
+const InviteTTL = 24 * time.Hour
+
+// ErrInvitesUnavailable is returned when no database is configured to store invites
+var ErrInvitesUnavailable = errors.New("invites require a database")
+
+// CreateInvite generates and stores a new invite token for createdBy
+func CreateInvite(createdBy string, singleUse bool) (*database.Invite, error) {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil, ErrInvitesUnavailable
+	}
+
+	b, err := randomBytes(16)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create invite: %v", err)
+	}
+	invite := &database.Invite{
+		Token:     base64.RawURLEncoding.EncodeToString(b),
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC(),
+		ExpiresAt: time.Now().Add(InviteTTL).UTC(),
+		SingleUse: singleUse,
+	}
+
+	if err := db.CreateInvite(invite.Token, invite.CreatedBy, invite.ExpiresAt, invite.SingleUse); err != nil {
+		return nil, fmt.Errorf("failed to create invite: %v", err)
+	}
+	return invite, nil
+}
+
+// CheckInvite validates an invite token without using it up
+func CheckInvite(token string) (*database.Invite, error) {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil, ErrInvitesUnavailable
+	}
+	return db.CheckInvite(token)
+}
+
+// ConsumeInvite validates an invite token, using it up if it is single-use
+func ConsumeInvite(token string) (*database.Invite, error) {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil, ErrInvitesUnavailable
+	}
+	return db.ConsumeInvite(token)
+}
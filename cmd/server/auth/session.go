@@ -3,28 +3,48 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"log"
 	"time"
 
+	"chapp/cmd/server/config"
 	"chapp/cmd/server/types"
 	"chapp/pkg/database"
 )
 
+// randReader is the randomness source for session IDs and invite tokens
+var randReader io.Reader = rand.Reader
+
+// randomBytes reads n random bytes, failing rather than returning a partial or zero value
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(randReader, b); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return b, nil
+}
+
 // generateSessionID creates a random session ID
-func generateSessionID() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
+func generateSessionID() (string, error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
 }
 
 // CreateSession creates a new session for a username
-func CreateSession(username string) string {
-	sessionID := generateSessionID()
+func CreateSession(username string) (string, error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %v", err)
+	}
 
 	// Store session in database
 	db := database.GetDatabase()
 	if db != nil {
-		if err := db.CreateSession(sessionID, username); err != nil {
+		if err := db.CreateSession(sessionID, username, config.GetConfig().SessionTTL); err != nil {
 			log.Printf("Failed to create session in database: %v", err)
 		}
 	}
@@ -39,30 +59,46 @@ func CreateSession(username string) string {
 	types.Sessions[sessionID] = session
 	types.SessionMutex.Unlock()
 
-	return sessionID
+	return sessionID, nil
 }
 
 // GetSession retrieves a session by ID
 func GetSession(sessionID string) *types.Session {
+	session, err := LookupSession(sessionID)
+	if err != nil {
+		log.Printf("Failed to get session from database: %v", err)
+
+		// Fallback to memory
+		types.SessionMutex.RLock()
+		defer types.SessionMutex.RUnlock()
+		return types.Sessions[sessionID]
+	}
+	return session
+}
+
+// LookupSession retrieves a session by ID, returning ErrDatabaseUnavailable
+// instead of falling back to memory when the database fails
+func LookupSession(sessionID string) (*types.Session, error) {
 	// Try database first
 	db := database.GetDatabase()
 	if db != nil {
 		session, err := db.GetSession(sessionID)
 		if err != nil {
-			log.Printf("Failed to get session from database: %v", err)
-		} else if session != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		}
+		if session != nil {
 			// Convert database session to types.Session
 			return &types.Session{
 				Username: session.Username,
 				Created:  session.Created,
-			}
+			}, nil
 		}
 	}
 
 	// Fallback to memory
 	types.SessionMutex.RLock()
 	defer types.SessionMutex.RUnlock()
-	return types.Sessions[sessionID]
+	return types.Sessions[sessionID], nil
 }
 
 // DeleteSession removes a session
@@ -81,7 +117,7 @@ func DeleteSession(sessionID string) {
 	types.SessionMutex.Unlock()
 }
 
-// cleanupSessions removes old sessions (older than 24 hours)
+// cleanupSessions removes sessions older than the session TTL
 func cleanupSessions() {
 	// Cleanup database sessions
 	db := database.GetDatabase()
@@ -95,7 +131,7 @@ func cleanupSessions() {
 	types.SessionMutex.Lock()
 	defer types.SessionMutex.Unlock()
 
-	cutoff := time.Now().Add(-24 * time.Hour)
+	cutoff := time.Now().Add(-config.GetConfig().SessionTTL)
 	for id, session := range types.Sessions {
 		if session.Created.Before(cutoff) {
 			delete(types.Sessions, id)
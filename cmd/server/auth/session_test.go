@@ -1,13 +1,32 @@
 package auth
 
 import (
+	"errors"
+	"io"
 	"testing"
 )
 
+// mustCreateSession creates a session, failing the test on error
+func mustCreateSession(t *testing.T, username string) string {
+	t.Helper()
+	sessionID, err := CreateSession(username)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	return sessionID
+}
+
+// failingReader is a randomness source that always fails
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("entropy unavailable")
+}
+
 // TestCreateSession tests session creation
 func TestCreateSession(t *testing.T) {
 	username := "testuser"
-	sessionID := CreateSession(username)
+	sessionID := mustCreateSession(t, username)
 
 	if sessionID == "" {
 		t.Error("Session ID should not be empty")
@@ -38,7 +57,7 @@ func TestGetSession(t *testing.T) {
 
 	// Test with valid session
 	username := "testuser"
-	sessionID := CreateSession(username)
+	sessionID := mustCreateSession(t, username)
 	session = GetSession(sessionID)
 
 	if session == nil {
@@ -54,7 +73,7 @@ func TestGetSession(t *testing.T) {
 func TestDeleteSession(t *testing.T) {
 	// Create a session
 	username := "testuser"
-	sessionID := CreateSession(username)
+	sessionID := mustCreateSession(t, username)
 
 	// Verify it exists
 	session := GetSession(sessionID)
@@ -79,7 +98,7 @@ func TestMultipleSessions(t *testing.T) {
 	sessionIDs := make([]string, len(users))
 
 	for i, username := range users {
-		sessionIDs[i] = CreateSession(username)
+		sessionIDs[i] = mustCreateSession(t, username)
 		if sessionIDs[i] == "" {
 			t.Errorf("Session ID should not be empty for user %s", username)
 		}
@@ -100,8 +119,8 @@ func TestMultipleSessions(t *testing.T) {
 // TestSessionUniqueness tests that session IDs are unique
 func TestSessionUniqueness(t *testing.T) {
 	username := "testuser"
-	sessionID1 := CreateSession(username)
-	sessionID2 := CreateSession(username)
+	sessionID1 := mustCreateSession(t, username)
+	sessionID2 := mustCreateSession(t, username)
 
 	if sessionID1 == sessionID2 {
 		t.Error("Session IDs should be unique")
@@ -115,3 +134,21 @@ func TestSessionUniqueness(t *testing.T) {
 		t.Error("Both sessions should exist")
 	}
 }
+
+// TestCreateSessionRandomFailure tests that a randomness failure is returned instead of a weak session
+func TestCreateSessionRandomFailure(t *testing.T) {
+	defer func(reader io.Reader) { randReader = reader }(randReader)
+	randReader = failingReader{}
+
+	sessionID, err := CreateSession("unlucky")
+	if err == nil {
+		t.Fatalf("Expected an error, got session '%s'", sessionID)
+	}
+	if sessionID != "" {
+		t.Errorf("Expected no session ID on failure, got '%s'", sessionID)
+	}
+
+	if _, err := CreateInvite("unlucky", true); err == nil {
+		t.Error("Expected invite creation to fail too")
+	}
+}
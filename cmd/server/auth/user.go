@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -9,6 +10,25 @@ import (
 	"chapp/pkg/database"
 )
 
+// ErrDatabaseUnavailable is returned when the database fails during a lookup
+var ErrDatabaseUnavailable = errors.New("database unavailable")
+
+// ErrUserConflict is returned when provisioning a user that already exists with different data
+var ErrUserConflict = errors.New("user exists with different data")
+
+// fromDatabaseUser converts a database user to types.User
+func fromDatabaseUser(user *database.User) *types.User {
+	return &types.User{
+		ID:           user.ID,
+		Username:     user.Username,
+		Created:      user.Created,
+		LastLogin:    user.LastLogin,
+		PasskeyID:    user.PasskeyID,
+		PublicKey:    user.PublicKey,
+		IsRegistered: user.IsRegistered,
+	}
+}
+
 // registerUser creates a new user account
 func registerUser(username, passkeyID string) error {
 	types.UsersMutex.Lock()
@@ -19,6 +39,7 @@ func registerUser(username, passkeyID string) error {
 	}
 
 	user := &types.User{
+		ID:           types.NextUserID,
 		Username:     username,
 		Created:      time.Now(),
 		LastLogin:    time.Now(),
@@ -27,35 +48,69 @@ func registerUser(username, passkeyID string) error {
 	}
 
 	types.Users[username] = user
+	types.NextUserID++
 	log.Printf("Registered new user: %s", username)
 	return nil
 }
 
 // GetUser retrieves a user by username
 func GetUser(username string) *types.User {
+	user, err := LookupUser(username)
+	if err != nil {
+		log.Printf("Failed to get user from database: %v", err)
+
+		// Fallback to memory
+		types.UsersMutex.RLock()
+		defer types.UsersMutex.RUnlock()
+		return types.Users[username]
+	}
+	return user
+}
+
+// LookupUser retrieves a user by username, returning ErrDatabaseUnavailable
+// instead of falling back to memory when the database fails
+func LookupUser(username string) (*types.User, error) {
 	// Try database first
 	db := database.GetDatabase()
 	if db != nil {
 		user, err := db.GetUser(username)
 		if err != nil {
-			log.Printf("Failed to get user from database: %v", err)
+			return nil, fmt.Errorf("%w: %v", ErrDatabaseUnavailable, err)
+		}
+		if user != nil {
+			return fromDatabaseUser(user), nil
+		}
+	}
+
+	// Fallback to memory
+	types.UsersMutex.RLock()
+	defer types.UsersMutex.RUnlock()
+	return types.Users[username], nil
+}
+
+// GetUserByID retrieves a user by ID
+func GetUserByID(id int) *types.User {
+	// Try database first
+	db := database.GetDatabase()
+	if db != nil {
+		user, err := db.GetUserByID(id)
+		if err != nil {
+			log.Printf("Failed to get user by ID from database: %v", err)
 		} else if user != nil {
-			// Convert database user to types.User
-			return &types.User{
-				Username:     user.Username,
-				Created:      user.Created,
-				LastLogin:    user.LastLogin,
-				PasskeyID:    user.PasskeyID,
-				PublicKey:    user.PublicKey,
-				IsRegistered: user.IsRegistered,
-			}
+			return fromDatabaseUser(user)
 		}
 	}
 
 	// Fallback to memory
 	types.UsersMutex.RLock()
 	defer types.UsersMutex.RUnlock()
-	return types.Users[username]
+
+	for _, user := range types.Users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
 }
 
 // UpdateUserLastLogin updates the user's last login time
@@ -83,6 +138,28 @@ func ValidateUser(username string) bool {
 	return user != nil && user.IsRegistered
 }
 
+// ClaimRegistration marks a user registered, returning false if they already were, so only one
+// registration ceremony can attach the first passkey to a pending user
+func ClaimRegistration(username string) (bool, error) {
+	db := database.GetDatabase()
+	if db != nil {
+		return db.ClaimUserRegistration(username)
+	}
+
+	types.UsersMutex.Lock()
+	defer types.UsersMutex.Unlock()
+
+	user, exists := types.Users[username]
+	if !exists {
+		return false, fmt.Errorf("user not found: %s", username)
+	}
+	if user.IsRegistered {
+		return false, nil
+	}
+	user.IsRegistered = true
+	return true, nil
+}
+
 // CreateUserForRegistration creates a new user for WebAuthn registration
 func CreateUserForRegistration(username string) *types.User {
 	// Create in database
@@ -92,29 +169,24 @@ func CreateUserForRegistration(username string) *types.User {
 		if err != nil {
 			log.Printf("Failed to create user in database: %v", err)
 		} else if user != nil {
-			// Convert database user to types.User
-			return &types.User{
-				Username:     user.Username,
-				Created:      user.Created,
-				LastLogin:    user.LastLogin,
-				PasskeyID:    user.PasskeyID,
-				PublicKey:    user.PublicKey,
-				IsRegistered: user.IsRegistered,
-			}
+			return fromDatabaseUser(user)
 		}
 	}
 
 	// Fallback to memory
+	types.UsersMutex.Lock()
+	defer types.UsersMutex.Unlock()
+
 	user := &types.User{
+		ID:           types.NextUserID,
 		Username:     username,
 		Created:      time.Now(),
 		LastLogin:    time.Now(),
 		IsRegistered: false, // Will be set to true after successful registration
 	}
 
-	types.UsersMutex.Lock()
 	types.Users[username] = user
-	types.UsersMutex.Unlock()
+	types.NextUserID++
 
 	return user
 }
@@ -128,15 +200,7 @@ func FindUserByPasskeyID(passkeyID string) *types.User {
 		if err != nil {
 			log.Printf("Failed to find user by passkey ID in database: %v", err)
 		} else if user != nil {
-			// Convert database user to types.User
-			return &types.User{
-				Username:     user.Username,
-				Created:      user.Created,
-				LastLogin:    user.LastLogin,
-				PasskeyID:    user.PasskeyID,
-				PublicKey:    user.PublicKey,
-				IsRegistered: user.IsRegistered,
-			}
+			return fromDatabaseUser(user)
 		}
 	}
 
@@ -151,3 +215,146 @@ func FindUserByPasskeyID(passkeyID string) *types.User {
 	}
 	return nil
 }
+
+// FindUserByCredentialID finds the owner of a stored WebAuthn credential
+func FindUserByCredentialID(credentialID string) *types.User {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil
+	}
+
+	cred, err := db.GetCredential(credentialID)
+	if err != nil {
+		log.Printf("Failed to get credential from database: %v", err)
+		return nil
+	}
+	if cred == nil {
+		return nil
+	}
+
+	return GetUserByID(cred.UserID)
+}
+
+// FindUserByCredentialHandle finds the owner of a stored discoverable credential from the user handle it returned
+func FindUserByCredentialHandle(credentialID string, userHandle []byte) *types.User {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil
+	}
+
+	user, err := db.FindUserByCredentialHandle(credentialID, userHandle)
+	if err != nil {
+		log.Printf("Failed to find user by credential handle in database: %v", err)
+		return nil
+	}
+	if user == nil {
+		return nil
+	}
+	return fromDatabaseUser(user)
+}
+
+// UpdateUserPublicKey stores the user's chat public key
+func UpdateUserPublicKey(username, publicKey string) error {
+	// Update in database
+	db := database.GetDatabase()
+	if db != nil {
+		if err := db.UpdateUserPublicKey(username, publicKey); err != nil {
+			return fmt.Errorf("failed to update user public key: %v", err)
+		}
+	}
+
+	// Also update in memory
+	types.UsersMutex.Lock()
+	defer types.UsersMutex.Unlock()
+
+	if user, exists := types.Users[username]; exists {
+		user.PublicKey = publicKey
+	}
+	return nil
+}
+
+// ProvisionUser creates a user non-interactively, optionally pre-registered with a public key.
+// It returns false without changing anything if an identical user already exists.
+func ProvisionUser(username, publicKey string, registered bool) (bool, error) {
+	existing, err := LookupUser(username)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		if existing.IsRegistered == registered && existing.PublicKey == publicKey {
+			return false, nil
+		}
+		return false, ErrUserConflict
+	}
+
+	// Create in database
+	db := database.GetDatabase()
+	if db != nil {
+		if _, err := db.CreateUser(username); err != nil {
+			return false, fmt.Errorf("failed to create user: %v", err)
+		}
+		if registered {
+			if err := db.SetUserRegistered(username, true); err != nil {
+				return false, fmt.Errorf("failed to set user registered: %v", err)
+			}
+		}
+		if publicKey != "" {
+			if err := db.UpdateUserPublicKey(username, publicKey); err != nil {
+				return false, fmt.Errorf("failed to update user public key: %v", err)
+			}
+		}
+		log.Printf("Provisioned user: %s", username)
+		return true, nil
+	}
+
+	// Fallback to memory
+	types.UsersMutex.Lock()
+	defer types.UsersMutex.Unlock()
+
+	types.Users[username] = &types.User{
+		ID:           types.NextUserID,
+		Username:     username,
+		Created:      time.Now(),
+		PublicKey:    publicKey,
+		IsRegistered: registered,
+	}
+	types.NextUserID++
+	log.Printf("Provisioned user: %s", username)
+	return true, nil
+}
+
+// ExportUserData returns everything stored about a user, or nil if the user doesn't exist
+func ExportUserData(username string) (*database.UserData, error) {
+	db := database.GetDatabase()
+	if db == nil {
+		return nil, ErrDatabaseUnavailable
+	}
+	return database.ExportUserData(db, username)
+}
+
+// DeleteUserData removes a user with all their credentials, sessions and audit events
+func DeleteUserData(username string) error {
+	db := database.GetDatabase()
+	if db == nil {
+		return ErrDatabaseUnavailable
+	}
+	if err := db.DeleteUserData(username); err != nil {
+		return err
+	}
+
+	// Also remove from memory
+	types.SessionMutex.Lock()
+	for id, session := range types.Sessions {
+		if session.Username == username {
+			delete(types.Sessions, id)
+		}
+	}
+	types.SessionMutex.Unlock()
+
+	types.UsersMutex.Lock()
+	delete(types.Users, username)
+	types.UsersMutex.Unlock()
+
+	log.Printf("Deleted all data for user: %s", username)
+	return nil
+}
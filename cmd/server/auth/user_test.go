@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"testing"
+
+	"chapp/pkg/database"
+)
+
+// TestGetUserByID tests that a created user is retrievable by its ID
+func TestGetUserByID(t *testing.T) {
+	database.SetDatabase(database.NewMemory())
+	defer database.SetDatabase(nil)
+
+	user := CreateUserForRegistration("idlookup")
+	if user == nil {
+		t.Fatal("User should be created")
+	}
+
+	found := GetUserByID(user.ID)
+	if found == nil {
+		t.Fatal("User should be found by ID")
+	}
+
+	if found.Username != "idlookup" {
+		t.Errorf("Expected username 'idlookup', got '%s'", found.Username)
+	}
+
+	if GetUserByID(user.ID+1000) != nil {
+		t.Error("Unknown ID should return nil")
+	}
+}
+
+// TestGetUserByIDMemoryFallback tests ID lookup without a database
+func TestGetUserByIDMemoryFallback(t *testing.T) {
+	user := CreateUserForRegistration("memoryidlookup")
+	if user == nil || user.ID == 0 {
+		t.Fatal("User should be created with an ID")
+	}
+
+	found := GetUserByID(user.ID)
+	if found == nil || found.Username != "memoryidlookup" {
+		t.Errorf("Expected user 'memoryidlookup', got %v", found)
+	}
+}
+
+// TestFindUserByCredentialID tests resolving a credential's owner through its user ID
+func TestFindUserByCredentialID(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	user := CreateUserForRegistration("credowner")
+	if err := db.StoreCredential(user.ID, "owned-credential", "data", ""); err != nil {
+		t.Fatalf("Failed to store credential: %v", err)
+	}
+
+	found := FindUserByCredentialID("owned-credential")
+	if found == nil || found.Username != "credowner" {
+		t.Errorf("Expected user 'credowner', got %v", found)
+	}
+
+	if FindUserByCredentialID("unknown-credential") != nil {
+		t.Error("Unknown credential should return nil")
+	}
+}
@@ -3,22 +3,25 @@ package auth
 import (
 	"log"
 
+	"chapp/cmd/server/config"
+
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 // WebAuthn configuration
 var webAuthn *webauthn.WebAuthn
 
-// initializeWebAuthn sets up the WebAuthn configuration
+// initializeWebAuthn sets up the WebAuthn configuration for the configured relying party
 func initializeWebAuthn() {
-	config := &webauthn.Config{
+	cfg := config.GetConfig()
+	rp := &webauthn.Config{
 		RPDisplayName: "Chapp",
-		RPID:          "localhost",                       // Change this for production
-		RPOrigins:     []string{"http://localhost:8080"}, // Change this for production
+		RPID:          cfg.RPID,
+		RPOrigins:     cfg.RPOrigins,
 	}
 
 	var err error
-	webAuthn, err = webauthn.New(config)
+	webAuthn, err = webauthn.New(rp)
 	if err != nil {
 		log.Fatal("Failed to initialize WebAuthn:", err)
 	}
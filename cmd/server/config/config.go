@@ -0,0 +1,416 @@
+package config
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the server settings
+type Config struct {
+	Addr              string         // Listen address of the static server
+	Admins            []string       // Usernames allowed to use admin endpoints
+	AllowGuests       bool           // Accept unregistered guest connections on the WebSocket server
+	DBPath            string         // SQLite database file
+	DBBatchInterval   time.Duration  // Batch audit inserts, flushing at this interval (0 disables)
+	EncryptedRouting  string         // "broadcast" relays encrypted messages without a recipient to everyone; "directed" refuses them
+	IdleAway          time.Duration  // Web clients mark themselves away after this long without input (0 disables)
+	IdleDisconnect    time.Duration  // Web clients disconnect after this long without input (0 disables)
+	MaxClients        int            // Maximum connected WebSocket clients (0 means unlimited)
+	MaxRooms          int            // Maximum rooms in use (0 means unlimited)
+	MaxRoomMembers    int            // Maximum connections per room (0 means unlimited)
+	MaxRoomsPerClient int            // Maximum rooms one connection may be in (0 means unlimited)
+	RedisAddr         string         // Redis server shared by WebSocket server instances (empty keeps broadcasts in-process)
+	RPID              string         // WebAuthn relying party ID, the domain passkeys are bound to
+	RPOrigins         []string       // Origins the browser may report during WebAuthn ceremonies
+	SessionTTL        time.Duration  // How long a login session lasts
+	TrustedProxies    []netip.Prefix // Peers whose X-Forwarded-For/X-Real-IP headers are honored
+	WSAddr            string         // Listen address of the WebSocket server
+	Cookie            CookiePolicy
+	Username          UsernamePolicy
+	WebAuthn          WebAuthnPolicy
+}
+
+// UsernamePolicy controls which usernames can be registered
+type UsernamePolicy struct {
+	MinLength    int
+	MaxLength    int
+	AllowedChars string // Every character a username may contain
+}
+
+// DefaultUsernameChars allows ASCII letters, digits, underscores and hyphens
+const DefaultUsernameChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-"
+
+// Validate checks a username against the policy, describing the first failure
+func (p UsernamePolicy) Validate(username string) error {
+	length := len([]rune(username))
+	if length < p.MinLength {
+		return fmt.Errorf("Username must be at least %d characters", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("Username must be at most %d characters", p.MaxLength)
+	}
+	for _, char := range username {
+		if !strings.ContainsRune(p.AllowedChars, char) {
+			return fmt.Errorf("Username contains disallowed character %q", char)
+		}
+	}
+	return nil
+}
+
+// WebAuthnPolicy controls the authenticators accepted at registration; values use the WebAuthn spec's names
+type WebAuthnPolicy struct {
+	AuthenticatorAttachment string // "platform", "cross-platform", or empty for either
+	ResidentKey             string // "discouraged", "preferred" or "required"
+	UserVerification        string // "discouraged", "preferred" or "required"
+	Attestation             string // "none", "indirect", "direct" or "enterprise"
+}
+
+// Validate checks that every setting is a value the WebAuthn spec defines
+func (p WebAuthnPolicy) Validate() error {
+	if !contains([]string{"", "platform", "cross-platform"}, p.AuthenticatorAttachment) {
+		return fmt.Errorf("webauthn.authenticator_attachment must be platform or cross-platform, got %q", p.AuthenticatorAttachment)
+	}
+	requirements := []string{"discouraged", "preferred", "required"}
+	if !contains(requirements, p.ResidentKey) {
+		return fmt.Errorf("webauthn.resident_key must be discouraged, preferred or required, got %q", p.ResidentKey)
+	}
+	if !contains(requirements, p.UserVerification) {
+		return fmt.Errorf("webauthn.user_verification must be discouraged, preferred or required, got %q", p.UserVerification)
+	}
+	if !contains([]string{"none", "indirect", "direct", "enterprise"}, p.Attestation) {
+		return fmt.Errorf("webauthn.attestation must be none, indirect, direct or enterprise, got %q", p.Attestation)
+	}
+	return nil
+}
+
+// CookiePolicy controls the attributes of the session cookie
+type CookiePolicy struct {
+	SameSite string // "lax", "strict" or "none"
+	Secure   string // "auto" (when the request arrived over TLS), "always" or "never"
+	Domain   string // Cookie domain, or empty for the host that set it
+}
+
+// Validate checks the cookie settings, including combinations browsers reject
+func (p CookiePolicy) Validate() error {
+	if !contains([]string{"lax", "strict", "none"}, p.SameSite) {
+		return fmt.Errorf("cookie.same_site must be lax, strict or none, got %q", p.SameSite)
+	}
+	if !contains([]string{"auto", "always", "never"}, p.Secure) {
+		return fmt.Errorf("cookie.secure must be auto, always or never, got %q", p.Secure)
+	}
+	if p.SameSite == "none" && p.Secure == "never" {
+		return fmt.Errorf("cookie.same_site none requires a secure cookie")
+	}
+	return nil
+}
+
+var (
+	current = Default()
+	mu      sync.RWMutex
+)
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		Addr: ":8080",
+		Cookie: CookiePolicy{
+			SameSite: "lax",
+			Secure:   "auto",
+		},
+		DBPath:            "chapp.db",
+		EncryptedRouting:  "broadcast",
+		IdleAway:          5 * time.Minute,
+		MaxRoomsPerClient: 20,
+		RPID:              "localhost",
+		RPOrigins:         []string{"http://localhost:8080"},
+		SessionTTL:        24 * time.Hour,
+		Username: UsernamePolicy{
+			MinLength:    2,
+			MaxLength:    20,
+			AllowedChars: DefaultUsernameChars,
+		},
+		WebAuthn: WebAuthnPolicy{
+			ResidentKey:      "discouraged",
+			UserVerification: "preferred",
+			Attestation:      "none",
+		},
+		WSAddr: ":8081",
+	}
+}
+
+// FromEnv builds a configuration from environment variables, using defaults for unset values
+func FromEnv() *Config {
+	cfg := Default()
+	applyEnv(cfg)
+	return cfg
+}
+
+// Load builds the configuration from defaults, then the JSON file named by CHAPP_CONFIG (if set),
+// then environment variables, and validates the result
+func Load() (*Config, error) {
+	cfg := Default()
+
+	if path := os.Getenv("CHAPP_CONFIG"); path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	applyEnv(cfg)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the settings are usable
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("addr must be host:port or :port, got %q", c.Addr)
+	}
+	if _, _, err := net.SplitHostPort(c.WSAddr); err != nil {
+		return fmt.Errorf("ws_addr must be host:port or :port, got %q", c.WSAddr)
+	}
+	if c.DBPath == "" {
+		return fmt.Errorf("db_path is required")
+	}
+	if c.DBBatchInterval < 0 {
+		return fmt.Errorf("db_batch_interval must not be negative")
+	}
+	if c.EncryptedRouting != "broadcast" && c.EncryptedRouting != "directed" {
+		return fmt.Errorf("encrypted_routing must be broadcast or directed, got %q", c.EncryptedRouting)
+	}
+	if c.IdleAway < 0 {
+		return fmt.Errorf("idle_away must not be negative")
+	}
+	if c.IdleDisconnect < 0 {
+		return fmt.Errorf("idle_disconnect must not be negative")
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients must not be negative")
+	}
+	if c.MaxRooms < 0 {
+		return fmt.Errorf("max_rooms must not be negative")
+	}
+	if c.MaxRoomMembers < 0 {
+		return fmt.Errorf("max_room_members must not be negative")
+	}
+	if c.MaxRoomsPerClient < 0 {
+		return fmt.Errorf("max_rooms_per_client must not be negative")
+	}
+	if c.RPID == "" {
+		return fmt.Errorf("rp_id is required")
+	}
+	if len(c.RPOrigins) == 0 {
+		return fmt.Errorf("rp_origins must list at least one origin")
+	}
+	for _, origin := range c.RPOrigins {
+		if err := validateOrigin(origin, c.RPID); err != nil {
+			return err
+		}
+	}
+	if c.SessionTTL <= 0 {
+		return fmt.Errorf("session_ttl must be positive")
+	}
+	if c.Username.MinLength < 1 {
+		return fmt.Errorf("username.min_length must be at least 1")
+	}
+	if c.Username.MaxLength != 0 && c.Username.MaxLength < c.Username.MinLength {
+		return fmt.Errorf("username.max_length must not be less than username.min_length")
+	}
+	if c.Username.AllowedChars == "" {
+		return fmt.Errorf("username.allowed_chars must not be empty")
+	}
+	if err := c.Cookie.Validate(); err != nil {
+		return err
+	}
+	return c.WebAuthn.Validate()
+}
+
+// validateOrigin checks that an origin is a bare http(s) URL on the relying party's domain,
+// since browsers only allow an RP ID that is the origin's host or a parent domain of it
+func validateOrigin(origin, rpID string) error {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return fmt.Errorf("rp_origins entry %q must be an http or https origin such as https://chat.example.com", origin)
+	}
+	host := u.Hostname()
+	if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+		return fmt.Errorf("rp_origins entry %q is not on the rp_id domain %q", origin, rpID)
+	}
+	return nil
+}
+
+// applyEnv overrides settings with any environment variables that are set
+func applyEnv(cfg *Config) {
+	if addr := os.Getenv("CHAPP_ADDR"); addr != "" {
+		cfg.Addr = addr
+	}
+
+	if wsAddr := os.Getenv("CHAPP_WS_ADDR"); wsAddr != "" {
+		cfg.WSAddr = wsAddr
+	}
+
+	if admins := os.Getenv("CHAPP_ADMINS"); admins != "" {
+		cfg.Admins = strings.Split(admins, ",")
+	}
+
+	if allowGuests, err := strconv.ParseBool(os.Getenv("CHAPP_ALLOW_GUESTS")); err == nil {
+		cfg.AllowGuests = allowGuests
+	}
+
+	if sameSite := os.Getenv("CHAPP_COOKIE_SAMESITE"); sameSite != "" {
+		cfg.Cookie.SameSite = sameSite
+	}
+
+	if secure := os.Getenv("CHAPP_COOKIE_SECURE"); secure != "" {
+		cfg.Cookie.Secure = secure
+	}
+
+	if domain, ok := os.LookupEnv("CHAPP_COOKIE_DOMAIN"); ok {
+		cfg.Cookie.Domain = domain
+	}
+
+	if interval, err := time.ParseDuration(os.Getenv("CHAPP_DB_BATCH_INTERVAL")); err == nil {
+		cfg.DBBatchInterval = interval
+	}
+
+	if routing := os.Getenv("CHAPP_ENCRYPTED_ROUTING"); routing != "" {
+		cfg.EncryptedRouting = routing
+	}
+
+	if idleAway, err := time.ParseDuration(os.Getenv("CHAPP_IDLE_AWAY")); err == nil {
+		cfg.IdleAway = idleAway
+	}
+
+	if idleDisconnect, err := time.ParseDuration(os.Getenv("CHAPP_IDLE_DISCONNECT")); err == nil {
+		cfg.IdleDisconnect = idleDisconnect
+	}
+
+	if maxClients, err := strconv.Atoi(os.Getenv("CHAPP_MAX_CLIENTS")); err == nil {
+		cfg.MaxClients = maxClients
+	}
+
+	if minLength, err := strconv.Atoi(os.Getenv("CHAPP_USERNAME_MIN_LENGTH")); err == nil {
+		cfg.Username.MinLength = minLength
+	}
+
+	if maxLength, err := strconv.Atoi(os.Getenv("CHAPP_USERNAME_MAX_LENGTH")); err == nil {
+		cfg.Username.MaxLength = maxLength
+	}
+
+	if chars := os.Getenv("CHAPP_USERNAME_CHARS"); chars != "" {
+		cfg.Username.AllowedChars = chars
+	}
+
+	if maxRooms, err := strconv.Atoi(os.Getenv("CHAPP_MAX_ROOMS")); err == nil {
+		cfg.MaxRooms = maxRooms
+	}
+
+	if maxRoomMembers, err := strconv.Atoi(os.Getenv("CHAPP_MAX_ROOM_MEMBERS")); err == nil {
+		cfg.MaxRoomMembers = maxRoomMembers
+	}
+
+	if maxRoomsPerClient, err := strconv.Atoi(os.Getenv("CHAPP_MAX_ROOMS_PER_CLIENT")); err == nil {
+		cfg.MaxRoomsPerClient = maxRoomsPerClient
+	}
+
+	if redisAddr, ok := os.LookupEnv("CHAPP_REDIS_ADDR"); ok {
+		cfg.RedisAddr = redisAddr
+	}
+
+	if rpID := os.Getenv("CHAPP_RP_ID"); rpID != "" {
+		cfg.RPID = rpID
+	}
+
+	if origins := os.Getenv("CHAPP_RP_ORIGINS"); origins != "" {
+		cfg.RPOrigins = splitList(origins)
+	}
+
+	if sessionTTL, err := time.ParseDuration(os.Getenv("CHAPP_SESSION_TTL")); err == nil {
+		cfg.SessionTTL = sessionTTL
+	}
+
+	if proxies := os.Getenv("CHAPP_TRUSTED_PROXIES"); proxies != "" {
+		cfg.TrustedProxies = ParseTrustedProxies(proxies)
+	}
+
+	if dbPath := os.Getenv("CHAPP_DB_PATH"); dbPath != "" {
+		cfg.DBPath = dbPath
+	}
+
+	if attachment, ok := os.LookupEnv("CHAPP_WEBAUTHN_ATTACHMENT"); ok {
+		cfg.WebAuthn.AuthenticatorAttachment = attachment
+	}
+
+	if residentKey := os.Getenv("CHAPP_WEBAUTHN_RESIDENT_KEY"); residentKey != "" {
+		cfg.WebAuthn.ResidentKey = residentKey
+	}
+
+	if userVerification := os.Getenv("CHAPP_WEBAUTHN_USER_VERIFICATION"); userVerification != "" {
+		cfg.WebAuthn.UserVerification = userVerification
+	}
+
+	if attestation := os.Getenv("CHAPP_WEBAUTHN_ATTESTATION"); attestation != "" {
+		cfg.WebAuthn.Attestation = attestation
+	}
+}
+
+// splitList splits a comma-separated list, trimming spaces and skipping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseTrustedProxies parses a comma-separated list of IPs and CIDR ranges, skipping invalid entries
+func ParseTrustedProxies(value string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q", entry)
+			continue
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+// SetConfig sets the global configuration
+func SetConfig(cfg *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = cfg
+}
+
+// GetConfig returns the global configuration
+func GetConfig() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
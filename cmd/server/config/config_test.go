@@ -0,0 +1,315 @@
+package config
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDefaultUsernamePolicy tests the default registration rules
+func TestDefaultUsernamePolicy(t *testing.T) {
+	policy := Default().Username
+
+	tests := []struct {
+		username string
+		valid    bool
+	}{
+		{"a", false},
+		{"ab", true},
+		{strings.Repeat("a", 20), true},
+		{strings.Repeat("a", 21), false},
+		{"user_name-1", true},
+		{"user.name", false},
+		{"user name", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			err := policy.Validate(tt.username)
+			if tt.valid && err != nil {
+				t.Errorf("Expected '%s' to be valid, got %v", tt.username, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("Expected '%s' to be rejected", tt.username)
+			}
+		})
+	}
+}
+
+// TestCustomUsernamePolicy tests boundary lengths and disallowed characters under a custom policy
+func TestCustomUsernamePolicy(t *testing.T) {
+	policy := UsernamePolicy{
+		MinLength:    3,
+		MaxLength:    8,
+		AllowedChars: "abcdefghijklmnopqrstuvwxyz.",
+	}
+
+	tests := []struct {
+		username string
+		expected string
+	}{
+		{"ab", "Username must be at least 3 characters"},
+		{"abc", ""},
+		{"abcdefgh", ""},
+		{"abcdefghi", "Username must be at most 8 characters"},
+		{"a.b.c", ""},
+		{"a_b", "Username contains disallowed character '_'"},
+		{"Abc", "Username contains disallowed character 'A'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			err := policy.Validate(tt.username)
+			if tt.expected == "" {
+				if err != nil {
+					t.Errorf("Expected '%s' to be valid, got %v", tt.username, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("Expected error '%s', got %v", tt.expected, err)
+			}
+		})
+	}
+}
+
+// TestFromEnvUsernamePolicy tests reading the username policy from the environment
+func TestFromEnvUsernamePolicy(t *testing.T) {
+	t.Setenv("CHAPP_USERNAME_MIN_LENGTH", "4")
+	t.Setenv("CHAPP_USERNAME_MAX_LENGTH", "12")
+	t.Setenv("CHAPP_USERNAME_CHARS", "abc.")
+
+	policy := FromEnv().Username
+	if policy.MinLength != 4 || policy.MaxLength != 12 || policy.AllowedChars != "abc." {
+		t.Errorf("Expected policy {4 12 abc.}, got %+v", policy)
+	}
+}
+
+// TestParseTrustedProxies tests parsing IPs and CIDR ranges
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes := ParseTrustedProxies("10.0.0.0/8, 192.0.2.1,,bogus, ::1")
+
+	expected := []string{"10.0.0.0/8", "192.0.2.1/32", "::1/128"}
+	if len(prefixes) != len(expected) {
+		t.Fatalf("Expected %d prefixes, got %v", len(expected), prefixes)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != expected[i] {
+			t.Errorf("Expected '%s', got '%s'", expected[i], prefix)
+		}
+	}
+}
+
+// writeConfigFile writes a config file in a temp dir and points CHAPP_CONFIG at it
+func writeConfigFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "chapp.json")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("CHAPP_CONFIG", path)
+	return path
+}
+
+// TestLoadPrecedence tests that env vars override the file and the file overrides defaults
+func TestLoadPrecedence(t *testing.T) {
+	writeConfigFile(t, `{
+		"db_path": "/var/lib/chapp/chapp.db",
+		"db_batch_interval": "50ms",
+		"max_clients": 100,
+		"max_rooms": 10,
+		"max_rooms_per_client": 5,
+		"idle_disconnect": "30m",
+		"encrypted_routing": "directed",
+		"redis_addr": "redis:6379",
+		"addr": "127.0.0.1:9080",
+		"rp_id": "example.com",
+		"rp_origins": ["https://chat.example.com"],
+		"session_ttl": "12h",
+		"admins": ["alice"],
+		"username": {"min_length": 3}
+	}`)
+	t.Setenv("CHAPP_MAX_CLIENTS", "25")
+	t.Setenv("CHAPP_ADMINS", "bob,carol")
+	t.Setenv("CHAPP_RP_ORIGINS", "https://chat.example.com, https://example.com:8443")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	// From the file
+	if cfg.DBPath != "/var/lib/chapp/chapp.db" {
+		t.Errorf("Expected db path from file, got '%s'", cfg.DBPath)
+	}
+	if cfg.DBBatchInterval != 50*time.Millisecond {
+		t.Errorf("Expected 50ms batch interval, got %v", cfg.DBBatchInterval)
+	}
+	if cfg.MaxRooms != 10 {
+		t.Errorf("Expected 10 max rooms, got %d", cfg.MaxRooms)
+	}
+	if cfg.MaxRoomsPerClient != 5 {
+		t.Errorf("Expected 5 max rooms per client, got %d", cfg.MaxRoomsPerClient)
+	}
+	if cfg.EncryptedRouting != "directed" {
+		t.Errorf("Expected directed routing from file, got '%s'", cfg.EncryptedRouting)
+	}
+	if cfg.RedisAddr != "redis:6379" {
+		t.Errorf("Expected redis address from file, got '%s'", cfg.RedisAddr)
+	}
+	if cfg.Username.MinLength != 3 {
+		t.Errorf("Expected min length 3, got %d", cfg.Username.MinLength)
+	}
+	if cfg.IdleDisconnect != 30*time.Minute {
+		t.Errorf("Expected 30m idle disconnect, got %v", cfg.IdleDisconnect)
+	}
+	if cfg.Addr != "127.0.0.1:9080" || cfg.RPID != "example.com" {
+		t.Errorf("Expected addr and rp_id from file, got '%s' and '%s'", cfg.Addr, cfg.RPID)
+	}
+	if cfg.SessionTTL != 12*time.Hour {
+		t.Errorf("Expected 12h session TTL, got %v", cfg.SessionTTL)
+	}
+
+	// Env overrides the file
+	if cfg.MaxClients != 25 {
+		t.Errorf("Expected env to override max clients to 25, got %d", cfg.MaxClients)
+	}
+	if len(cfg.Admins) != 2 || cfg.Admins[0] != "bob" {
+		t.Errorf("Expected env admins, got %v", cfg.Admins)
+	}
+	if len(cfg.RPOrigins) != 2 || cfg.RPOrigins[1] != "https://example.com:8443" {
+		t.Errorf("Expected env origins, got %v", cfg.RPOrigins)
+	}
+
+	// Defaults fill the rest
+	if cfg.Username.MaxLength != 20 || cfg.Username.AllowedChars != DefaultUsernameChars {
+		t.Errorf("Expected default max length and chars, got %+v", cfg.Username)
+	}
+	if cfg.IdleAway != 5*time.Minute {
+		t.Errorf("Expected default 5m idle away, got %v", cfg.IdleAway)
+	}
+	if cfg.WSAddr != ":8081" {
+		t.Errorf("Expected default WebSocket address ':8081', got '%s'", cfg.WSAddr)
+	}
+}
+
+// TestLoadWebAuthnPolicy tests that the WebAuthn policy is read from the file and env
+func TestLoadWebAuthnPolicy(t *testing.T) {
+	writeConfigFile(t, `{"webauthn": {"authenticator_attachment": "platform", "resident_key": "required"}}`)
+	t.Setenv("CHAPP_WEBAUTHN_ATTESTATION", "direct")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	expected := WebAuthnPolicy{
+		AuthenticatorAttachment: "platform",
+		ResidentKey:             "required",
+		UserVerification:        "preferred",
+		Attestation:             "direct",
+	}
+	if cfg.WebAuthn != expected {
+		t.Errorf("Expected %+v, got %+v", expected, cfg.WebAuthn)
+	}
+}
+
+// TestLoadCookiePolicy tests that the cookie policy is read from the file and env
+func TestLoadCookiePolicy(t *testing.T) {
+	writeConfigFile(t, `{"cookie": {"same_site": "strict", "domain": "chat.example.com"}}`)
+	t.Setenv("CHAPP_COOKIE_SECURE", "always")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	expected := CookiePolicy{SameSite: "strict", Secure: "always", Domain: "chat.example.com"}
+	if cfg.Cookie != expected {
+		t.Errorf("Expected %+v, got %+v", expected, cfg.Cookie)
+	}
+}
+
+// TestLoadWithoutFile tests that Load works from env and defaults alone
+func TestLoadWithoutFile(t *testing.T) {
+	t.Setenv("CHAPP_CONFIG", "")
+	t.Setenv("CHAPP_DB_PATH", "test.db")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if cfg.DBPath != "test.db" {
+		t.Errorf("Expected db path 'test.db', got '%s'", cfg.DBPath)
+	}
+}
+
+// TestLoadValidation tests that bad files and invalid settings are rejected
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected string
+	}{
+		{"malformed", `{"max_clients": `, "failed to parse config file"},
+		{"wrong type", `{"max_clients": "many"}`, "failed to parse config file"},
+		{"bad duration", `{"db_batch_interval": "soon"}`, "invalid db_batch_interval"},
+		{"negative limit", `{"max_rooms": -1}`, "max_rooms must not be negative"},
+		{"bad idle duration", `{"idle_disconnect": "later"}`, "invalid idle_disconnect"},
+		{"empty db path", `{"db_path": ""}`, "db_path is required"},
+		{"inverted lengths", `{"username": {"min_length": 10, "max_length": 5}}`, "username.max_length must not be less than username.min_length"},
+		{"bad encrypted routing", `{"encrypted_routing": "private"}`, "encrypted_routing must be broadcast or directed"},
+		{"bad same site", `{"cookie": {"same_site": "loose"}}`, "cookie.same_site must be lax, strict or none"},
+		{"insecure same site none", `{"cookie": {"same_site": "none", "secure": "never"}}`, "cookie.same_site none requires a secure cookie"},
+		{"bad attachment", `{"webauthn": {"authenticator_attachment": "usb"}}`, "webauthn.authenticator_attachment must be platform or cross-platform"},
+		{"bad attestation", `{"webauthn": {"attestation": "full"}}`, "webauthn.attestation must be none, indirect, direct or enterprise"},
+		{"bad addr", `{"addr": "8080"}`, "addr must be host:port or :port"},
+		{"bad ws addr", `{"ws_addr": "localhost"}`, "ws_addr must be host:port or :port"},
+		{"empty rp id", `{"rp_id": ""}`, "rp_id is required"},
+		{"no origins", `{"rp_origins": []}`, "rp_origins must list at least one origin"},
+		{"origin with path", `{"rp_origins": ["http://localhost:8080/login"]}`, "must be an http or https origin"},
+		{"origin off rp domain", `{"rp_id": "example.com", "rp_origins": ["https://example.org"]}`, "is not on the rp_id domain"},
+		{"origin suffix without dot", `{"rp_id": "example.com", "rp_origins": ["https://badexample.com"]}`, "is not on the rp_id domain"},
+		{"bad session ttl", `{"session_ttl": "a day"}`, "invalid session_ttl"},
+		{"zero session ttl", `{"session_ttl": "0s"}`, "session_ttl must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfigFile(t, tt.contents)
+
+			_, err := Load()
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Expected error containing '%s', got %v", tt.expected, err)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("CHAPP_CONFIG", filepath.Join(t.TempDir(), "missing.json"))
+		if _, err := Load(); err == nil || !strings.Contains(err.Error(), "failed to read config file") {
+			t.Errorf("Expected a read error, got %v", err)
+		}
+	})
+}
+
+// TestLoadUnknownKeys tests that unknown keys are warned about but not fatal
+func TestLoadUnknownKeys(t *testing.T) {
+	writeConfigFile(t, `{"max_client": 5, "username": {"min_len": 3}, "webauthn": {"attachment": "platform"}}`)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	if _, err := Load(); err != nil {
+		t.Fatalf("Expected unknown keys to be ignored, got %v", err)
+	}
+	for _, key := range []string{`"max_client"`, `"username.min_len"`, `"webauthn.attachment"`} {
+		if !strings.Contains(logs.String(), key) {
+			t.Errorf("Expected a warning for %s, got '%s'", key, logs.String())
+		}
+	}
+}
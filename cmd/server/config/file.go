@@ -0,0 +1,226 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileConfig mirrors Config for JSON config files; nil fields leave the current value untouched
+type fileConfig struct {
+	Addr              *string  `json:"addr"`
+	Admins            []string `json:"admins"`
+	AllowGuests       *bool    `json:"allow_guests"`
+	DBPath            *string  `json:"db_path"`
+	DBBatchInterval   *string  `json:"db_batch_interval"`
+	EncryptedRouting  *string  `json:"encrypted_routing"`
+	IdleAway          *string  `json:"idle_away"`
+	IdleDisconnect    *string  `json:"idle_disconnect"`
+	MaxClients        *int     `json:"max_clients"`
+	MaxRooms          *int     `json:"max_rooms"`
+	MaxRoomMembers    *int     `json:"max_room_members"`
+	MaxRoomsPerClient *int     `json:"max_rooms_per_client"`
+	RedisAddr         *string  `json:"redis_addr"`
+	RPID              *string  `json:"rp_id"`
+	RPOrigins         []string `json:"rp_origins"`
+	SessionTTL        *string  `json:"session_ttl"`
+	TrustedProxies    []string `json:"trusted_proxies"`
+	WSAddr            *string  `json:"ws_addr"`
+	Cookie            *struct {
+		SameSite *string `json:"same_site"`
+		Secure   *string `json:"secure"`
+		Domain   *string `json:"domain"`
+	} `json:"cookie"`
+	Username *struct {
+		MinLength    *int    `json:"min_length"`
+		MaxLength    *int    `json:"max_length"`
+		AllowedChars *string `json:"allowed_chars"`
+	} `json:"username"`
+	WebAuthn *struct {
+		AuthenticatorAttachment *string `json:"authenticator_attachment"`
+		ResidentKey             *string `json:"resident_key"`
+		UserVerification        *string `json:"user_verification"`
+		Attestation             *string `json:"attestation"`
+	} `json:"webauthn"`
+}
+
+// Known keys, used to warn about typos in config files
+var (
+	fileKeys = []string{
+		"addr", "admins", "allow_guests", "cookie", "db_path", "db_batch_interval", "encrypted_routing", "idle_away", "idle_disconnect", "max_clients",
+		"max_rooms", "max_room_members", "max_rooms_per_client", "redis_addr", "rp_id", "rp_origins", "session_ttl", "trusted_proxies", "username",
+		"webauthn", "ws_addr",
+	}
+	cookieKeys   = []string{"same_site", "secure", "domain"}
+	usernameKeys = []string{"min_length", "max_length", "allowed_chars"}
+	webAuthnKeys = []string{"authenticator_attachment", "resident_key", "user_verification", "attestation"}
+)
+
+// LoadFile applies the settings from a JSON config file, logging a warning for unknown keys
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var file fileConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	for _, key := range unknownKeys(data, "", fileKeys) {
+		log.Printf("Ignoring unknown config key %q in %s", key, path)
+	}
+
+	if file.Addr != nil {
+		c.Addr = *file.Addr
+	}
+	if file.Admins != nil {
+		c.Admins = file.Admins
+	}
+	if file.AllowGuests != nil {
+		c.AllowGuests = *file.AllowGuests
+	}
+	if file.Cookie != nil {
+		if file.Cookie.SameSite != nil {
+			c.Cookie.SameSite = *file.Cookie.SameSite
+		}
+		if file.Cookie.Secure != nil {
+			c.Cookie.Secure = *file.Cookie.Secure
+		}
+		if file.Cookie.Domain != nil {
+			c.Cookie.Domain = *file.Cookie.Domain
+		}
+	}
+	if file.DBPath != nil {
+		c.DBPath = *file.DBPath
+	}
+	if file.DBBatchInterval != nil {
+		interval, err := time.ParseDuration(*file.DBBatchInterval)
+		if err != nil {
+			return fmt.Errorf("invalid db_batch_interval in %s: %v", path, err)
+		}
+		c.DBBatchInterval = interval
+	}
+	if file.EncryptedRouting != nil {
+		c.EncryptedRouting = *file.EncryptedRouting
+	}
+	if file.IdleAway != nil {
+		idleAway, err := time.ParseDuration(*file.IdleAway)
+		if err != nil {
+			return fmt.Errorf("invalid idle_away in %s: %v", path, err)
+		}
+		c.IdleAway = idleAway
+	}
+	if file.IdleDisconnect != nil {
+		idleDisconnect, err := time.ParseDuration(*file.IdleDisconnect)
+		if err != nil {
+			return fmt.Errorf("invalid idle_disconnect in %s: %v", path, err)
+		}
+		c.IdleDisconnect = idleDisconnect
+	}
+	if file.MaxClients != nil {
+		c.MaxClients = *file.MaxClients
+	}
+	if file.MaxRooms != nil {
+		c.MaxRooms = *file.MaxRooms
+	}
+	if file.MaxRoomMembers != nil {
+		c.MaxRoomMembers = *file.MaxRoomMembers
+	}
+	if file.MaxRoomsPerClient != nil {
+		c.MaxRoomsPerClient = *file.MaxRoomsPerClient
+	}
+	if file.RedisAddr != nil {
+		c.RedisAddr = *file.RedisAddr
+	}
+	if file.RPID != nil {
+		c.RPID = *file.RPID
+	}
+	if file.RPOrigins != nil {
+		c.RPOrigins = file.RPOrigins
+	}
+	if file.SessionTTL != nil {
+		sessionTTL, err := time.ParseDuration(*file.SessionTTL)
+		if err != nil {
+			return fmt.Errorf("invalid session_ttl in %s: %v", path, err)
+		}
+		c.SessionTTL = sessionTTL
+	}
+	if file.TrustedProxies != nil {
+		c.TrustedProxies = ParseTrustedProxies(strings.Join(file.TrustedProxies, ","))
+	}
+	if file.Username != nil {
+		if file.Username.MinLength != nil {
+			c.Username.MinLength = *file.Username.MinLength
+		}
+		if file.Username.MaxLength != nil {
+			c.Username.MaxLength = *file.Username.MaxLength
+		}
+		if file.Username.AllowedChars != nil {
+			c.Username.AllowedChars = *file.Username.AllowedChars
+		}
+	}
+	if file.WebAuthn != nil {
+		if file.WebAuthn.AuthenticatorAttachment != nil {
+			c.WebAuthn.AuthenticatorAttachment = *file.WebAuthn.AuthenticatorAttachment
+		}
+		if file.WebAuthn.ResidentKey != nil {
+			c.WebAuthn.ResidentKey = *file.WebAuthn.ResidentKey
+		}
+		if file.WebAuthn.UserVerification != nil {
+			c.WebAuthn.UserVerification = *file.WebAuthn.UserVerification
+		}
+		if file.WebAuthn.Attestation != nil {
+			c.WebAuthn.Attestation = *file.WebAuthn.Attestation
+		}
+	}
+	if file.WSAddr != nil {
+		c.WSAddr = *file.WSAddr
+	}
+
+	return nil
+}
+
+// unknownKeys returns the keys of a JSON object, and of its nested objects, that aren't known settings
+func unknownKeys(data []byte, prefix string, known []string) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil
+	}
+
+	var unknown []string
+	for key, value := range object {
+		if prefix == "" && key == "cookie" {
+			unknown = append(unknown, unknownKeys(value, "cookie.", cookieKeys)...)
+			continue
+		}
+		if prefix == "" && key == "username" {
+			unknown = append(unknown, unknownKeys(value, "username.", usernameKeys)...)
+			continue
+		}
+		if prefix == "" && key == "webauthn" {
+			unknown = append(unknown, unknownKeys(value, "webauthn.", webAuthnKeys)...)
+			continue
+		}
+		if !contains(known, key) {
+			unknown = append(unknown, prefix+key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// contains reports whether a string is in a list
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"chapp/cmd/server/auth"
+)
+
+// ServeAccountData exports (GET) everything stored about the authenticated user as a JSON bundle,
+// or deletes (DELETE) the account and all its data
+func ServeAccountData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if err := auth.DeleteUserData(username); err != nil {
+			log.Printf("Failed to delete data for %s: %v", username, err)
+			http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, sessionCookie(r, "", -1))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	data, err := auth.ExportUserData(username)
+	if err != nil {
+		log.Printf("Failed to export data for %s: %v", username, err)
+		http.Error(w, "Failed to export account data", http.StatusInternalServerError)
+		return
+	}
+	if data == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="chapp-account.json"`)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
+	"chapp/cmd/server/types"
+	"chapp/pkg/database"
+	"chapp/pkg/keys"
+	pkgtypes "chapp/pkg/types"
+)
+
+// requireSession validates the session cookie, writing an error response if it is missing or invalid
+func requireSession(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(pkgtypes.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	session, err := auth.LookupSession(cookie.Value)
+	if err != nil {
+		log.Printf("Session lookup failed: %v", err)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return "", false
+	}
+	if session == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	return session.Username, true
+}
+
+// requireAdmin validates the session cookie and admin role, writing an error response if either is missing
+func requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := requireSession(w, r)
+	if !ok {
+		return "", false
+	}
+
+	if !auth.IsAdmin(username) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+
+	return username, true
+}
+
+// ServeAdminBroadcast pushes an operator announcement to all connected clients
+func ServeAdminBroadcast(hub *types.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Message == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+
+	announcement := pkgtypes.Message{
+		Type:      pkgtypes.MessageTypeSystem,
+		Content:   req.Message,
+		Sender:    pkgtypes.SystemSender,
+		Timestamp: time.Now().Unix(),
+	}
+	announcementBytes, _ := json.Marshal(announcement)
+	hub.Relay(announcementBytes)
+
+	log.Printf("Admin broadcast sent by %s", username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// ServeAdminAudit returns recent authentication audit events
+func ServeAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, 1000)
+	}
+
+	events := auth.GetRecentAuditEvents(limit)
+	if events == nil {
+		events = []*database.AuditEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// ProvisionUserRequest describes a user to pre-create
+type ProvisionUserRequest struct {
+	Username   string `json:"username"`
+	PublicKey  string `json:"public_key,omitempty"`
+	Registered bool   `json:"registered"`
+}
+
+// ServeAdminUsers creates users for provisioning scripts. Repeating a request is safe:
+// an identical existing user returns 200, a different one returns 409.
+func ServeAdminUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	var req ProvisionUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := config.GetConfig().Username.Validate(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.HasPrefix(req.Username, guestPrefix) {
+		http.Error(w, "Username prefix '"+guestPrefix+"' is reserved", http.StatusBadRequest)
+		return
+	}
+
+	if req.PublicKey != "" {
+		if _, err := keys.ParsePublicKey(req.PublicKey); err != nil {
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+	}
+
+	created, err := auth.ProvisionUser(req.Username, req.PublicKey, req.Registered)
+	if errors.Is(err, auth.ErrUserConflict) {
+		http.Error(w, "User already exists with different data", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, auth.ErrDatabaseUnavailable) {
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to provision user %s: %v", req.Username, err)
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+		log.Printf("User %s provisioned by %s", req.Username, admin)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(req)
+}
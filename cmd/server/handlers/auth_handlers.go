@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"encoding/json"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"strings"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
 	pkgtypes "chapp/pkg/types"
 )
 
@@ -71,19 +76,134 @@ func ServeLogout(w http.ResponseWriter, r *http.Request) {
 	// Get session cookie
 	cookie, err := r.Cookie(pkgtypes.SessionCookieName)
 	if err == nil && cookie.Value != "" {
+		if session := auth.GetSession(cookie.Value); session != nil {
+			auth.RecordAuditEvent(auth.AuditLogout, session.Username, clientIP(r))
+			auth.RecordAuditEvent(auth.AuditSessionDeleted, session.Username, clientIP(r))
+		}
+
 		// Delete session
 		auth.DeleteSession(cookie.Value)
 	}
 
 	// Clear session cookie
-	http.SetCookie(w, &http.Cookie{
+	http.SetCookie(w, sessionCookie(r, "", -1))
+
+	// Redirect to login page
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// ServeSession reports the signed-in user, or 401 once the session has expired, so clients can
+// tell an expired session from a network failure before reconnecting
+func ServeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"username": username})
+}
+
+// sessionCookie builds the session cookie with the configured attributes; a negative maxAge clears it
+func sessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
+	policy := config.GetConfig().Cookie
+
+	sameSite := http.SameSiteLaxMode
+	switch policy.SameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+
+	secure := isTLS(r)
+	switch policy.Secure {
+	case "always":
+		secure = true
+	case "never":
+		secure = false
+	}
+
+	return &http.Cookie{
 		Name:     pkgtypes.SessionCookieName,
-		Value:    "",
+		Value:    value,
 		Path:     "/",
-		MaxAge:   -1,
+		Domain:   policy.Domain,
+		MaxAge:   maxAge,
 		HttpOnly: true,
-	})
+		Secure:   secure,
+		SameSite: sameSite,
+	}
+}
 
-	// Redirect to login page
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+// isTLS reports whether the client connected over TLS, either directly or through a trusted proxy
+func isTLS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host, config.GetConfig().TrustedProxies) {
+		return false
+	}
+	return strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// clientIP returns the IP address of the client making the request. Forwarding headers
+// are only honored when the immediate peer is a trusted proxy, so clients can't spoof them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	trusted := config.GetConfig().TrustedProxies
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+
+	// Walk X-Forwarded-For from the nearest hop, skipping our own proxies
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !isTrustedProxy(hop, trusted) {
+				return hop
+			}
+		}
+		return host
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return host
+}
+
+// isTrustedProxy reports whether ip falls within one of the trusted proxy prefixes
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"chapp/cmd/server/auth"
+	"chapp/pkg/database"
+)
+
+// credentialIDPrefixLength is how much of a credential ID is shown to identify a device
+const credentialIDPrefixLength = 12
+
+// CredentialInfo describes one of the user's registered passkeys
+type CredentialInfo struct {
+	ID          string    `json:"id"` // Credential ID prefix
+	DeviceLabel string    `json:"device_label,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// ServeCredentials lists (GET) the authenticated user's passkeys or revokes one (DELETE ?id=<prefix>)
+func ServeCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "DELETE" {
+		err := auth.RevokeCredential(username, r.URL.Query().Get("id"))
+		switch {
+		case err == nil:
+			auth.RecordAuditEvent(auth.AuditCredentialRevoked, username, clientIP(r))
+			w.WriteHeader(http.StatusNoContent)
+		case errors.Is(err, database.ErrCredentialNotFound):
+			http.Error(w, "Credential not found", http.StatusNotFound)
+		case errors.Is(err, auth.ErrAmbiguousCredential):
+			http.Error(w, "Credential ID prefix is ambiguous", http.StatusBadRequest)
+		case errors.Is(err, auth.ErrLastCredential):
+			http.Error(w, "Cannot remove your last passkey", http.StatusConflict)
+		default:
+			log.Printf("Failed to revoke credential for %s: %v", username, err)
+			http.Error(w, "Failed to revoke credential", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	stored, err := auth.ListCredentials(username)
+	if err != nil {
+		log.Printf("Failed to list credentials for %s: %v", username, err)
+		http.Error(w, "Failed to list credentials", http.StatusInternalServerError)
+		return
+	}
+
+	infos := []CredentialInfo{}
+	for _, cred := range stored {
+		id := cred.CredentialID
+		if len(id) > credentialIDPrefixLength {
+			id = id[:credentialIDPrefixLength]
+		}
+		infos = append(infos, CredentialInfo{
+			ID:          id,
+			DeviceLabel: cred.DeviceLabel,
+			Created:     cred.Created,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
@@ -1,13 +1,38 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
+	"chapp/cmd/server/types"
+	"chapp/pkg/database"
 	pkgtypes "chapp/pkg/types"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gorilla/websocket"
 )
 
 // TestServeHome tests the home page serving
@@ -38,7 +63,7 @@ func TestServeHome(t *testing.T) {
 	}
 
 	// Create a valid session
-	sessionID := auth.CreateSession("testuser")
+	sessionID := createTestSession(t, "testuser")
 	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
 
 	rr = httptest.NewRecorder()
@@ -92,6 +117,50 @@ func TestServeStatic(t *testing.T) {
 	}
 }
 
+// TestServeStaticConfinement tests that static files are only served from their route's directory
+func TestServeStaticConfinement(t *testing.T) {
+	// Run from the repository root so the static directory is found
+	t.Chdir("../../..")
+
+	tests := []struct {
+		name     string
+		path     string
+		expected string
+	}{
+		{"CSS file", "/css/styles.css", "text/css"},
+		{"JS file", "/js/script.js", "application/javascript"},
+		{"JS file in css directory", "/css/script.js", ""},
+		{"CSS file in js directory", "/js/styles.css", ""},
+		{"Traversal out of js directory", "/js/../index.html", ""},
+		{"Traversal to js file outside js directory", "/js/../../static/js/script.js", ""},
+		{"Unknown directory", "/other/styles.css", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.URL.Path = tt.path // Bypass request normalization to test raw paths
+
+			rr := httptest.NewRecorder()
+			ServeStatic(rr, req)
+
+			if tt.expected != "" {
+				if status := rr.Code; status != http.StatusOK {
+					t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+				}
+
+				if contentType := rr.Header().Get("Content-Type"); contentType != tt.expected {
+					t.Errorf("handler returned wrong content type: got %v want %v", contentType, tt.expected)
+				}
+			} else {
+				if status := rr.Code; status != http.StatusNotFound {
+					t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+				}
+			}
+		})
+	}
+}
+
 // TestServeLogin tests login page serving
 func TestServeLogin(t *testing.T) {
 	req, err := http.NewRequest("GET", "/login", nil)
@@ -131,3 +200,1626 @@ func TestServeLogout(t *testing.T) {
 		t.Errorf("handler should redirect to login, got location: %v", rr.Header().Get("Location"))
 	}
 }
+
+// TestServeSession tests that the session check succeeds with a live session and is 401 once it's gone
+func TestServeSession(t *testing.T) {
+	sessionID := createTestSession(t, "reconnector")
+	check := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/session", nil)
+		req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		ServeSession(rr, req)
+		return rr
+	}
+
+	rr := check()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["username"] != "reconnector" {
+		t.Errorf("Expected username 'reconnector', got '%s'", resp["username"])
+	}
+
+	auth.DeleteSession(sessionID)
+	if rr := check(); rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+// TestServeReady tests that readiness and the stats' database health both follow the database's health
+func TestServeReady(t *testing.T) {
+	defer database.SetDatabase(nil)
+	hub := types.NewHub()
+
+	tests := []struct {
+		name   string
+		db     database.Database
+		status int
+	}{
+		{"healthy", database.NewMemory(), http.StatusOK},
+		{"unhealthy", &unhealthyDB{MemoryDB: database.NewMemory()}, http.StatusServiceUnavailable},
+		{"no database", nil, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database.SetDatabase(tt.db)
+
+			rr := httptest.NewRecorder()
+			ServeReady(rr, httptest.NewRequest("GET", "/readyz", nil))
+			if rr.Code != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.status)
+			}
+
+			rr = httptest.NewRecorder()
+			ServeStats(hub, rr, httptest.NewRequest("GET", "/api/stats", nil))
+			var stats Stats
+			if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+				t.Fatalf("Failed to decode stats: %v", err)
+			}
+			if expected := tt.status == http.StatusOK; stats.DatabaseHealthy != expected {
+				t.Errorf("Expected database_healthy %v in stats, got %v", expected, stats.DatabaseHealthy)
+			}
+		})
+	}
+}
+
+// unhealthyDB is a database whose health check always fails
+type unhealthyDB struct {
+	*database.MemoryDB
+}
+
+func (u *unhealthyDB) Healthy() bool {
+	return false
+}
+
+// TestServeVersion tests the build information endpoint
+func TestServeVersion(t *testing.T) {
+	req, err := http.NewRequest("GET", "/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ServeVersion)
+
+	handler.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("handler returned wrong content type: got %v want %v", contentType, "application/json")
+	}
+
+	var info map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if info["version"] != "dev" {
+		t.Errorf("Expected version 'dev', got '%s'", info["version"])
+	}
+
+	if info["git_commit"] != "dev" {
+		t.Errorf("Expected git commit 'dev', got '%s'", info["git_commit"])
+	}
+
+	if info["go_version"] != runtime.Version() {
+		t.Errorf("Expected go version '%s', got '%s'", runtime.Version(), info["go_version"])
+	}
+}
+
+// TestServeAdminBroadcast tests that an admin announcement reaches connected clients
+func TestServeAdminBroadcast(t *testing.T) {
+	hub := types.NewHub()
+	go hub.Run()
+
+	client := &types.Client{
+		BaseClient: pkgtypes.BaseClient{Username: "listener"},
+		Send:       make(chan []byte, 10),
+	}
+	hub.Register <- client
+
+	// Drain the join message
+	select {
+	case <-client.Send:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for join message")
+	}
+
+	auth.SetAdmins([]string{"admin"})
+	defer auth.SetAdmins(nil)
+
+	// Non-admin users are rejected
+	req := httptest.NewRequest("POST", "/api/broadcast", strings.NewReader(`{"message":"hello"}`))
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: createTestSession(t, "someone")})
+	rr := httptest.NewRecorder()
+	ServeAdminBroadcast(hub, rr, req)
+
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Admin announcement is delivered
+	req = httptest.NewRequest("POST", "/api/broadcast", strings.NewReader(`{"message":"Server maintenance at 10pm"}`))
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: createTestSession(t, "admin")})
+	rr = httptest.NewRecorder()
+	ServeAdminBroadcast(hub, rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	select {
+	case data := <-client.Send:
+		var msg pkgtypes.Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Failed to decode message: %v", err)
+		}
+		if msg.Type != pkgtypes.MessageTypeSystem {
+			t.Errorf("Expected type '%s', got '%s'", pkgtypes.MessageTypeSystem, msg.Type)
+		}
+		if msg.Content != "Server maintenance at 10pm" {
+			t.Errorf("Expected announcement content, got '%s'", msg.Content)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for announcement")
+	}
+}
+
+// createTestSession creates a session, failing the test on error
+func createTestSession(t *testing.T, username string) string {
+	t.Helper()
+	sessionID, err := auth.CreateSession(username)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	return sessionID
+}
+
+// newWebAuthnRequest builds a same-origin POST to a WebAuthn endpoint
+func newWebAuthnRequest(path string, body io.Reader) *http.Request {
+	req := httptest.NewRequest("POST", path, body)
+	req.Header.Set("Origin", "http://"+req.Host)
+	return req
+}
+
+// newTestWsServer starts a hub and an HTTP server routing to ServeWs
+func newTestWsServer() (*types.Hub, *httptest.Server) {
+	hub := types.NewHub()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r)
+	}))
+	return hub, server
+}
+
+// TestServeWsGuestAllowed tests that guests can connect when guest mode is enabled
+func TestServeWsGuestAllowed(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowGuests = true
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?guest=visitor"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Guest connection should succeed: %v", err)
+	}
+	defer conn.Close()
+
+	var msg pkgtypes.Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read user info: %v", err)
+	}
+
+	if msg.Type != pkgtypes.MessageTypeUserInfo {
+		t.Errorf("Expected type '%s', got '%s'", pkgtypes.MessageTypeUserInfo, msg.Type)
+	}
+
+	if msg.Content != "guest-visitor" {
+		t.Errorf("Expected username 'guest-visitor', got '%s'", msg.Content)
+	}
+}
+
+// TestServeWsIdlePolicy tests that the user_info handshake carries the configured idle policy
+func TestServeWsIdlePolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowGuests = true
+	cfg.IdleAway = 10 * time.Minute
+	cfg.IdleDisconnect = 30 * time.Minute
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?guest=idler", nil)
+	if err != nil {
+		t.Fatalf("Guest connection should succeed: %v", err)
+	}
+	defer conn.Close()
+
+	var msg pkgtypes.Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read user info: %v", err)
+	}
+
+	if msg.Type != pkgtypes.MessageTypeUserInfo || msg.Idle == nil {
+		t.Fatalf("Expected user info with an idle policy, got %+v", msg)
+	}
+	if msg.Idle.AwayAfter != 600 || msg.Idle.DisconnectAfter != 1800 {
+		t.Errorf("Expected away after 600s and disconnect after 1800s, got %+v", *msg.Idle)
+	}
+}
+
+// TestServeWsGuestName tests that guest names must meet the username policy and not already be connected
+func TestServeWsGuestName(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowGuests = true
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	hub, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?guest="
+	// With the prefix, a 15-character name is over the 20-character limit
+	for _, name := range []string{"bad%20name", "bad.name", strings.Repeat("a", 15)} {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+name, nil)
+		if err == nil {
+			t.Errorf("Guest name %q should be rejected", name)
+			continue
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status %v for %q, got %v", http.StatusBadRequest, name, resp)
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"visitor", nil)
+	if err != nil {
+		t.Fatalf("Guest connection should succeed: %v", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for !hub.IsConnected("guest-visitor") {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the guest to register")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"visitor", nil)
+	if err == nil {
+		t.Fatal("A second guest with the same name should be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status %v, got %v", http.StatusConflict, resp)
+	}
+}
+
+// TestServeWsGuestDenied tests that guests are rejected when guest mode is disabled
+func TestServeWsGuestDenied(t *testing.T) {
+	config.SetConfig(config.Default())
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?guest=visitor"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Guest connection should be rejected")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, got %v", http.StatusUnauthorized, resp)
+	}
+}
+
+// TestServeWsUsernameParamIgnored tests that naming a registered user in the query doesn't authenticate as them
+func TestServeWsUsernameParamIgnored(t *testing.T) {
+	config.SetConfig(config.Default())
+
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	if _, err := db.CreateUser("victim"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := db.SetUserRegistered("victim", true); err != nil {
+		t.Fatalf("Failed to register user: %v", err)
+	}
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?username=victim"
+	tests := []struct {
+		name   string
+		cookie string
+	}{
+		{"no session", ""},
+		{"invalid session", "expired-or-forged"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.cookie != "" {
+				header.Set("Cookie", pkgtypes.SessionCookieName+"="+tt.cookie)
+			}
+
+			conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+			if err == nil {
+				conn.Close()
+				t.Fatal("Connection with only ?username= should be rejected")
+			}
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("Expected status %v, got %v", http.StatusUnauthorized, resp)
+			}
+		})
+	}
+}
+
+// TestServeWsPlainGet tests that a non-upgrade request gets 426 with an explanation
+func TestServeWsPlainGet(t *testing.T) {
+	hub := types.NewHub()
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	rr := httptest.NewRecorder()
+	ServeWs(hub, rr, req)
+
+	if status := rr.Code; status != http.StatusUpgradeRequired {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUpgradeRequired)
+	}
+
+	if upgrade := rr.Header().Get("Upgrade"); upgrade != "websocket" {
+		t.Errorf("Expected Upgrade header 'websocket', got '%s'", upgrade)
+	}
+
+	if !strings.Contains(rr.Body.String(), "only accepts WebSocket connections") {
+		t.Errorf("Expected a helpful message, got '%s'", rr.Body.String())
+	}
+}
+
+// TestLoginFailureAudit tests that a failed login writes an audit record
+func TestLoginFailureAudit(t *testing.T) {
+	auth.InitializeWebAuthn()
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	// A passkey that was never registered here
+	req := testLoginRequest(t, newTestAuthenticator(t), "stranger")
+	req.RemoteAddr = "192.0.2.10:54321"
+	rr := httptest.NewRecorder()
+	ServeWebAuthnFinishLogin(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	events, err := db.GetRecentAuditEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to get audit events: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 audit event, got %d", len(events))
+	}
+
+	if events[0].Event != auth.AuditLoginFailure {
+		t.Errorf("Expected event '%s', got '%s'", auth.AuditLoginFailure, events[0].Event)
+	}
+
+	if events[0].RemoteIP != "192.0.2.10" {
+		t.Errorf("Expected remote IP '192.0.2.10', got '%s'", events[0].RemoteIP)
+	}
+}
+
+// TestFinishLoginUserHandle tests that a discoverable login is verified against the owner named by its user handle
+func TestFinishLoginUserHandle(t *testing.T) {
+	auth.InitializeWebAuthn()
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	authenticator := registerTestPasskey(t, "discoverer")
+	registerTestPasskey(t, "bystander")
+
+	finish := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ServeWebAuthnFinishLogin(rr, req)
+		return rr
+	}
+
+	req := testLoginRequest(t, authenticator, "discoverer")
+	replay, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(replay))
+	rr := finish(req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+	}
+
+	var resp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["username"] != "discoverer" {
+		t.Errorf("Expected login as 'discoverer', got '%s'", resp["username"])
+	}
+
+	// The same assertion cannot be used twice
+	if status := finish(newWebAuthnRequest("/webauthn/finish-login", bytes.NewReader(replay))).Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status %v for a replayed assertion, got %v", http.StatusBadRequest, status)
+	}
+
+	// A handle naming someone else must not log in as either user
+	if status := finish(testLoginRequest(t, authenticator, "bystander")).Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// A signature from another key fails verification
+	impostor := newTestAuthenticator(t)
+	impostor.id = authenticator.id
+	if status := finish(testLoginRequest(t, impostor, "discoverer")).Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v for a forged signature, got %v", http.StatusUnauthorized, status)
+	}
+}
+
+// TestFinishLoginSignCount tests that logins store the authenticator's sign count and that a
+// copy of the authenticator with a stale count is refused
+func TestFinishLoginSignCount(t *testing.T) {
+	auth.InitializeWebAuthn()
+	database.SetDatabase(database.NewMemory())
+	defer database.SetDatabase(nil)
+
+	authenticator := registerTestPasskey(t, "counter")
+	clone := *authenticator
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		ServeWebAuthnFinishLogin(rr, testLoginRequest(t, authenticator, "counter"))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		stored := auth.LoadCredentials("counter")
+		if len(stored) != 1 {
+			t.Fatalf("Expected one stored credential, got %d", len(stored))
+		}
+		if count := stored[0].Authenticator.SignCount; count != authenticator.counter {
+			t.Fatalf("Expected stored sign count %d, got %d", authenticator.counter, count)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	ServeWebAuthnFinishLogin(rr, testLoginRequest(t, &clone, "counter"))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v for a stale sign count, got %v", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// TestSessionCookieAttributes tests the attributes of the cookie issued at login and cleared at logout
+func TestSessionCookieAttributes(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+	defer config.SetConfig(config.Default())
+
+	auth.InitializeWebAuthn()
+	authenticator := registerTestPasskey(t, "cookieuser")
+
+	tests := []struct {
+		name     string
+		policy   config.CookiePolicy
+		tls      bool
+		secure   bool
+		sameSite http.SameSite
+	}{
+		{"defaults over plain HTTP", config.Default().Cookie, false, false, http.SameSiteLaxMode},
+		{"defaults over TLS", config.Default().Cookie, true, true, http.SameSiteLaxMode},
+		{"always secure", config.CookiePolicy{SameSite: "strict", Secure: "always", Domain: "example.com"}, false, true, http.SameSiteStrictMode},
+		{"never secure", config.CookiePolicy{SameSite: "lax", Secure: "never"}, true, false, http.SameSiteLaxMode},
+		{"cross-site", config.CookiePolicy{SameSite: "none", Secure: "auto"}, true, true, http.SameSiteNoneMode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Cookie = tt.policy
+			cfg.SessionTTL = 2 * time.Hour
+			config.SetConfig(cfg)
+
+			check := func(action string, rr *httptest.ResponseRecorder) {
+				t.Helper()
+				cookies := rr.Result().Cookies()
+				if len(cookies) != 1 || cookies[0].Name != pkgtypes.SessionCookieName {
+					t.Fatalf("Expected the session cookie on %s, got %v", action, cookies)
+				}
+				cookie := cookies[0]
+				if cookie.Secure != tt.secure {
+					t.Errorf("Expected Secure %v on %s, got %v", tt.secure, action, cookie.Secure)
+				}
+				if cookie.SameSite != tt.sameSite {
+					t.Errorf("Expected SameSite %v on %s, got %v", tt.sameSite, action, cookie.SameSite)
+				}
+				if cookie.Domain != tt.policy.Domain {
+					t.Errorf("Expected domain '%s' on %s, got '%s'", tt.policy.Domain, action, cookie.Domain)
+				}
+				if !cookie.HttpOnly {
+					t.Errorf("Expected an HttpOnly cookie on %s", action)
+				}
+				if action == "login" && cookie.MaxAge != int(cfg.SessionTTL/time.Second) {
+					t.Errorf("Expected the cookie to last the session TTL, got %d seconds", cookie.MaxAge)
+				}
+			}
+
+			req := testLoginRequest(t, authenticator, "cookieuser")
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rr := httptest.NewRecorder()
+			ServeWebAuthnFinishLogin(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+			check("login", rr)
+
+			req = httptest.NewRequest("GET", "/logout", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rr = httptest.NewRecorder()
+			ServeLogout(rr, req)
+			check("logout", rr)
+		})
+	}
+
+	// A trusted proxy reporting HTTPS counts as TLS
+	cfg := config.Default()
+	cfg.TrustedProxies = config.ParseTrustedProxies("10.0.0.0/8")
+	config.SetConfig(cfg)
+
+	for _, remoteAddr := range []string{"10.1.2.3:1234", "203.0.113.5:1234"} {
+		req := httptest.NewRequest("GET", "/logout", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-Proto", "https")
+		cookie := sessionCookie(req, "", -1)
+		if expected := remoteAddr == "10.1.2.3:1234"; cookie.Secure != expected {
+			t.Errorf("Expected Secure %v behind %s, got %v", expected, remoteAddr, cookie.Secure)
+		}
+	}
+}
+
+// TestWebAuthnSameOrigin tests that WebAuthn requests from other sites are rejected
+func TestWebAuthnSameOrigin(t *testing.T) {
+	auth.InitializeWebAuthn()
+
+	handlers := map[string]http.HandlerFunc{
+		"/webauthn/begin-registration":  ServeWebAuthnBeginRegistration,
+		"/webauthn/finish-registration": ServeWebAuthnFinishRegistration,
+		"/webauthn/begin-login":         ServeWebAuthnBeginLogin,
+		"/webauthn/finish-login":        ServeWebAuthnFinishLogin,
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		allowed bool
+	}{
+		{"no origin or referer", nil, false},
+		{"same origin", map[string]string{"Origin": "http://example.com"}, true},
+		{"same origin over TLS", map[string]string{"Origin": "https://example.com"}, true},
+		{"cross origin", map[string]string{"Origin": "https://evil.example"}, false},
+		{"cross origin with same-site referer", map[string]string{"Origin": "https://evil.example", "Referer": "http://example.com/login"}, false},
+		{"null origin", map[string]string{"Origin": "null"}, false},
+		{"same-origin referer", map[string]string{"Referer": "http://example.com/login"}, true},
+		{"cross-origin referer", map[string]string{"Referer": "https://example.com.evil.example/login"}, false},
+	}
+
+	for path, handler := range handlers {
+		for _, tt := range tests {
+			t.Run(path+" "+tt.name, func(t *testing.T) {
+				req := httptest.NewRequest("POST", path, strings.NewReader(`not json`))
+				for name, value := range tt.headers {
+					req.Header.Set(name, value)
+				}
+
+				rr := httptest.NewRecorder()
+				handler(rr, req)
+
+				// Allowed requests get past the check, then fail on the body or begin a login
+				if forbidden := rr.Code == http.StatusForbidden; forbidden == tt.allowed {
+					t.Errorf("Expected allowed=%v, got status %v", tt.allowed, rr.Code)
+				}
+			})
+		}
+	}
+}
+
+// TestServeWsMaxClients tests that connections past the cap are rejected
+func TestServeWsMaxClients(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowGuests = true
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	hub, server := newTestWsServer()
+	hub.MaxClients = 2
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?guest="
+	for _, name := range []string{"first", "second"} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+name, nil)
+		if err != nil {
+			t.Fatalf("Connection %s should succeed: %v", name, err)
+		}
+		defer conn.Close()
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"third", nil)
+	if err == nil {
+		t.Fatal("Connection past the cap should be rejected")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+
+	var msg pkgtypes.Message
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+		t.Fatalf("Failed to decode rejection message: %v", err)
+	}
+
+	if msg.Type != pkgtypes.MessageTypeSystem {
+		t.Errorf("Expected type '%s', got '%s'", pkgtypes.MessageTypeSystem, msg.Type)
+	}
+
+	// Stats report the current and maximum client counts
+	deadline := time.Now().Add(time.Second)
+	for hub.ClientCount() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	rr := httptest.NewRecorder()
+	ServeStats(hub, rr, httptest.NewRequest("GET", "/api/stats", nil))
+
+	var stats Stats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+
+	if stats.Clients != 2 || stats.MaxClients != 2 {
+		t.Errorf("Expected 2/2 clients, got %d/%d", stats.Clients, stats.MaxClients)
+	}
+}
+
+// TestServeWebAuthnBeginLogin tests that login options carry a base64url-encoded challenge
+func TestServeWebAuthnBeginLogin(t *testing.T) {
+	auth.InitializeWebAuthn()
+
+	req := newWebAuthnRequest("/webauthn/begin-login", strings.NewReader(`{}`))
+	rr := httptest.NewRecorder()
+	ServeWebAuthnBeginLogin(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var options struct {
+		PublicKey struct {
+			Challenge        string `json:"challenge"`
+			RPID             string `json:"rpId"`
+			UserVerification string `json:"userVerification"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to decode options: %v", err)
+	}
+
+	if options.PublicKey.Challenge == "" {
+		t.Fatal("Challenge should be present")
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(options.PublicKey.Challenge)
+	if err != nil {
+		t.Fatalf("Challenge should be unpadded base64url: %v", err)
+	}
+
+	if len(challenge) < 16 {
+		t.Errorf("Challenge should be at least 16 bytes, got %d", len(challenge))
+	}
+
+	if options.PublicKey.RPID != "localhost" {
+		t.Errorf("Expected rpId 'localhost', got '%s'", options.PublicKey.RPID)
+	}
+
+	if options.PublicKey.UserVerification != "preferred" {
+		t.Errorf("Expected userVerification 'preferred', got '%s'", options.PublicKey.UserVerification)
+	}
+}
+
+// TestServePublicKey tests storing and retrieving a user's chat public key
+func TestServePublicKey(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	if _, err := db.CreateUser("keyuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	sessionID := createTestSession(t, "keyuser")
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(der)
+
+	// Without a session
+	req := httptest.NewRequest("POST", "/api/publickey", strings.NewReader(`{"public_key":"`+publicKey+`"}`))
+	rr := httptest.NewRecorder()
+	ServePublicKey(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	// Nothing stored yet
+	req = httptest.NewRequest("GET", "/api/publickey", nil)
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+	rr = httptest.NewRecorder()
+	ServePublicKey(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	// Invalid key
+	req = httptest.NewRequest("POST", "/api/publickey", strings.NewReader(`{"public_key":"bm90IGEga2V5"}`))
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+	rr = httptest.NewRecorder()
+	ServePublicKey(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+
+	// Store
+	req = httptest.NewRequest("POST", "/api/publickey", strings.NewReader(`{"public_key":"`+publicKey+`"}`))
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+	rr = httptest.NewRecorder()
+	ServePublicKey(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	user, err := db.GetUser("keyuser")
+	if err != nil || user == nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if user.PublicKey != publicKey {
+		t.Error("Public key should be stored in the database")
+	}
+
+	// Retrieve
+	req = httptest.NewRequest("GET", "/api/publickey", nil)
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+	rr = httptest.NewRecorder()
+	ServePublicKey(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var resp PublicKeyResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Username != "keyuser" {
+		t.Errorf("Expected username 'keyuser', got '%s'", resp.Username)
+	}
+	if resp.PublicKey != publicKey {
+		t.Error("Expected stored public key to be returned")
+	}
+}
+
+// failingDB is a database whose user and session lookups always fail
+type failingDB struct {
+	*database.MemoryDB
+}
+
+func (f *failingDB) GetUser(username string) (*database.User, error) {
+	return nil, errors.New("disk I/O error")
+}
+
+func (f *failingDB) GetSession(sessionID string) (*database.Session, error) {
+	return nil, errors.New("disk I/O error")
+}
+
+// TestServeWsDatabaseUnavailable tests that a failing database yields 503 instead of a spurious 401
+func TestServeWsDatabaseUnavailable(t *testing.T) {
+	sessionID := createTestSession(t, "dbfailuser")
+
+	database.SetDatabase(&failingDB{MemoryDB: database.NewMemory()})
+	defer database.SetDatabase(nil)
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{}
+	header.Add("Cookie", pkgtypes.SessionCookieName+"="+sessionID)
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err == nil {
+		t.Fatal("Connection should be rejected")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v, got %v", http.StatusServiceUnavailable, resp)
+	}
+}
+
+// TestServeAdminUsers tests creating, re-creating and conflicting user provisioning
+func TestServeAdminUsers(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	auth.SetAdmins([]string{"admin"})
+	defer auth.SetAdmins(nil)
+	adminSession := createTestSession(t, "admin")
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(der)
+
+	provision := func(session, body string) int {
+		req := httptest.NewRequest("POST", "/api/admin/users", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: session})
+		rr := httptest.NewRecorder()
+		ServeAdminUsers(rr, req)
+		return rr.Code
+	}
+
+	body := `{"username":"provisioned","public_key":"` + publicKey + `","registered":true}`
+
+	// Non-admin users are rejected
+	if status := provision(createTestSession(t, "someone"), body); status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	// Create
+	if status := provision(adminSession, body); status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	user, err := db.GetUser("provisioned")
+	if err != nil || user == nil {
+		t.Fatalf("User should be created: %v", err)
+	}
+	if !user.IsRegistered {
+		t.Error("User should be registered")
+	}
+	if user.PublicKey != publicKey {
+		t.Error("User public key should be stored")
+	}
+
+	// Idempotent re-create
+	if status := provision(adminSession, body); status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	// Conflict
+	if status := provision(adminSession, `{"username":"provisioned","registered":false}`); status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+
+	// Invalid input
+	if status := provision(adminSession, `{"username":"bad name!"}`); status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if status := provision(adminSession, `{"username":"weakkey","public_key":"bm90IGEga2V5"}`); status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestServeWsConnectionID tests that one connection ID tags every log line of a connection's lifecycle
+func TestServeWsConnectionID(t *testing.T) {
+	cfg := config.Default()
+	cfg.AllowGuests = true
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	_, server := newTestWsServer()
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?guest=idtest"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Guest connection should succeed: %v", err)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(logs.String(), "Unregistered guest-idtest") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for disconnect, logs:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	match := regexp.MustCompile(`\[conn ([0-9a-f]{8})\] Web client connecting: guest-idtest`).FindStringSubmatch(logs.String())
+	if match == nil {
+		t.Fatalf("Expected a connection ID on the connecting line, logs:\n%s", logs.String())
+	}
+	prefix := "[conn " + match[1] + "] "
+
+	for _, event := range []string{
+		"Registered guest-idtest",
+		"Web client connected: guest-idtest",
+		"Error parsing message",
+		"Unregistered guest-idtest",
+	} {
+		if !strings.Contains(logs.String(), prefix+event) {
+			t.Errorf("Expected '%s%s' in logs:\n%s", prefix, event, logs.String())
+		}
+	}
+}
+
+// TestServePublicKeyForPeer tests fetching another user's stored key
+func TestServePublicKeyForPeer(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	for _, username := range []string{"offlinepeer", "keylesspeer"} {
+		if _, err := db.CreateUser(username); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	if err := db.UpdateUserPublicKey("offlinepeer", "c3RvcmVkLWtleQ=="); err != nil {
+		t.Fatalf("Failed to store key: %v", err)
+	}
+	sessionID := createTestSession(t, "requester")
+
+	fetch := func(session, username string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/publickey?username="+username, nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: session})
+		}
+		rr := httptest.NewRecorder()
+		ServePublicKey(rr, req)
+		return rr
+	}
+
+	if status := fetch("", "offlinepeer").Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	rr := fetch(sessionID, "offlinepeer")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var resp PublicKeyResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Username != "offlinepeer" || resp.PublicKey != "c3RvcmVkLWtleQ==" {
+		t.Errorf("Expected offlinepeer's stored key, got %+v", resp)
+	}
+
+	for _, username := range []string{"unknownpeer", "keylesspeer"} {
+		if status := fetch(sessionID, username).Code; status != http.StatusNotFound {
+			t.Errorf("Expected %v for %s, got %v", http.StatusNotFound, username, status)
+		}
+	}
+}
+
+// TestServeWebAuthnBeginRegistrationUsernamePolicy tests that registration enforces the configured username policy
+func TestServeWebAuthnBeginRegistrationUsernamePolicy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Username = config.UsernamePolicy{MinLength: 3, MaxLength: 8, AllowedChars: "abcdefghijklmnopqrstuvwxyz."}
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	tests := []struct {
+		username string
+		expected string
+	}{
+		{"ab", "Username must be at least 3 characters"},
+		{"abcdefghi", "Username must be at most 8 characters"},
+		{"a-b", "Username contains disallowed character '-'"},
+	}
+
+	for _, tt := range tests {
+		req := newWebAuthnRequest("/webauthn/begin-registration", strings.NewReader(`{"username":"`+tt.username+`"}`))
+		rr := httptest.NewRecorder()
+		ServeWebAuthnBeginRegistration(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code for '%s': got %v want %v", tt.username, status, http.StatusBadRequest)
+		}
+
+		if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+			t.Errorf("Expected '%s', got '%s'", tt.expected, body)
+		}
+	}
+}
+
+// TestServeWebAuthnBeginRegistrationSelection tests that registration options carry the configured authenticator policy
+func TestServeWebAuthnBeginRegistrationSelection(t *testing.T) {
+	auth.InitializeWebAuthn()
+	database.SetDatabase(database.NewMemory())
+	defer database.SetDatabase(nil)
+
+	cfg := config.Default()
+	cfg.WebAuthn = config.WebAuthnPolicy{
+		AuthenticatorAttachment: "platform",
+		ResidentKey:             "required",
+		UserVerification:        "required",
+		Attestation:             "direct",
+	}
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	req := newWebAuthnRequest("/webauthn/begin-registration", strings.NewReader(`{"username":"selector"}`))
+	rr := httptest.NewRecorder()
+	ServeWebAuthnBeginRegistration(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var options struct {
+		PublicKey struct {
+			AuthenticatorSelection struct {
+				AuthenticatorAttachment string `json:"authenticatorAttachment"`
+				RequireResidentKey      bool   `json:"requireResidentKey"`
+				ResidentKey             string `json:"residentKey"`
+				UserVerification        string `json:"userVerification"`
+			} `json:"authenticatorSelection"`
+			Attestation string `json:"attestation"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to decode options: %v", err)
+	}
+
+	selection := options.PublicKey.AuthenticatorSelection
+	if selection.AuthenticatorAttachment != "platform" {
+		t.Errorf("Expected authenticatorAttachment 'platform', got '%s'", selection.AuthenticatorAttachment)
+	}
+	if selection.ResidentKey != "required" || !selection.RequireResidentKey {
+		t.Errorf("Expected a required resident key, got residentKey '%s' requireResidentKey %v", selection.ResidentKey, selection.RequireResidentKey)
+	}
+	if selection.UserVerification != "required" {
+		t.Errorf("Expected userVerification 'required', got '%s'", selection.UserVerification)
+	}
+	if options.PublicKey.Attestation != "direct" {
+		t.Errorf("Expected attestation 'direct', got '%s'", options.PublicKey.Attestation)
+	}
+}
+
+// TestInvites tests creating an invite, checking it, and using it up by registering
+func TestInvites(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	// Creating requires a session
+	req := httptest.NewRequest("POST", "/api/invites", nil)
+	rr := httptest.NewRecorder()
+	ServeCreateInvite(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+	}
+
+	req = httptest.NewRequest("POST", "/api/invites", nil)
+	req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: createTestSession(t, "inviter")})
+	rr = httptest.NewRecorder()
+	ServeCreateInvite(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var invite InviteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &invite); err != nil {
+		t.Fatalf("Failed to decode invite: %v", err)
+	}
+	if invite.Token == "" || !invite.SingleUse {
+		t.Fatalf("Expected a single-use invite token, got %+v", invite)
+	}
+	if invite.URL != "/login?invite="+invite.Token {
+		t.Errorf("Unexpected invite URL '%s'", invite.URL)
+	}
+
+	if err := db.CreateInvite("expired-token", "inviter", time.Now().Add(-time.Minute), true); err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+
+	check := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/invites/check", strings.NewReader(`{"token":"`+token+`"}`))
+		rr := httptest.NewRecorder()
+		ServeCheckInvite(rr, req)
+		return rr
+	}
+
+	// Checking a valid invite, as the login page does on load, leaves it usable
+	for i := 0; i < 2; i++ {
+		rr = check(invite.Token)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if !strings.Contains(rr.Body.String(), `"created_by":"inviter"`) {
+			t.Errorf("Expected inviter in response, got %s", rr.Body.String())
+		}
+	}
+
+	// Registering with the invite uses it up
+	auth.InitializeWebAuthn()
+	registerWithInvite := func(username string) *httptest.ResponseRecorder {
+		response := newTestAuthenticator(t).register(beginTestRegistration(t, username), testOrigin)
+		response["invite"] = invite.Token
+		return postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", response)
+	}
+	if rr := registerWithInvite("invitee"); rr.Code != http.StatusOK {
+		t.Fatalf("finish-registration returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if status := check(invite.Token).Code; status != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusGone)
+	}
+	if rr := registerWithInvite("latecomer"); rr.Code != http.StatusGone {
+		t.Errorf("Expected status %v registering with a used invite, got %v", http.StatusGone, rr.Code)
+	}
+	if auth.ValidateUser("latecomer") {
+		t.Error("Expected a registration with a used invite to be refused")
+	}
+
+	// Expired
+	if status := check("expired-token").Code; status != http.StatusGone {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusGone)
+	}
+
+	// Unknown
+	if status := check("unknown-token").Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+// TestClientIP tests that forwarding headers are only honored from trusted proxies
+func TestClientIP(t *testing.T) {
+	cfg := config.Default()
+	cfg.TrustedProxies = config.ParseTrustedProxies("10.0.0.0/8, 192.0.2.1")
+	config.SetConfig(cfg)
+	defer config.SetConfig(config.Default())
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"untrusted peer spoofing forwarded", "203.0.113.5:1234", "198.51.100.7", "", "203.0.113.5"},
+		{"untrusted peer spoofing real IP", "203.0.113.5:1234", "", "198.51.100.7", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:1234", "198.51.100.7", "", "198.51.100.7"},
+		{"trusted proxy chain", "10.1.2.3:1234", "198.51.100.7, 192.0.2.1", "", "198.51.100.7"},
+		{"spoofed hop before real client", "10.1.2.3:1234", "1.2.3.4, 198.51.100.7", "", "198.51.100.7"},
+		{"trusted proxy real IP", "192.0.2.1:1234", "", "198.51.100.7", "198.51.100.7"},
+		{"trusted proxy invalid header", "10.1.2.3:1234", "not-an-ip", "", "10.1.2.3"},
+		{"trusted proxy without headers", "10.1.2.3:1234", "", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if ip := clientIP(req); ip != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, ip)
+			}
+		})
+	}
+}
+
+// TestServeCredentials tests listing and revoking passkeys, including keeping the last one
+func TestServeCredentials(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	user, err := db.CreateUser("deviceuser")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	db.StoreCredential(user.ID, "laptop-credential-id", "data", "Laptop")
+	db.StoreCredential(user.ID, "phone-credential-id", "data", "Phone")
+
+	other, _ := db.CreateUser("otheruser")
+	db.StoreCredential(other.ID, "other-credential-id", "data", "")
+
+	sessionID := createTestSession(t, "deviceuser")
+	request := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		ServeCredentials(rr, req)
+		return rr
+	}
+
+	rr := request("GET", "/api/credentials")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	var infos []CredentialInfo
+	if err := json.Unmarshal(rr.Body.Bytes(), &infos); err != nil {
+		t.Fatalf("Failed to decode credentials: %v", err)
+	}
+	if len(infos) != 2 || infos[0].DeviceLabel != "Laptop" || infos[1].DeviceLabel != "Phone" {
+		t.Fatalf("Expected Laptop and Phone, got %+v", infos)
+	}
+	if infos[0].ID != "laptop-crede" {
+		t.Errorf("Expected a credential ID prefix, got '%s'", infos[0].ID)
+	}
+
+	// Another user's credential can't be revoked
+	if rr := request("DELETE", "/api/credentials?id=other"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v for another user's credential, got %v", http.StatusNotFound, rr.Code)
+	}
+
+	if rr := request("DELETE", "/api/credentials?id=laptop"); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status %v when revoking, got %v", http.StatusNoContent, rr.Code)
+	}
+
+	// The remaining credential is the last one and must stay
+	if rr := request("DELETE", "/api/credentials?id=phone"); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %v for the last credential, got %v", http.StatusConflict, rr.Code)
+	}
+
+	remaining, _ := db.GetCredentialsByUserID(user.ID)
+	if len(remaining) != 1 || remaining[0].CredentialID != "phone-credential-id" {
+		t.Errorf("Expected only the phone credential to remain, got %v", remaining)
+	}
+
+	// Unauthenticated requests are rejected
+	rr = httptest.NewRecorder()
+	ServeCredentials(rr, httptest.NewRequest("GET", "/api/credentials", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v without a session, got %v", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// TestServeAccountData tests exporting and then deleting everything stored about the user
+func TestServeAccountData(t *testing.T) {
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	user, err := db.CreateUser("leaver")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	db.StoreCredential(user.ID, "leaver-credential-id", "secret-key-data", "Laptop")
+	db.RecordAuditEvent(auth.AuditLoginSuccess, "leaver", "192.0.2.1")
+
+	sessionID := createTestSession(t, "leaver")
+	request := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/account", nil)
+		req.AddCookie(&http.Cookie{Name: pkgtypes.SessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		ServeAccountData(rr, req)
+		return rr
+	}
+
+	rr := request("GET")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if strings.Contains(rr.Body.String(), sessionID) || strings.Contains(rr.Body.String(), "secret-key-data") {
+		t.Error("Export must not include session IDs or key material")
+	}
+
+	var data database.UserData
+	if err := json.Unmarshal(rr.Body.Bytes(), &data); err != nil {
+		t.Fatalf("Failed to decode export: %v", err)
+	}
+	if data.User == nil || data.User.Username != "leaver" {
+		t.Errorf("Expected the user row, got %+v", data.User)
+	}
+	if len(data.Credentials) != 1 || len(data.Sessions) != 1 || len(data.AuditEvents) != 1 {
+		t.Errorf("Expected one credential, session and audit event, got %+v", data)
+	}
+
+	rr = request("DELETE")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected the session cookie to be cleared, got %v", cookies)
+	}
+	if user, _ := db.GetUser("leaver"); user != nil {
+		t.Error("Expected the user to be deleted")
+	}
+
+	// The session went with the account
+	if rr := request("GET"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+// testOrigin is the origin the test authenticator reports, matching the WebAuthn configuration
+const testOrigin = "http://localhost:8080"
+
+// testAuthenticator is a software passkey producing "none" attestations and ES256 assertions
+type testAuthenticator struct {
+	key     *ecdsa.PrivateKey
+	id      []byte
+	counter uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &testAuthenticator{key: key, id: id}
+}
+
+// cborBytes encodes a CBOR byte string
+func cborBytes(data []byte) []byte {
+	switch {
+	case len(data) < 24:
+		return append([]byte{0x40 | byte(len(data))}, data...)
+	case len(data) < 256:
+		return append([]byte{0x58, byte(len(data))}, data...)
+	default:
+		return append(binary.BigEndian.AppendUint16([]byte{0x59}, uint16(len(data))), data...)
+	}
+}
+
+// authenticatorData builds authenticator data for the test RP, with the attested credential when registering
+func (a *testAuthenticator) authenticatorData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	flags := byte(0x05) // User present and verified
+	if attested {
+		flags |= 0x40
+	}
+	a.counter++
+	data := binary.BigEndian.AppendUint32(append(rpIDHash[:], flags), a.counter)
+	if !attested {
+		return data
+	}
+
+	pub, _ := a.key.PublicKey.ECDH()
+	// The point is 0x04 || x || y; the COSE key is EC2, ES256, P-256, then x and y
+	point := pub.Bytes()
+	coseKey := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21}
+	coseKey = append(append(coseKey, cborBytes(point[1:33])...), 0x22)
+	coseKey = append(coseKey, cborBytes(point[33:])...)
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+	return append(append(data, a.id...), coseKey...)
+}
+
+// clientData builds the client data JSON for a ceremony's challenge
+func testClientData(ceremony string, challenge []byte, origin string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    origin,
+	})
+	return data
+}
+
+// register answers registration options with a credential creation response
+func (a *testAuthenticator) register(challenge []byte, origin string) map[string]any {
+	attestation := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a'}
+	attestation = append(attestation, cborBytes(a.authenticatorData(true))...)
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	return map[string]any{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(testClientData("webauthn.create", challenge, origin)),
+		},
+	}
+}
+
+// assert answers login options with a signed assertion naming userHandle as the credential's owner
+func (a *testAuthenticator) assert(t *testing.T, challenge []byte, userHandle string) map[string]any {
+	authData := a.authenticatorData(false)
+	clientData := testClientData("webauthn.get", challenge, testOrigin)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign assertion: %v", err)
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(a.id)
+	return map[string]any{
+		"id":    id,
+		"rawId": id,
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString([]byte(userHandle)),
+		},
+	}
+}
+
+// postWebAuthn sends a JSON body to a WebAuthn handler
+func postWebAuthn(handler http.HandlerFunc, path string, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	rr := httptest.NewRecorder()
+	handler(rr, newWebAuthnRequest(path, bytes.NewReader(data)))
+	return rr
+}
+
+// beginTestRegistration starts registering a user and returns the challenge to answer
+func beginTestRegistration(t *testing.T, username string) []byte {
+	rr := postWebAuthn(ServeWebAuthnBeginRegistration, "/webauthn/begin-registration", map[string]string{"username": username})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("begin-registration returned %v: %s", rr.Code, rr.Body.String())
+	}
+	var options protocol.CredentialCreation
+	if err := json.Unmarshal(rr.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to decode registration options: %v", err)
+	}
+	return options.Response.Challenge
+}
+
+// registerTestPasskey registers a user with a new test authenticator
+func registerTestPasskey(t *testing.T, username string) *testAuthenticator {
+	authenticator := newTestAuthenticator(t)
+	challenge := beginTestRegistration(t, username)
+	rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", authenticator.register(challenge, testOrigin))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("finish-registration returned %v: %s", rr.Code, rr.Body.String())
+	}
+	return authenticator
+}
+
+// testLoginRequest begins a login and builds the finish request answering it with a's assertion
+func testLoginRequest(t *testing.T, a *testAuthenticator, userHandle string) *http.Request {
+	rr := postWebAuthn(ServeWebAuthnBeginLogin, "/webauthn/begin-login", map[string]string{})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("begin-login returned %v: %s", rr.Code, rr.Body.String())
+	}
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(rr.Body.Bytes(), &options); err != nil {
+		t.Fatalf("Failed to decode login options: %v", err)
+	}
+	data, _ := json.Marshal(a.assert(t, options.Response.Challenge, userHandle))
+	return newWebAuthnRequest("/webauthn/finish-login", bytes.NewReader(data))
+}
+
+// TestWebAuthnRegistration tests that registration verifies the attestation and stores the credential
+func TestWebAuthnRegistration(t *testing.T) {
+	auth.InitializeWebAuthn()
+	db := database.NewMemory()
+	database.SetDatabase(db)
+	defer database.SetDatabase(nil)
+
+	authenticator := newTestAuthenticator(t)
+	challenge := beginTestRegistration(t, "registrant")
+	response := authenticator.register(challenge, testOrigin)
+
+	// A response for another origin fails verification and uses up the registration
+	if rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", authenticator.register(challenge, "http://evil.example")); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for the wrong origin, got %v", http.StatusBadRequest, rr.Code)
+	}
+	if rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", response); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %v for a used challenge, got %v", http.StatusBadRequest, rr.Code)
+	}
+	if auth.ValidateUser("registrant") {
+		t.Fatal("Expected a failed registration to leave the user unregistered")
+	}
+
+	// The device label is cleaned up before it is stored
+	challenge = beginTestRegistration(t, "registrant")
+	response = authenticator.register(challenge, testOrigin)
+	response["deviceLabel"] = " Firefox on\tLinux \n"
+	if rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", response); rr.Code != http.StatusOK {
+		t.Fatalf("finish-registration returned %v: %s", rr.Code, rr.Body.String())
+	}
+
+	if !auth.ValidateUser("registrant") {
+		t.Error("Expected the user to be registered")
+	}
+	stored := auth.LoadCredentials("registrant")
+	if len(stored) != 1 || !bytes.Equal(stored[0].ID, authenticator.id) {
+		t.Fatalf("Expected the verified credential to be stored, got %+v", stored)
+	}
+	pub, _ := authenticator.key.PublicKey.ECDH()
+	if !bytes.Contains(stored[0].PublicKey, pub.Bytes()[1:33]) {
+		t.Error("Expected the stored credential to carry the authenticator's public key")
+	}
+
+	infos, err := auth.ListCredentials("registrant")
+	if err != nil || len(infos) != 1 || infos[0].DeviceLabel != "Firefox on Linux" {
+		t.Errorf("Expected the device label 'Firefox on Linux', got %+v, %v", infos, err)
+	}
+}
+
+// TestFinishRegistrationAlreadyRegistered tests that a second ceremony begun for a pending user
+// can't attach another passkey once the first has finished
+func TestFinishRegistrationAlreadyRegistered(t *testing.T) {
+	auth.InitializeWebAuthn()
+	database.SetDatabase(database.NewMemory())
+	defer database.SetDatabase(nil)
+
+	owner := newTestAuthenticator(t)
+	attacker := newTestAuthenticator(t)
+	ownerChallenge := beginTestRegistration(t, "pending")
+	attackerChallenge := beginTestRegistration(t, "pending")
+
+	if rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", owner.register(ownerChallenge, testOrigin)); rr.Code != http.StatusOK {
+		t.Fatalf("finish-registration returned %v: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postWebAuthn(ServeWebAuthnFinishRegistration, "/webauthn/finish-registration", attacker.register(attackerChallenge, testOrigin)); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status %v for a second finish, got %v", http.StatusConflict, rr.Code)
+	}
+
+	stored := auth.LoadCredentials("pending")
+	if len(stored) != 1 || !bytes.Equal(stored[0].ID, owner.id) {
+		t.Errorf("Expected only the owner's credential to be stored, got %+v", stored)
+	}
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http"
+
+	"chapp/pkg/database"
+)
+
+// ServeReady reports whether the server can serve requests: 200 when the database answers, 503 otherwise.
+// Load balancers and orchestrators poll it, which also lets a failing database be reopened.
+func ServeReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !databaseHealthy() {
+		http.Error(w, "Database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ready\n"))
+}
+
+// databaseHealthy reports whether the database answers queries right now
+func databaseHealthy() bool {
+	db := database.GetDatabase()
+	return db != nil && db.Healthy()
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"chapp/cmd/server/auth"
+	"chapp/pkg/database"
+)
+
+// InviteResponse describes a newly created invite link
+type InviteResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SingleUse bool      `json:"single_use"`
+}
+
+// ServeCreateInvite creates a short-lived invite link for the authenticated user
+func ServeCreateInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	// Invites are single-use unless asked otherwise
+	var req struct {
+		SingleUse *bool `json:"single_use"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	singleUse := req.SingleUse == nil || *req.SingleUse
+
+	invite, err := auth.CreateInvite(username, singleUse)
+	if err != nil {
+		log.Printf("Failed to create invite for %s: %v", username, err)
+		http.Error(w, "Failed to create invite", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(InviteResponse{
+		Token:     invite.Token,
+		URL:       "/login?invite=" + url.QueryEscape(invite.Token),
+		ExpiresAt: invite.ExpiresAt,
+		SingleUse: invite.SingleUse,
+	})
+}
+
+// ServeCheckInvite validates an invite token without using it up; registering with it does that
+func ServeCheckInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	invite, err := auth.CheckInvite(req.Token)
+	if err != nil {
+		writeInviteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"created_by": invite.CreatedBy})
+}
+
+// writeInviteError responds to an invite that can't be used
+func writeInviteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrInviteNotFound):
+		http.Error(w, "Invite not found", http.StatusNotFound)
+	case errors.Is(err, database.ErrInviteExpired), errors.Is(err, database.ErrInviteConsumed):
+		http.Error(w, "Invite is no longer valid", http.StatusGone)
+	default:
+		log.Printf("Failed to validate invite: %v", err)
+		http.Error(w, "Failed to validate invite", http.StatusInternalServerError)
+	}
+}
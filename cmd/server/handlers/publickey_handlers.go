@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"chapp/cmd/server/auth"
+	"chapp/pkg/keys"
+)
+
+// PublicKeyRequest represents a chat public key upload
+type PublicKeyRequest struct {
+	PublicKey string `json:"public_key"`
+}
+
+// PublicKeyResponse represents a stored chat public key
+type PublicKeyResponse struct {
+	Username  string `json:"username"`
+	PublicKey string `json:"public_key"`
+}
+
+// ServePublicKey stores (POST) or returns (GET) the authenticated user's chat public key.
+// GET ?username=<name> returns another user's stored key so clients can encrypt to offline peers.
+func ServePublicKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "POST" {
+		var req PublicKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Only accept base64-encoded SPKI keys of a safe size
+		if _, err := keys.ParsePublicKey(req.PublicKey); err != nil {
+			log.Printf("Rejected public key from %s: %v", username, err)
+			http.Error(w, "Invalid public key", http.StatusBadRequest)
+			return
+		}
+
+		if err := auth.UpdateUserPublicKey(username, req.PublicKey); err != nil {
+			log.Printf("Failed to store public key for %s: %v", username, err)
+			http.Error(w, "Failed to store public key", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	target := username
+	if r.Method == "GET" && r.URL.Query().Get("username") != "" {
+		target = r.URL.Query().Get("username")
+	}
+
+	user := auth.GetUser(target)
+	if user == nil || user.PublicKey == "" {
+		http.Error(w, "Public key not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PublicKeyResponse{
+		Username:  target,
+		PublicKey: user.PublicKey,
+	})
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"chapp/cmd/server/auth"
@@ -32,13 +33,7 @@ func ServeHome(w http.ResponseWriter, r *http.Request) {
 	session := auth.GetSession(cookie.Value)
 	if session == nil {
 		// Clear invalid cookie and redirect to login
-		http.SetCookie(w, &http.Cookie{
-			Name:     pkgtypes.SessionCookieName,
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-		})
+		http.SetCookie(w, sessionCookie(r, "", -1))
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
@@ -62,13 +57,13 @@ func ServeStatic(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := r.URL.Path[1:] // Remove leading slash
+	filename := path.Clean(r.URL.Path)[1:] // Normalize and remove leading slash
 
-	// Set appropriate MIME types based on file extension
+	// Only serve files from the directory matching their type, with appropriate MIME types
 	switch {
-	case strings.HasSuffix(filename, ".css"):
+	case strings.HasPrefix(filename, "css/") && strings.HasSuffix(filename, ".css"):
 		w.Header().Set("Content-Type", "text/css")
-	case strings.HasSuffix(filename, ".js"):
+	case strings.HasPrefix(filename, "js/") && strings.HasSuffix(filename, ".js"):
 		w.Header().Set("Content-Type", "application/javascript")
 	default:
 		http.Error(w, "Not found", http.StatusNotFound)
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"chapp/cmd/server/types"
+)
+
+// Stats describes the current state of the WebSocket server
+type Stats struct {
+	Clients         int            `json:"clients"`
+	MaxClients      int            `json:"max_clients"` // 0 means unlimited
+	Rooms           int            `json:"rooms"`
+	MaxRooms        int            `json:"max_rooms"`        // 0 means unlimited
+	MaxRoomMembers  int            `json:"max_room_members"` // 0 means unlimited
+	DatabaseHealthy bool           `json:"database_healthy"`
+	Messages        map[string]int `json:"messages"` // Broadcast messages relayed, by type
+}
+
+// ServeStats returns connection statistics for the hub
+func ServeStats(hub *types.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := Stats{
+		Clients:         hub.ClientCount(),
+		MaxClients:      hub.MaxClients,
+		Rooms:           hub.RoomCount(),
+		MaxRooms:        hub.MaxRooms,
+		MaxRoomMembers:  hub.MaxRoomMembers,
+		DatabaseHealthy: databaseHealthy(),
+		Messages:        hub.MessageCounts(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"chapp/pkg/vars"
+)
+
+// ServeVersion returns the server build information as JSON
+func ServeVersion(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/version" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.GetBuildInfo())
+}
@@ -1,16 +1,31 @@
 package handlers
 
 import (
-	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
 	"chapp/cmd/server/types"
+	"chapp/pkg/credentials"
 	"chapp/pkg/database"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
+// maxWebAuthnBody caps the size of a WebAuthn finish request
+const maxWebAuthnBody = 64 * 1024
+
+// errUnknownPasskey is returned when a login names a credential no user has registered
+var errUnknownPasskey = errors.New("passkey not recognized")
+
 // ServeWebAuthnBeginRegistration starts the WebAuthn registration process
 func ServeWebAuthnBeginRegistration(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -18,6 +33,12 @@ func ServeWebAuthnBeginRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !isSameOrigin(r) {
+		log.Printf("Rejected cross-origin WebAuthn request to %s from %s", r.URL.Path, clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	var req struct {
 		Username string `json:"username"`
 	}
@@ -31,17 +52,16 @@ func ServeWebAuthnBeginRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Clean username (remove special characters, limit length)
-	username := req.Username[:min(len(req.Username), 20)]
-	for i, char := range username {
-		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
-			(char >= '0' && char <= '9') || char == '_' || char == '-') {
-			username = username[:i] + username[i+1:]
-		}
+	username := req.Username
+
+	if err := config.GetConfig().Username.Validate(username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if len(username) < 2 {
-		http.Error(w, "Username must be at least 2 characters", http.StatusBadRequest)
+	// The guest prefix is reserved so guests can't impersonate registered users
+	if strings.HasPrefix(username, guestPrefix) {
+		http.Error(w, "Username prefix '"+guestPrefix+"' is reserved", http.StatusBadRequest)
 		return
 	}
 
@@ -53,22 +73,45 @@ func ServeWebAuthnBeginRegistration(w http.ResponseWriter, r *http.Request) {
 
 	// Create a new user for WebAuthn registration
 	user := auth.CreateUserForRegistration(username)
+	auth.RecordAuditEvent(auth.AuditRegistrationStarted, username, clientIP(r))
 
-	webAuthnUser := &types.WebAuthnUser{User: user}
+	webAuthnUser := &types.WebAuthnUser{
+		User:        user,
+		Credentials: auth.LoadCredentials(username),
+	}
 
-	// Begin WebAuthn registration
-	options, _, err := auth.GetWebAuthn().BeginRegistration(webAuthnUser)
+	// Begin WebAuthn registration, keeping the challenge to verify the attestation against
+	options, session, err := auth.GetWebAuthn().BeginRegistration(webAuthnUser, registrationOptions(config.GetConfig().WebAuthn)...)
 	if err != nil {
 		log.Printf("WebAuthn registration failed: %v", err)
 		http.Error(w, "Registration failed", http.StatusInternalServerError)
 		return
 	}
+	auth.SaveCeremony(session)
 
 	// Return the registration options
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(options)
 }
 
+// registrationOptions applies the configured authenticator selection and attestation preference
+func registrationOptions(policy config.WebAuthnPolicy) []webauthn.RegistrationOption {
+	selection := protocol.AuthenticatorSelection{
+		AuthenticatorAttachment: protocol.AuthenticatorAttachment(policy.AuthenticatorAttachment),
+		ResidentKey:             protocol.ResidentKeyRequirement(policy.ResidentKey),
+		UserVerification:        protocol.UserVerificationRequirement(policy.UserVerification),
+	}
+	// requireResidentKey is the Level 1 spelling, still read by older browsers
+	if selection.ResidentKey == protocol.ResidentKeyRequirementRequired {
+		selection.RequireResidentKey = protocol.ResidentKeyRequired()
+	}
+
+	return []webauthn.RegistrationOption{
+		webauthn.WithAuthenticatorSelection(selection),
+		webauthn.WithConveyancePreference(protocol.ConveyancePreference(policy.Attestation)),
+	}
+}
+
 // ServeWebAuthnFinishRegistration completes the WebAuthn registration process
 func ServeWebAuthnFinishRegistration(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -76,58 +119,102 @@ func ServeWebAuthnFinishRegistration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the credential creation response from the request body
+	if !isSameOrigin(r) {
+		log.Printf("Rejected cross-origin WebAuthn request to %s from %s", r.URL.Path, clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Parse the credential creation response, finding the registration it answers by its challenge
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebAuthnBody))
+	if err != nil {
+		http.Error(w, "Invalid response", http.StatusBadRequest)
+		return
+	}
 	var req struct {
-		ID       string `json:"id"`
-		RawID    string `json:"rawId"`
-		Type     string `json:"type"`
-		Username string `json:"username"` // Add username to the request structure
-		Response struct {
-			AttestationObject string `json:"attestationObject"`
-			ClientDataJSON    string `json:"clientDataJSON"`
-		} `json:"response"`
+		DeviceLabel string `json:"deviceLabel"` // Optional name for the authenticator, shown when listing credentials
+		Invite      string `json:"invite"`      // Optional invite token the registration started from
 	}
+	json.Unmarshal(body, &req)
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(body)
+	if err != nil {
 		log.Printf("Failed to parse credential creation response: %v", err)
 		http.Error(w, "Invalid response", http.StatusBadRequest)
 		return
 	}
 
-	// Get username from the request body
-	username := req.Username
-	if username == "" {
-		http.Error(w, "Username not found in request", http.StatusBadRequest)
+	session := auth.TakeCeremony(parsed.Response.CollectedClientData.Challenge)
+	if session == nil {
+		http.Error(w, "Registration expired, please try again", http.StatusBadRequest)
 		return
 	}
 
+	// The user was named when the registration began, not by this request
+	username := string(session.UserID)
 	user := auth.GetUser(username)
 	if user == nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	// Create a mock credential for now (in production, you'd validate the actual credential)
-	// For now, we'll just mark the user as registered
+	webAuthnUser := &types.WebAuthnUser{
+		User:        user,
+		Credentials: auth.LoadCredentials(username),
+	}
+	credential, err := auth.GetWebAuthn().CreateCredential(webAuthnUser, *session, parsed)
+	if err != nil {
+		log.Printf("WebAuthn registration for %s failed verification: %v", username, err)
+		http.Error(w, "Registration failed", http.StatusBadRequest)
+		return
+	}
+
+	// An invite is used up once the passkey it was opened for has been verified
+	if req.Invite != "" {
+		if _, err := auth.ConsumeInvite(req.Invite); err != nil {
+			writeInviteError(w, err)
+			return
+		}
+	}
+
+	// Another ceremony begun for the same pending user may have finished first
+	claimed, err := auth.ClaimRegistration(username)
+	if err != nil {
+		log.Printf("Failed to claim registration for %s: %v", username, err)
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		log.Printf("Rejected WebAuthn registration for %s: already registered", username)
+		http.Error(w, "User already registered", http.StatusConflict)
+		return
+	}
+
+	if err := auth.StoreCredential(username, credential, req.DeviceLabel); err != nil {
+		log.Printf("Failed to store credential for %s: %v", username, err)
+		if db := database.GetDatabase(); db != nil {
+			db.SetUserRegistered(username, false)
+		}
+		http.Error(w, "Registration failed", http.StatusInternalServerError)
+		return
+	}
+
+	passkeyID := credentials.EncodeCredentialID(credential.ID)
 	types.UsersMutex.Lock()
 	user.IsRegistered = true
-	user.PasskeyID = req.ID
+	user.PasskeyID = passkeyID
 	types.UsersMutex.Unlock()
 
 	// Update user in database
 	db := database.GetDatabase()
 	if db != nil {
 		// Update passkey ID
-		if err := db.UpdateUserPasskeyID(username, req.ID); err != nil {
+		if err := db.UpdateUserPasskeyID(username, passkeyID); err != nil {
 			log.Printf("Failed to update passkey ID in database: %v", err)
 		}
-
-		// Mark user as registered
-		if err := db.SetUserRegistered(username, true); err != nil {
-			log.Printf("Failed to set user as registered in database: %v", err)
-		}
 	}
 
+	auth.RecordAuditEvent(auth.AuditRegistrationCompleted, username, clientIP(r))
 	log.Printf("WebAuthn registration completed for user: %s", username)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -141,27 +228,26 @@ func ServeWebAuthnBeginLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate a random challenge for WebAuthn
-	challenge := make([]byte, 32)
-	_, err := rand.Read(challenge)
-	if err != nil {
-		log.Printf("Failed to generate challenge: %v", err)
-		http.Error(w, "Login failed", http.StatusInternalServerError)
+	if !isSameOrigin(r) {
+		log.Printf("Rejected cross-origin WebAuthn request to %s from %s", r.URL.Path, clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	// Return WebAuthn authentication options
-	response := map[string]interface{}{
-		"publicKey": map[string]interface{}{
-			"challenge":        challenge,
-			"rpId":             "localhost",
-			"timeout":          60000,
-			"userVerification": "preferred",
-		},
+	// Begin a discoverable login (no username needed), letting the library encode the options
+	options, session, err := auth.GetWebAuthn().BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationPreferred),
+	)
+	if err != nil {
+		log.Printf("WebAuthn login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
 	}
+	auth.SaveCeremony(session)
 
+	// Return the authentication options
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(options)
 }
 
 // ServeWebAuthnFinishLogin completes the WebAuthn authentication process
@@ -171,50 +257,88 @@ func ServeWebAuthnFinishLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse the credential assertion response from the request body
-	var req struct {
-		ID       string `json:"id"`
-		RawID    string `json:"rawId"`
-		Type     string `json:"type"`
-		Response struct {
-			AuthenticatorData string `json:"authenticatorData"`
-			ClientDataJSON    string `json:"clientDataJSON"`
-			Signature         string `json:"signature"`
-		} `json:"response"`
+	if !isSameOrigin(r) {
+		log.Printf("Rejected cross-origin WebAuthn request to %s from %s", r.URL.Path, clientIP(r))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	// Parse the credential assertion response, finding the login it answers by its challenge
+	parsed, err := protocol.ParseCredentialRequestResponseBody(io.LimitReader(r.Body, maxWebAuthnBody))
+	if err != nil {
 		log.Printf("Failed to parse credential request response: %v", err)
+		auth.RecordAuditEvent(auth.AuditLoginFailure, "", clientIP(r))
 		http.Error(w, "Invalid response", http.StatusBadRequest)
 		return
 	}
 
-	// Find the user by passkey ID
-	authenticatedUser := auth.FindUserByPasskeyID(req.ID)
+	session := auth.TakeCeremony(parsed.Response.CollectedClientData.Challenge)
+	if session == nil {
+		auth.RecordAuditEvent(auth.AuditLoginFailure, "", clientIP(r))
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
 
-	if authenticatedUser == nil {
-		http.Error(w, "User not found or passkey not recognized", http.StatusNotFound)
+	// The credential names its owner in the user handle; the signature is then checked
+	// against the public key stored for that user's credential
+	var authenticatedUser *types.User
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		authenticatedUser = auth.FindUserByCredentialHandle(credentials.EncodeCredentialID(rawID), userHandle)
+		if authenticatedUser == nil {
+			return nil, errUnknownPasskey
+		}
+		return &types.WebAuthnUser{
+			User:        authenticatedUser,
+			Credentials: auth.LoadCredentials(authenticatedUser.Username),
+		}, nil
+	}
+
+	credential, err := auth.GetWebAuthn().ValidateDiscoverableLogin(findUser, *session, parsed)
+	if err != nil {
+		if authenticatedUser == nil {
+			auth.RecordAuditEvent(auth.AuditLoginFailure, "", clientIP(r))
+			http.Error(w, "User not found or passkey not recognized", http.StatusNotFound)
+			return
+		}
+		log.Printf("WebAuthn login for %s failed verification: %v", authenticatedUser.Username, err)
+		auth.RecordAuditEvent(auth.AuditLoginFailure, authenticatedUser.Username, clientIP(r))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	// A sign count that didn't go up means another copy of the authenticator signed in since
+	if credential.Authenticator.CloneWarning {
+		log.Printf("WebAuthn login for %s rejected: sign count %d did not increase, the authenticator may be cloned",
+			authenticatedUser.Username, parsed.Response.AuthenticatorData.Counter)
+		auth.RecordAuditEvent(auth.AuditLoginFailure, authenticatedUser.Username, clientIP(r))
+		http.Error(w, "Login failed", http.StatusUnauthorized)
 		return
 	}
 
 	if !authenticatedUser.IsRegistered {
+		auth.RecordAuditEvent(auth.AuditLoginFailure, authenticatedUser.Username, clientIP(r))
 		http.Error(w, "User not fully registered", http.StatusUnauthorized)
 		return
 	}
 
-	// For now, we'll just mark the user as logged in
-	// In production, you'd validate the actual credential
+	if err := auth.UpdateCredential(credential); err != nil {
+		log.Printf("Failed to update credential for %s: %v", authenticatedUser.Username, err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+
 	auth.UpdateUserLastLogin(authenticatedUser.Username)
 
 	// Create session for web client
-	sessionID := auth.CreateSession(authenticatedUser.Username)
-	http.SetCookie(w, &http.Cookie{
-		Name:     "chapp_session",
-		Value:    sessionID,
-		Path:     "/",
-		HttpOnly: true,
-		MaxAge:   86400, // 24 hours
-	})
+	sessionID, err := auth.CreateSession(authenticatedUser.Username)
+	if err != nil {
+		log.Printf("WebAuthn login failed: %v", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, sessionCookie(r, sessionID, int(config.GetConfig().SessionTTL/time.Second)))
+	auth.RecordAuditEvent(auth.AuditSessionCreated, authenticatedUser.Username, clientIP(r))
+	auth.RecordAuditEvent(auth.AuditLoginSuccess, authenticatedUser.Username, clientIP(r))
 	log.Printf("WebAuthn login completed for user: %s", authenticatedUser.Username)
 
 	// Return JSON response
@@ -224,10 +348,21 @@ func ServeWebAuthnFinishLogin(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// min returns the minimum of two integers
-func min(a, b int) int {
-	if a < b {
-		return a
+// isSameOrigin reports whether a request was sent by a page on this server, guarding against
+// cross-site request forgery. Browsers send Origin on POSTs; Referer is the fallback, and a
+// request carrying neither is rejected.
+func isSameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" || source == "null" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return false
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
 	}
-	return b
+	return u.Host != "" && strings.EqualFold(u.Host, r.Host)
 }
@@ -1,47 +1,111 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/http"
 	"time"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
 	"chapp/cmd/server/types"
 	pkgtypes "chapp/pkg/types"
+	"chapp/pkg/vars"
+
+	"github.com/gorilla/websocket"
 )
 
+// guestPrefix is prepended to guest usernames
+const guestPrefix = "guest-"
+
 // ServeWs handles WebSocket requests from clients
 func ServeWs(hub *types.Hub, w http.ResponseWriter, r *http.Request) {
+	connID := newConnectionID()
+
+	// Explain plain HTTP requests, e.g. the ws URL pasted into a browser
+	if !websocket.IsWebSocketUpgrade(r) {
+		log.Printf("[conn %s] Rejected non-WebSocket request from %s", connID, clientIP(r))
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "Upgrade Required: this endpoint only accepts WebSocket connections. Open the chat at the main page instead.", http.StatusUpgradeRequired)
+		return
+	}
+
+	var username string
+	isGuest := false
+
 	// Check for session cookie (web client only)
 	cookie, err := r.Cookie(pkgtypes.SessionCookieName)
-	if err != nil || cookie.Value == "" {
-		log.Printf("WebSocket connection rejected: no session")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	if err == nil && cookie.Value != "" {
+		// Web client with session
+		session, err := auth.LookupSession(cookie.Value)
+		if err != nil {
+			serveDatabaseUnavailable(w, connID, err)
+			return
+		}
+		if session != nil {
+			username = session.Username
+		}
 	}
 
-	// Web client with session
-	session := auth.GetSession(cookie.Value)
-	if session == nil {
-		log.Printf("WebSocket connection rejected: invalid session")
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+	if username == "" {
+		// Fall back to a guest connection when allowed
+		guestName := r.URL.Query().Get("guest")
+		if !config.GetConfig().AllowGuests || guestName == "" {
+			log.Printf("[conn %s] WebSocket connection rejected: no valid session", connID)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// The prefixed name is what everyone sees, so it is the one that must meet the policy
+		username = guestPrefix + guestName
+		if err := config.GetConfig().Username.Validate(username); err != nil {
+			log.Printf("[conn %s] WebSocket connection rejected: invalid guest name: %v", connID, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if hub.IsConnected(username) {
+			log.Printf("[conn %s] WebSocket connection rejected: %s is already connected", connID, username)
+			http.Error(w, "Guest name is already in use", http.StatusConflict)
+			return
+		}
+		isGuest = true
 	}
-	username := session.Username
-	log.Printf("Web client connecting: %s", username)
+	log.Printf("[conn %s] Web client connecting: %s from %s", connID, username, clientIP(r))
 
 	// Check if user is registered with passkey
-	user := auth.GetUser(username)
-	if user == nil || !user.IsRegistered {
-		log.Printf("WebSocket connection rejected: user not registered with passkey")
-		http.Error(w, "Unauthorized - User must be registered with passkey", http.StatusUnauthorized)
+	if !isGuest {
+		user, err := auth.LookupUser(username)
+		if err != nil {
+			serveDatabaseUnavailable(w, connID, err)
+			return
+		}
+		if user == nil || !user.IsRegistered {
+			log.Printf("[conn %s] WebSocket connection rejected: user not registered with passkey", connID)
+			http.Error(w, "Unauthorized - User must be registered with passkey", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Enforce the connected client cap
+	if !hub.ReserveSlot() {
+		log.Printf("[conn %s] WebSocket connection rejected: server full", connID)
+		fullMsg := pkgtypes.Message{
+			Type:      pkgtypes.MessageTypeSystem,
+			Content:   "Server is full, please try again later",
+			Sender:    pkgtypes.SystemSender,
+			Timestamp: time.Now().Unix(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(fullMsg)
 		return
 	}
 
 	conn, err := types.Upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		hub.ReleaseSlot()
+		log.Printf("[conn %s] WebSocket upgrade failed: %v", connID, err)
 		return
 	}
 
@@ -50,31 +114,52 @@ func ServeWs(hub *types.Hub, w http.ResponseWriter, r *http.Request) {
 			Conn:     conn,
 			Username: username,
 		},
-		Send: make(chan []byte, 256),
+		Send:    make(chan []byte, 256),
+		IsGuest: isGuest,
+		ConnID:  connID,
 	}
 
-	hub.Register <- client
-
-	// Send user info to client
-	isRegistered := user != nil && user.IsRegistered
-
+	// Send user info to client. It is queued before the hub knows the client, so it comes first
+	// and can't race the hub dropping the connection.
+	buildInfo := vars.GetBuildInfo()
+	cfg := config.GetConfig()
 	userInfoMsg := pkgtypes.Message{
 		Type:      pkgtypes.MessageTypeUserInfo,
 		Content:   username,
 		Sender:    pkgtypes.SystemSender,
 		Timestamp: time.Now().Unix(),
+		Version:   &buildInfo,
+		Idle: &pkgtypes.IdlePolicy{
+			AwayAfter:       int64(cfg.IdleAway / time.Second),
+			DisconnectAfter: int64(cfg.IdleDisconnect / time.Second),
+		},
 	}
 	userInfoBytes, _ := json.Marshal(userInfoMsg)
 	client.Send <- userInfoBytes
+	hub.Register <- client
 
 	// Log connection with registration status
-	if isRegistered {
-		log.Printf("Web client connected: %s (registered)", username)
+	if isGuest {
+		client.Logf("Web client connected: %s (guest)", username)
 	} else {
-		log.Printf("Web client connected: %s (guest)", username)
+		client.Logf("Web client connected: %s (registered)", username)
 	}
 
 	// Start goroutines for reading and writing
 	go client.WritePump()
 	go client.ReadPump(hub)
 }
+
+// serveDatabaseUnavailable rejects a request with 503 when a user or session lookup fails,
+// rather than treating the user as unknown
+func serveDatabaseUnavailable(w http.ResponseWriter, connID string, err error) {
+	log.Printf("[conn %s] WebSocket connection rejected: %v", connID, err)
+	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+}
+
+// newConnectionID returns a short random ID for correlating a connection's log lines
+func newConnectionID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,44 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Timeout bounds how long in-flight requests get to finish once shutdown starts
+const Timeout = 10 * time.Second
+
+// Serve runs the server until ctx is cancelled (e.g. by SIGINT or SIGTERM), then stops accepting
+// requests, waits for in-flight ones and runs the cleanup steps in order. It returns early with
+// the error if the server fails to start.
+func Serve(ctx context.Context, server *http.Server, cleanup ...func()) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Shutdown left requests unfinished: %v", err)
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server error during shutdown: %v", err)
+	}
+
+	for _, step := range cleanup {
+		step()
+	}
+	log.Println("Shutdown complete")
+	return nil
+}
@@ -0,0 +1,80 @@
+package shutdown
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestServeRunsCleanupInOrder tests that cancelling the context stops the server and runs every cleanup step in order
+func TestServeRunsCleanupInOrder(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+
+	var steps []string
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, server, func() { steps = append(steps, "hub") }, func() { steps = append(steps, "database") })
+	}()
+
+	// Wait for the server to answer before shutting it down
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get("http://" + addr)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server never started: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for shutdown")
+	}
+
+	if !slices.Equal(steps, []string{"hub", "database"}) {
+		t.Errorf("Expected cleanup steps in order, got %v", steps)
+	}
+	if _, err := http.Get("http://" + addr); err == nil {
+		t.Error("Expected the server to stop accepting requests")
+	}
+}
+
+// TestServeStartError tests that a server that can't listen returns its error without cleaning up
+func TestServeStartError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	cleaned := false
+	err = Serve(context.Background(), &http.Server{Addr: listener.Addr().String()}, func() { cleaned = true })
+	if err == nil {
+		t.Fatal("Expected an error for an address in use")
+	}
+	if cleaned {
+		t.Error("Expected no cleanup when the server never started")
+	}
+}
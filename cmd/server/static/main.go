@@ -1,21 +1,37 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
 	"chapp/cmd/server/handlers"
+	"chapp/cmd/server/shutdown"
 	"chapp/pkg/database"
 )
 
 func main() {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	config.SetConfig(cfg)
+
 	// Initialize database
-	db, err := database.NewSQLite("chapp.db")
+	db, err := database.NewSQLite(cfg.DBPath)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
-	defer db.Close()
+
+	if cfg.DBBatchInterval > 0 {
+		db.EnableWriteBatching(cfg.DBBatchInterval)
+	}
 
 	// Set global database instance
 	database.SetDatabase(db)
@@ -23,6 +39,9 @@ func main() {
 	// Initialize WebAuthn
 	auth.InitializeWebAuthn()
 
+	// Load admin usernames
+	auth.SetAdmins(cfg.Admins)
+
 	// Start session cleanup goroutine
 	auth.StartSessionCleanup()
 
@@ -31,6 +50,9 @@ func main() {
 	http.HandleFunc("/login", handlers.ServeLogin)
 	http.HandleFunc("/register", handlers.ServeRegister)
 	http.HandleFunc("/logout", handlers.ServeLogout)
+	http.HandleFunc("/api/session", handlers.ServeSession)
+	http.HandleFunc("/version", handlers.ServeVersion)
+	http.HandleFunc("/readyz", handlers.ServeReady)
 
 	// WebAuthn endpoints
 	http.HandleFunc("/webauthn/begin-registration", handlers.ServeWebAuthnBeginRegistration)
@@ -38,13 +60,34 @@ func main() {
 	http.HandleFunc("/webauthn/begin-login", handlers.ServeWebAuthnBeginLogin)
 	http.HandleFunc("/webauthn/finish-login", handlers.ServeWebAuthnFinishLogin)
 
+	// Chat public key endpoint
+	http.HandleFunc("/api/publickey", handlers.ServePublicKey)
+
+	// Passkey management endpoint
+	http.HandleFunc("/api/credentials", handlers.ServeCredentials)
+
+	// Account data export and deletion endpoint
+	http.HandleFunc("/api/account", handlers.ServeAccountData)
+
+	// Invite endpoints
+	http.HandleFunc("/api/invites", handlers.ServeCreateInvite)
+	http.HandleFunc("/api/invites/check", handlers.ServeCheckInvite)
+
+	// Admin endpoints
+	http.HandleFunc("/api/admin/audit", handlers.ServeAdminAudit)
+	http.HandleFunc("/api/admin/users", handlers.ServeAdminUsers)
+
 	// Handle static files
 	http.HandleFunc("/css/", handlers.ServeStatic)
 	http.HandleFunc("/js/", handlers.ServeStatic)
 
-	log.Println("Chapp static server starting on :8080")
+	log.Printf("Chapp static server starting on %s", cfg.Addr)
+
+	// On SIGINT/SIGTERM: stop accepting requests, let in-flight ones finish, then flush and close the database
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = http.ListenAndServe(":8080", nil)
+	err = shutdown.Serve(ctx, &http.Server{Addr: cfg.Addr}, func() { db.Close() })
 	if err != nil {
 		log.Fatal("Static server error: ", err)
 	}
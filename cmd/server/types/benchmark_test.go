@@ -0,0 +1,146 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chapp/pkg/types"
+)
+
+// benchmarkMessage is a representative encrypted message as a client would send it
+var benchmarkMessage = types.Message{
+	Type:      types.MessageTypeEncrypted,
+	Content:   string(bytes.Repeat([]byte("A"), 344)), // base64 of one RSA-2048 ciphertext
+	Sender:    "alice",
+	Timestamp: 1700000000,
+}
+
+// broadcastBatch bounds how far the benchmark gets ahead of the receivers, so slow consumers aren't dropped
+const broadcastBatch = 256
+
+// BenchmarkBroadcastNClients measures fan-out of an untargeted encrypted message through the hub
+func BenchmarkBroadcastNClients(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, clients := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			hub := NewHub()
+			go hub.Run()
+
+			marker := []byte("benchmark-payload")
+			msg := benchmarkMessage
+			msg.Content = string(marker) + msg.Content
+			message, _ := json.Marshal(msg)
+
+			var delivered atomic.Int64
+			for i := 0; i < clients; i++ {
+				client := newTestClient(fmt.Sprintf("user%d", i))
+				client.Send = make(chan []byte, 1024)
+				go func() {
+					for data := range client.Send {
+						if bytes.Contains(data, marker) {
+							delivered.Add(1)
+						}
+					}
+				}()
+				hub.Register <- client
+				waitForClientCount(b, hub, i+1)
+			}
+
+			waitDelivered := func(expected int64) {
+				deadline := time.Now().Add(10 * time.Second)
+				for delivered.Load() < expected {
+					if time.Now().After(deadline) {
+						b.Fatalf("Delivered %d of %d messages", delivered.Load(), expected)
+					}
+					time.Sleep(10 * time.Microsecond)
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 1; i <= b.N; i++ {
+				hub.Broadcast <- message
+				if i%broadcastBatch == 0 {
+					waitDelivered(int64(clients) * int64(i))
+				}
+			}
+			waitDelivered(int64(clients) * int64(b.N))
+			b.StopTimer()
+
+			b.ReportMetric(float64(clients)*float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// BenchmarkReadPumpDispatch measures the per-message parse and dispatch done for each incoming frame
+func BenchmarkReadPumpDispatch(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name string
+		msg  types.Message
+	}{
+		{"encrypted", benchmarkMessage},
+		{"encrypted_unstamped", types.Message{Type: types.MessageTypeEncrypted, Content: benchmarkMessage.Content}},
+		{"public_key_share", types.Message{Type: types.MessageTypePublicKeyShare, Content: benchmarkMessage.Content, Sender: "alice", Timestamp: 1700000000}},
+	}
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			hub := NewHub()
+			hub.Moderator = nil // isolate parse and dispatch from the rate moderator
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for {
+					select {
+					case <-hub.Broadcast:
+					case <-done:
+						return
+					}
+				}
+			}()
+
+			client := newTestClient("alice")
+			message, _ := json.Marshal(tt.msg)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.handleMessage(hub, message)
+			}
+		})
+	}
+}
+
+// BenchmarkMessageRemarshal shows the cost of re-marshaling a message that was only parsed for inspection
+func BenchmarkMessageRemarshal(b *testing.B) {
+	message, _ := json.Marshal(benchmarkMessage)
+
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg types.Message
+			json.Unmarshal(message, &msg)
+		}
+	})
+
+	b.Run("unmarshal+marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var msg types.Message
+			json.Unmarshal(message, &msg)
+			json.Marshal(msg)
+		}
+	})
+}
@@ -0,0 +1,156 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+
+	"chapp/pkg/types"
+)
+
+// Hub-to-hub messages. Membership updates track which instances each user is connected to, so join
+// and leave notices are shown once per user and online checks see users on every instance; ID names
+// the instance and Content carries the notice. Clients never receive or send them.
+const (
+	messageTypeInstanceJoin  = "instance_join"  // Sender's first connection to instance ID registered
+	messageTypeInstanceLeave = "instance_leave" // Sender's last connection to instance ID left
+	messageTypeInstanceSync  = "instance_sync"  // A starting instance asks the others for their users
+	messageTypeInstanceAck   = "instance_ack"   // server_ack for Sender's message ID, queued for Recipient on another instance
+)
+
+// isInstanceMessage reports whether a message type is one hubs only exchange among themselves
+func isInstanceMessage(messageType string) bool {
+	switch messageType {
+	case messageTypeInstanceJoin, messageTypeInstanceLeave, messageTypeInstanceSync, messageTypeInstanceAck:
+		return true
+	}
+	return false
+}
+
+// Broadcaster shares relayed messages between WebSocket server instances. Each instance publishes
+// what its clients send and delivers everything it receives to its own clients, so a message sent
+// on one instance reaches clients connected to any of them.
+type Broadcaster interface {
+	// Publish sends a message to every subscribed instance, including this one
+	Publish(message []byte) error
+	// Subscribe starts delivering messages published by any instance
+	Subscribe(deliver func(message []byte)) error
+	Close() error
+}
+
+// Relay sends a message to every client, through the Broadcaster when one is set and directly
+// to this hub otherwise
+func (h *Hub) Relay(message []byte) {
+	if h.Broadcaster == nil {
+		h.Broadcast <- message
+		return
+	}
+	if err := h.Broadcaster.Publish(message); err != nil {
+		log.Printf("Failed to publish message: %v", err)
+	}
+}
+
+// subscribe delivers messages published by any instance to this hub's clients
+func (h *Hub) subscribe() {
+	if h.Broadcaster == nil {
+		return
+	}
+	// Deliver straight from the subscriber: queueing on h.Broadcast could stall it behind Run
+	if err := h.Broadcaster.Subscribe(h.deliver); err != nil {
+		log.Printf("Failed to subscribe to broadcasts: %v", err)
+		return
+	}
+
+	// Users already connected to other instances joined before this one was listening
+	syncRequest, _ := json.Marshal(types.Message{Type: messageTypeInstanceSync, ID: h.instanceID, Timestamp: time.Now().Unix()})
+	h.Relay(syncRequest)
+}
+
+// dispatchInstance handles a hub-to-hub message, returning the notices to announce
+func (h *Hub) dispatchInstance(msg types.Message) [][]byte {
+	switch msg.Type {
+	case messageTypeInstanceJoin, messageTypeInstanceLeave:
+		if notice := h.trackMembership(msg); notice != nil {
+			return h.dispatch(notice)
+		}
+	case messageTypeInstanceSync:
+		return h.membershipSnapshot()
+	case messageTypeInstanceAck:
+		h.SendToUsername(msg.Sender, serverAck(msg.ID, msg.Recipient))
+	}
+	return nil
+}
+
+// membershipSnapshot returns a membership update for every user connected to this instance
+func (h *Hub) membershipSnapshot() [][]byte {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	var updates [][]byte
+	for username := range h.ConnectedUsers {
+		updates = append(updates, h.joinNotice(username))
+	}
+	return updates
+}
+
+// relayedAck builds the hub-to-hub form of a server_ack for a sender connected to another instance
+func relayedAck(msg types.Message) []byte {
+	ack, _ := json.Marshal(types.Message{
+		Type:      messageTypeInstanceAck,
+		ID:        msg.ID,
+		Sender:    msg.Sender,
+		Recipient: msg.Recipient,
+		Timestamp: time.Now().Unix(),
+	})
+	return ack
+}
+
+// membershipMessage builds a hub-to-hub update about a user's connections to this instance
+func (h *Hub) membershipMessage(messageType, username, notice string) []byte {
+	membership := types.Message{
+		Type:      messageType,
+		ID:        h.instanceID,
+		Content:   notice,
+		Sender:    username,
+		Timestamp: time.Now().Unix(),
+	}
+	membershipBytes, _ := json.Marshal(membership)
+	return membershipBytes
+}
+
+// trackMembership records a membership update and returns the system notice to deliver, or nil
+// when the user was already connected to another instance or still is
+func (h *Hub) trackMembership(msg types.Message) []byte {
+	h.Mutex.Lock()
+	instances := h.userInstances[msg.Sender]
+	wasOnline := len(instances) > 0
+	if msg.Type == messageTypeInstanceJoin {
+		if instances == nil {
+			instances = make(map[string]bool)
+			h.userInstances[msg.Sender] = instances
+		}
+		instances[msg.ID] = true
+	} else {
+		delete(instances, msg.ID)
+		if len(instances) == 0 {
+			delete(h.userInstances, msg.Sender)
+			delete(h.presence, msg.Sender)
+		}
+	}
+	online := len(h.userInstances[msg.Sender]) > 0
+	h.Mutex.Unlock()
+
+	if (msg.Type == messageTypeInstanceJoin && !wasOnline) || (msg.Type == messageTypeInstanceLeave && !online) {
+		return systemNotice(msg.Content)
+	}
+	return nil
+}
+
+// newInstanceID returns a random ID telling this hub apart from other instances
+func newInstanceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,240 @@
+package types
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chapp/pkg/types"
+)
+
+// fakeBus stands in for a shared pub/sub server, delivering every published message to all subscribers
+type fakeBus struct {
+	mutex       sync.Mutex
+	subscribers []func(message []byte)
+}
+
+// fakeBroadcaster connects one hub to a fakeBus
+type fakeBroadcaster struct {
+	bus *fakeBus
+}
+
+func (b *fakeBroadcaster) Publish(message []byte) error {
+	b.bus.mutex.Lock()
+	subscribers := append([]func([]byte){}, b.bus.subscribers...)
+	b.bus.mutex.Unlock()
+
+	for _, deliver := range subscribers {
+		go deliver(message)
+	}
+	return nil
+}
+
+func (b *fakeBroadcaster) Subscribe(deliver func(message []byte)) error {
+	b.bus.mutex.Lock()
+	defer b.bus.mutex.Unlock()
+	b.bus.subscribers = append(b.bus.subscribers, deliver)
+	return nil
+}
+
+func (b *fakeBroadcaster) Close() error {
+	return nil
+}
+
+// newBusHub starts a hub sharing broadcasts through bus
+func newBusHub(bus *fakeBus) *Hub {
+	hub := NewHub()
+	hub.Broadcaster = &fakeBroadcaster{bus: bus}
+	go hub.Run()
+	return hub
+}
+
+// newSharedHubs starts two hubs sharing broadcasts through one fakeBus
+func newSharedHubs() (*Hub, *Hub) {
+	bus := &fakeBus{}
+	return newBusHub(bus), newBusHub(bus)
+}
+
+// TestBroadcasterCrossInstanceDelivery tests that directed and broadcast messages reach clients on another instance
+func TestBroadcasterCrossInstanceDelivery(t *testing.T) {
+	first, second := newSharedHubs()
+
+	alice := newTestClient("alice")
+	first.Register <- alice
+	bob := newTestClient("bob")
+	carol := newTestClient("carol")
+	second.Register <- bob
+	second.Register <- carol
+	waitForClientCount(t, first, 1)
+	waitForClientCount(t, second, 2)
+	drainMessages(t, alice)
+	drainMessages(t, bob)
+	drainMessages(t, carol)
+
+	// bob is connected to the other instance, so alice gets no delivery_failed
+	alice.handleMessage(first, []byte(`{"type":"encrypted_message","content":"for bob","sender":"alice","recipient":"bob","timestamp":1700000000}`))
+
+	if msg := nextChatMessage(t, bob); msg.Content != "for bob" || msg.Sender != "alice" {
+		t.Errorf("Expected bob to receive alice's message, got %+v", msg)
+	}
+	if messages := drainMessages(t, carol); len(messages) != 0 {
+		t.Errorf("Expected carol to receive nothing, got %+v", messages)
+	}
+	if messages := drainMessages(t, alice); countType(messages, types.MessageTypeDeliveryFailed) != 0 {
+		t.Errorf("Expected no delivery_failed for a recipient on another instance, got %+v", messages)
+	}
+
+	alice.handleMessage(first, []byte(`{"type":"encrypted_message","content":"for everyone","sender":"alice","timestamp":1700000000}`))
+
+	for _, client := range []*Client{bob, carol} {
+		if msg := nextChatMessage(t, client); msg.Content != "for everyone" {
+			t.Errorf("Expected %s to receive the broadcast, got %+v", client.Username, msg)
+		}
+	}
+}
+
+// TestBroadcasterSharesSystemMessages tests that join notices from one instance reach clients on another
+func TestBroadcasterSharesSystemMessages(t *testing.T) {
+	first, second := newSharedHubs()
+
+	bob := newTestClient("bob")
+	second.Register <- bob
+	waitForClientCount(t, second, 1)
+	drainMessages(t, bob)
+
+	first.Register <- newTestClient("alice")
+	waitForClientCount(t, first, 1)
+
+	messages := drainMessages(t, bob)
+	if countType(messages, types.MessageTypeSystem) == 0 {
+		t.Fatalf("Expected bob to see alice join on the other instance, got %+v", messages)
+	}
+}
+
+// TestBroadcasterJoinLeaveAcrossInstances tests that a user connected to two instances is announced
+// joining when the first connection arrives and leaving when the last one goes, on every instance
+func TestBroadcasterJoinLeaveAcrossInstances(t *testing.T) {
+	first, second := newSharedHubs()
+
+	carol := newTestClient("carol")
+	first.Register <- carol
+	bob := newTestClient("bob")
+	second.Register <- bob
+	waitForClientCount(t, first, 1)
+	waitForClientCount(t, second, 1)
+	drainMessages(t, carol)
+	drainMessages(t, bob)
+
+	// expectNotices checks the system notices carol and bob see after each step
+	expectNotices := func(step string, expected []string) {
+		t.Helper()
+		for _, client := range []*Client{carol, bob} {
+			var notices []string
+			for _, msg := range drainMessages(t, client) {
+				if msg.Type == types.MessageTypeSystem {
+					notices = append(notices, msg.Content)
+				}
+			}
+			if strings.Join(notices, "|") != strings.Join(expected, "|") {
+				t.Errorf("%s: expected %s to see %q, got %q", step, client.Username, expected, notices)
+			}
+		}
+	}
+
+	aliceFirst := newTestClient("alice")
+	first.Register <- aliceFirst
+	expectNotices("first connection", []string{"User alice joined the chat"})
+
+	aliceSecond := newTestClient("alice")
+	second.Register <- aliceSecond
+	expectNotices("second instance", nil)
+
+	first.Unregister <- aliceFirst
+	expectNotices("one connection left", nil)
+
+	aliceSecond.LeaveReason = "bye"
+	second.Unregister <- aliceSecond
+	expectNotices("last connection left", []string{"User alice left the chat: bye"})
+}
+
+// TestMembershipFromClientDropped tests that clients can't forge instance membership updates
+func TestMembershipFromClientDropped(t *testing.T) {
+	first, _ := newSharedHubs()
+
+	bob := newTestClient("bob")
+	first.Register <- bob
+	waitForClientCount(t, first, 1)
+	drainMessages(t, bob)
+
+	mallory := newTestClient("mallory")
+	mallory.handleMessage(first, []byte(`{"type":"instance_leave","id":"x","content":"User bob left the chat","sender":"bob","timestamp":1700000000}`))
+	if messages := drainMessages(t, bob); len(messages) != 0 {
+		t.Errorf("Expected a forged membership update to be dropped, got %+v", messages)
+	}
+}
+
+// TestBroadcasterOnlineAcrossInstances tests that acks, delivery failures and presence treat users on
+// another instance as online, including for an instance started after they connected
+func TestBroadcasterOnlineAcrossInstances(t *testing.T) {
+	bus := &fakeBus{}
+	first, second := newBusHub(bus), newBusHub(bus)
+
+	alice := newTestClient("alice")
+	first.Register <- alice
+	bob := newTestClient("bob")
+	second.Register <- bob
+	waitForClientCount(t, first, 1)
+	waitForClientCount(t, second, 1)
+	drainMessages(t, alice)
+	drainMessages(t, bob)
+
+	// A directed message to bob on the other instance is acked, not reported as failed
+	alice.handleMessage(first, []byte(`{"type":"encrypted_message","id":"m1","content":"for bob","recipient":"bob","timestamp":1700000000}`))
+	messages := drainMessages(t, alice)
+	if countType(messages, types.MessageTypeDeliveryFailed) != 0 {
+		t.Errorf("Expected no delivery_failed for bob, got %+v", messages)
+	}
+	if len(messages) != 1 || messages[0].Type != types.MessageTypeServerAck || messages[0].ID != "m1" || messages[0].Recipient != "bob" {
+		t.Errorf("Expected one server_ack for m1 to bob, got %+v", messages)
+	}
+	if msg := nextChatMessage(t, bob); msg.Content != "for bob" {
+		t.Errorf("Expected bob to receive alice's message, got %+v", msg)
+	}
+
+	// A user connected nowhere is still reported offline
+	alice.handleMessage(first, []byte(`{"type":"encrypted_message","id":"m2","content":"for dave","recipient":"dave","timestamp":1700000000}`))
+	if count := countType(drainMessages(t, alice), types.MessageTypeDeliveryFailed); count != 1 {
+		t.Errorf("Expected one delivery_failed for dave, got %d", count)
+	}
+
+	// bob's away message is kept for new connections on the other instance
+	bob.handleMessage(second, []byte(`{"type":"presence","content":"lunch","timestamp":1700000000}`))
+	drainMessages(t, alice)
+	if status := first.PresenceSnapshot()["bob"]; status != "lunch" {
+		t.Errorf("Expected bob's away message on the first instance, got %q", status)
+	}
+
+	// An instance started later learns who is already connected elsewhere
+	third := newBusHub(bus)
+	deadline := time.Now().Add(time.Second)
+	for !third.IsConnected("alice") || !third.IsConnected("bob") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the new instance to learn about alice and bob")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Once bob leaves every instance he is offline and no longer away
+	second.Unregister <- bob
+	deadline = time.Now().Add(time.Second)
+	for first.IsConnected("bob") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected bob to be offline after leaving")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, away := first.PresenceSnapshot()["bob"]; away {
+		t.Error("Expected bob's away message to be cleared after leaving")
+	}
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"sync"
+	"time"
+)
+
+// ModerationAction is the decision a moderation hook makes for a message
+type ModerationAction int
+
+const (
+	ModerationAllow      ModerationAction = iota // Relay the message
+	ModerationWarn                               // Relay the message but log a warning for operators
+	ModerationDrop                               // Silently drop the message
+	ModerationDisconnect                         // Drop the message and close the sender's connection
+)
+
+// MessageMetadata is what moderation hooks can see about a message (never its content)
+type MessageMetadata struct {
+	Sender   string
+	Type     string
+	Size     int
+	Received time.Time
+}
+
+// ModerationHook decides what to do with a message based on its metadata
+type ModerationHook interface {
+	Moderate(meta MessageMetadata) ModerationAction
+}
+
+// RateModerator flags or drops messages from senders exceeding a message rate
+type RateModerator struct {
+	limit  int
+	window time.Duration
+	over   ModerationAction // What happens to messages past the limit
+	recent map[string][]time.Time
+	mutex  sync.Mutex
+}
+
+// NewRateModerator creates a moderator warning about senders with more than limit messages per window
+func NewRateModerator(limit int, window time.Duration) *RateModerator {
+	return &RateModerator{
+		limit:  limit,
+		window: window,
+		over:   ModerationWarn,
+		recent: make(map[string][]time.Time),
+	}
+}
+
+// NewRateLimiter creates a moderator dropping messages from senders with more than limit messages per window
+func NewRateLimiter(limit int, window time.Duration) *RateModerator {
+	limiter := NewRateModerator(limit, window)
+	limiter.over = ModerationDrop
+	return limiter
+}
+
+// Moderate records the message and acts when the sender exceeds the rate limit
+func (m *RateModerator) Moderate(meta MessageMetadata) ModerationAction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Keep only timestamps inside the window
+	cutoff := meta.Received.Add(-m.window)
+	timestamps := m.recent[meta.Sender]
+	kept := timestamps[:0]
+	for _, ts := range timestamps {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	kept = append(kept, meta.Received)
+	m.recent[meta.Sender] = kept
+
+	if len(kept) > m.limit {
+		return m.over
+	}
+	return ModerationAllow
+}
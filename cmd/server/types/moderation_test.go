@@ -0,0 +1,151 @@
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"chapp/pkg/types"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockSender is a moderation hook dropping everything from one sender
+type blockSender struct {
+	sender string
+}
+
+func (b *blockSender) Moderate(meta MessageMetadata) ModerationAction {
+	if meta.Sender == b.sender {
+		return ModerationDrop
+	}
+	return ModerationAllow
+}
+
+// dialTestClient connects a WebSocket client served by ReadPump/WritePump for the given username
+func dialTestClient(t *testing.T, hub *Hub, username string) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &Client{
+			BaseClient: types.BaseClient{Conn: conn, Username: username},
+			Send:       make(chan []byte, 256),
+		}
+		hub.Register <- client
+		go client.WritePump()
+		go client.ReadPump(hub)
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect %s: %v", username, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// nextChatMessage returns the next non-system message sent to a client
+func nextChatMessage(t *testing.T, client *Client) types.Message {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case data := <-client.Send:
+			var msg types.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("Failed to decode message: %v", err)
+			}
+			if msg.Type != types.MessageTypeSystem {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+}
+
+// TestModerationHookBlocksSender tests that a custom hook can drop a sender's messages
+func TestModerationHookBlocksSender(t *testing.T) {
+	hub := NewHub()
+	hub.Moderator = &blockSender{sender: "mallory"}
+	go hub.Run()
+
+	listener := newTestClient("listener")
+	hub.Register <- listener
+
+	mallory := dialTestClient(t, hub, "mallory")
+	alice := dialTestClient(t, hub, "alice")
+
+	mallory.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "spam"})
+	time.Sleep(50 * time.Millisecond)
+	alice.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "hello"})
+
+	msg := nextChatMessage(t, listener)
+	if msg.Sender != "alice" {
+		t.Errorf("Expected first relayed message from 'alice', got '%s'", msg.Sender)
+	}
+}
+
+// TestRateModerator tests that the default moderator flags high message rates
+func TestRateModerator(t *testing.T) {
+	moderator := NewRateModerator(3, time.Second)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		meta := MessageMetadata{Sender: "alice", Received: now}
+		if action := moderator.Moderate(meta); action != ModerationAllow {
+			t.Errorf("Message %d should be allowed, got %v", i+1, action)
+		}
+	}
+
+	if action := moderator.Moderate(MessageMetadata{Sender: "alice", Received: now}); action != ModerationWarn {
+		t.Errorf("Message over the limit should be flagged, got %v", action)
+	}
+
+	if action := moderator.Moderate(MessageMetadata{Sender: "bob", Received: now}); action != ModerationAllow {
+		t.Errorf("Other senders should not be affected, got %v", action)
+	}
+
+	// Messages outside the window are forgotten
+	later := now.Add(2 * time.Second)
+	if action := moderator.Moderate(MessageMetadata{Sender: "alice", Received: later}); action != ModerationAllow {
+		t.Errorf("Message after the window should be allowed, got %v", action)
+	}
+}
+
+// TestGuestRateLimit tests that guests past their message rate are dropped while registered users are only flagged
+func TestGuestRateLimit(t *testing.T) {
+	hub := NewHub()
+	hub.Moderator = NewRateModerator(3, time.Minute)
+	hub.GuestModerator = NewRateLimiter(3, time.Minute)
+
+	guest := newTestClient("guest-visitor")
+	guest.IsGuest = true
+	member := newTestClient("alice")
+
+	for _, client := range []*Client{guest, member} {
+		for i := 0; i < 5; i++ {
+			client.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","timestamp":1700000000}`))
+		}
+	}
+
+	relayed := map[string]int{}
+	for len(hub.Broadcast) > 0 {
+		var msg types.Message
+		if err := json.Unmarshal(<-hub.Broadcast, &msg); err != nil {
+			t.Fatalf("Failed to decode relayed message: %v", err)
+		}
+		relayed[msg.Sender]++
+	}
+	if relayed["guest-visitor"] != 3 {
+		t.Errorf("Expected 3 guest messages relayed, got %d", relayed["guest-visitor"])
+	}
+	if relayed["alice"] != 5 {
+		t.Errorf("Expected all 5 of alice's messages relayed, got %d", relayed["alice"])
+	}
+}
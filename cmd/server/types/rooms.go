@@ -0,0 +1,201 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"chapp/pkg/types"
+)
+
+// MaxRoomNameLength caps the length of room names
+const MaxRoomNameLength = 32
+
+// Room join errors
+var (
+	ErrTooManyRooms       = errors.New("the server has reached its room limit")
+	ErrRoomFull           = errors.New("room is full")
+	ErrTooManyClientRooms = errors.New("you have joined too many rooms")
+)
+
+// ValidRoomName reports whether a room name is 1-32 letters, digits, underscores or hyphens
+func ValidRoomName(room string) bool {
+	if room == "" || len(room) > MaxRoomNameLength {
+		return false
+	}
+	for _, char := range room {
+		if !((char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') ||
+			(char >= '0' && char <= '9') || char == '_' || char == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// JoinRoom adds a client connection to a room, returning the other usernames already in it.
+// It fails when creating the room would exceed MaxRooms, the room already has MaxRoomMembers connections,
+// or the connection is already in MaxRoomsPerClient rooms.
+func (h *Hub) JoinRoom(client *Client, room string) ([]string, error) {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if h.MaxRoomsPerClient > 0 && !h.rooms[room][client] && h.clientRoomCount(client) >= h.MaxRoomsPerClient {
+		return nil, ErrTooManyClientRooms
+	}
+
+	members := h.rooms[room]
+	if members == nil {
+		if h.MaxRooms > 0 && len(h.rooms) >= h.MaxRooms {
+			return nil, ErrTooManyRooms
+		}
+		members = make(map[*Client]bool)
+		h.rooms[room] = members
+	}
+	if !members[client] && h.MaxRoomMembers > 0 && len(members) >= h.MaxRoomMembers {
+		return nil, ErrRoomFull
+	}
+	members[client] = true
+
+	return roomUsernames(members, client.Username), nil
+}
+
+// RoomCount returns the number of rooms with at least one member
+func (h *Hub) RoomCount() int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return len(h.rooms)
+}
+
+// LeaveRoom removes a client connection from a room, returning false if it wasn't a member
+func (h *Hub) LeaveRoom(client *Client, room string) bool {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if !h.rooms[room][client] {
+		return false
+	}
+	h.removeFromRoom(client, room)
+	return true
+}
+
+// InRoom reports whether a client connection is a member of a room
+func (h *Hub) InRoom(client *Client, room string) bool {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return h.rooms[room][client]
+}
+
+// RoomMembers returns the sorted usernames in a room
+func (h *Hub) RoomMembers(room string) []string {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return roomUsernames(h.rooms[room], "")
+}
+
+// clientRoomCount returns how many rooms a client connection is in (caller holds the lock)
+func (h *Hub) clientRoomCount(client *Client) int {
+	count := 0
+	for _, members := range h.rooms {
+		if members[client] {
+			count++
+		}
+	}
+	return count
+}
+
+// removeFromRoom drops a client from a room, deleting the room once empty (caller holds the lock)
+func (h *Hub) removeFromRoom(client *Client, room string) {
+	delete(h.rooms[room], client)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// leaveAllRooms removes a disconnecting client from every room, returning the rooms it was in (caller holds the lock)
+func (h *Hub) leaveAllRooms(client *Client) []string {
+	var left []string
+	for room, members := range h.rooms {
+		if members[client] {
+			left = append(left, room)
+			h.removeFromRoom(client, room)
+		}
+	}
+	return left
+}
+
+// roomUsernames returns the sorted distinct usernames of a room's members, excluding one username
+func roomUsernames(members map[*Client]bool, exclude string) []string {
+	seen := make(map[string]bool)
+	usernames := []string{}
+	for member := range members {
+		if member.Username != exclude && !seen[member.Username] {
+			seen[member.Username] = true
+			usernames = append(usernames, member.Username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// roomMessage builds a room membership message
+func roomMessage(messageType, sender, room string) []byte {
+	msg := types.Message{
+		Type:      messageType,
+		Sender:    sender,
+		Room:      room,
+		Timestamp: time.Now().Unix(),
+	}
+	msgBytes, _ := json.Marshal(msg)
+	return msgBytes
+}
+
+// sendSystem sends a system message to this connection only
+func (c *Client) sendSystem(hub *Hub, content, room string) {
+	msg := types.Message{
+		Type:      types.MessageTypeSystem,
+		Content:   content,
+		Sender:    types.SystemSender,
+		Room:      room,
+		Timestamp: time.Now().Unix(),
+	}
+	msgBytes, _ := json.Marshal(msg)
+	hub.SendToClient(c, msgBytes)
+}
+
+// joinRoom handles a client's join_room request. The joiner learns the existing members
+// through one join_room message each, then everyone in the room sees the join.
+func (c *Client) joinRoom(hub *Hub, room string) {
+	if !ValidRoomName(room) {
+		c.sendSystem(hub, fmt.Sprintf("Invalid room name %q", room), "")
+		return
+	}
+	if hub.InRoom(c, room) {
+		return
+	}
+
+	members, err := hub.JoinRoom(c, room)
+	if err != nil {
+		c.Logf("%s could not join room %s: %v", c.Username, room, err)
+		c.sendSystem(hub, fmt.Sprintf("Cannot join %s: %v", room, err), "")
+		return
+	}
+
+	for _, member := range members {
+		hub.SendToClient(c, roomMessage(types.MessageTypeJoinRoom, member, room))
+	}
+	c.Logf("%s joined room %s", c.Username, room)
+
+	hub.Relay(roomMessage(types.MessageTypeJoinRoom, c.Username, room))
+}
+
+// leaveRoom handles a client's leave_room request
+func (c *Client) leaveRoom(hub *Hub, room string) {
+	if !hub.LeaveRoom(c, room) {
+		return
+	}
+	c.Logf("%s left room %s", c.Username, room)
+
+	hub.Relay(roomMessage(types.MessageTypeLeaveRoom, c.Username, room))
+}
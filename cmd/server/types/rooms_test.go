@@ -0,0 +1,348 @@
+package types
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"chapp/pkg/types"
+
+	"github.com/gorilla/websocket"
+)
+
+// joinTestRoom sends a join_room request and waits for the hub to record it
+func joinTestRoom(t *testing.T, hub *Hub, conn *roomTestClient, username, room string) {
+	if err := conn.WriteJSON(types.Message{Type: types.MessageTypeJoinRoom, Room: room}); err != nil {
+		t.Fatalf("Failed to join %s: %v", room, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, member := range hub.RoomMembers(room) {
+			if member == username {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s to join %s", username, room)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// roomTestClient is a dialed connection whose incoming messages are collected in the background
+type roomTestClient struct {
+	*websocket.Conn
+	received chan types.Message
+}
+
+// dialRoomTestClient connects a client and starts collecting what it receives
+func dialRoomTestClient(t *testing.T, hub *Hub, username string) *roomTestClient {
+	client := &roomTestClient{
+		Conn:     dialTestClient(t, hub, username),
+		received: make(chan types.Message, 100),
+	}
+	go func() {
+		for {
+			var msg types.Message
+			if err := client.ReadJSON(&msg); err != nil {
+				return
+			}
+			client.received <- msg
+		}
+	}()
+	return client
+}
+
+// readRoomMessages returns the messages a client received after a short wait
+func readRoomMessages(t *testing.T, client *roomTestClient) []types.Message {
+	time.Sleep(50 * time.Millisecond)
+
+	var messages []types.Message
+	for {
+		select {
+		case msg := <-client.received:
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+// contentsInRoom returns the contents of encrypted messages received for a room
+func contentsInRoom(messages []types.Message, room string) []string {
+	var contents []string
+	for _, msg := range messages {
+		if msg.Type == types.MessageTypeEncrypted && msg.Room == room {
+			contents = append(contents, msg.Content)
+		}
+	}
+	return contents
+}
+
+// TestRoomDeliveryIsolation tests that room messages only reach that room's members
+func TestRoomDeliveryIsolation(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := dialRoomTestClient(t, hub, "alice")
+	bob := dialRoomTestClient(t, hub, "bob")
+	carol := dialRoomTestClient(t, hub, "carol")
+	waitForClientCount(t, hub, 3)
+
+	joinTestRoom(t, hub, alice, "alice", "red")
+	joinTestRoom(t, hub, bob, "bob", "red")
+	joinTestRoom(t, hub, carol, "carol", "blue")
+	readRoomMessages(t, alice)
+	readRoomMessages(t, bob)
+	readRoomMessages(t, carol)
+
+	// Carol can't send into a room she isn't in
+	carol.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "intrusion", Recipient: "bob", Room: "red"})
+	alice.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "red-secret", Recipient: "bob", Room: "red"})
+
+	if contents := contentsInRoom(readRoomMessages(t, bob), "red"); len(contents) != 1 || contents[0] != "red-secret" {
+		t.Errorf("Expected bob to receive only 'red-secret', got %v", contents)
+	}
+
+	carolMessages := readRoomMessages(t, carol)
+	if contents := contentsInRoom(carolMessages, "red"); len(contents) != 0 {
+		t.Errorf("Expected carol to receive nothing from red, got %v", contents)
+	}
+	if countType(carolMessages, types.MessageTypeSystem) != 1 {
+		t.Errorf("Expected carol to be told she isn't in red, got %v", carolMessages)
+	}
+
+	// Leaving stops delivery
+	if err := bob.WriteJSON(types.Message{Type: types.MessageTypeLeaveRoom, Room: "red"}); err != nil {
+		t.Fatalf("Failed to leave room: %v", err)
+	}
+	readRoomMessages(t, bob)
+
+	if members := hub.RoomMembers("red"); len(members) != 1 || members[0] != "alice" {
+		t.Errorf("Expected only alice in red, got %v", members)
+	}
+}
+
+// TestRoomMultiplexing tests a client in several rooms receiving from each, tagged by room
+func TestRoomMultiplexing(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := dialRoomTestClient(t, hub, "alice")
+	bob := dialRoomTestClient(t, hub, "bob")
+	carol := dialRoomTestClient(t, hub, "carol")
+	waitForClientCount(t, hub, 3)
+
+	joinTestRoom(t, hub, alice, "alice", "red")
+	joinTestRoom(t, hub, alice, "alice", "blue")
+	joinTestRoom(t, hub, bob, "bob", "red")
+	joinTestRoom(t, hub, carol, "carol", "blue")
+
+	// A late joiner learns existing members through join_room messages
+	joined := readRoomMessages(t, carol)
+	var announced []string
+	for _, msg := range joined {
+		if msg.Type == types.MessageTypeJoinRoom && msg.Room == "blue" {
+			announced = append(announced, msg.Sender)
+		}
+	}
+	if len(announced) != 2 || announced[0] != "alice" || announced[1] != "carol" {
+		t.Errorf("Expected carol to learn about alice then her own join, got %v", announced)
+	}
+	readRoomMessages(t, alice)
+
+	bob.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "from-red", Recipient: "alice", Room: "red"})
+	carol.WriteJSON(types.Message{Type: types.MessageTypeEncrypted, Content: "from-blue", Recipient: "alice", Room: "blue"})
+
+	received := readRoomMessages(t, alice)
+	if contents := contentsInRoom(received, "red"); len(contents) != 1 || contents[0] != "from-red" {
+		t.Errorf("Expected 'from-red' in red, got %v", contents)
+	}
+	if contents := contentsInRoom(received, "blue"); len(contents) != 1 || contents[0] != "from-blue" {
+		t.Errorf("Expected 'from-blue' in blue, got %v", contents)
+	}
+}
+
+// TestValidRoomName tests room name validation
+func TestValidRoomName(t *testing.T) {
+	valid := []string{"general", "team-1", "a_b"}
+	invalid := []string{"", "has space", "dot.name", "abcdefghijklmnopqrstuvwxyz0123456"}
+
+	for _, room := range valid {
+		if !ValidRoomName(room) {
+			t.Errorf("Expected '%s' to be valid", room)
+		}
+	}
+	for _, room := range invalid {
+		if ValidRoomName(room) {
+			t.Errorf("Expected '%s' to be invalid", room)
+		}
+	}
+}
+
+// TestRoomLimits tests the room and member caps and that empty rooms are removed
+func TestRoomLimits(t *testing.T) {
+	hub := NewHub()
+	hub.MaxRooms = 2
+	hub.MaxRoomMembers = 2
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	carol := newTestClient("carol")
+
+	if _, err := hub.JoinRoom(alice, "red"); err != nil {
+		t.Fatalf("Expected alice to join red, got %v", err)
+	}
+	if _, err := hub.JoinRoom(bob, "red"); err != nil {
+		t.Fatalf("Expected bob to join red, got %v", err)
+	}
+	if _, err := hub.JoinRoom(carol, "red"); err != ErrRoomFull {
+		t.Errorf("Expected ErrRoomFull, got %v", err)
+	}
+	if _, err := hub.JoinRoom(alice, "red"); err != nil {
+		t.Errorf("Expected rejoining a full room to succeed, got %v", err)
+	}
+
+	if _, err := hub.JoinRoom(carol, "blue"); err != nil {
+		t.Fatalf("Expected carol to join blue, got %v", err)
+	}
+	if _, err := hub.JoinRoom(carol, "green"); err != ErrTooManyRooms {
+		t.Errorf("Expected ErrTooManyRooms, got %v", err)
+	}
+	if hub.RoomCount() != 2 {
+		t.Errorf("Expected 2 rooms, got %d", hub.RoomCount())
+	}
+
+	// Emptying a room frees its slot
+	hub.LeaveRoom(carol, "blue")
+	if hub.RoomCount() != 1 {
+		t.Errorf("Expected the empty room to be removed, got %d rooms", hub.RoomCount())
+	}
+	if _, err := hub.JoinRoom(carol, "green"); err != nil {
+		t.Errorf("Expected carol to join green after blue emptied, got %v", err)
+	}
+}
+
+// TestRoomFullSystemError tests that a refused join is reported to the client
+func TestRoomFullSystemError(t *testing.T) {
+	hub := NewHub()
+	hub.MaxRoomMembers = 1
+	go hub.Run()
+
+	alice := dialRoomTestClient(t, hub, "alice")
+	bob := dialRoomTestClient(t, hub, "bob")
+	waitForClientCount(t, hub, 2)
+
+	joinTestRoom(t, hub, alice, "alice", "red")
+	readRoomMessages(t, bob)
+
+	if err := bob.WriteJSON(types.Message{Type: types.MessageTypeJoinRoom, Room: "red"}); err != nil {
+		t.Fatalf("Failed to send join: %v", err)
+	}
+
+	if countType(readRoomMessages(t, bob), types.MessageTypeSystem) != 1 {
+		t.Errorf("Expected bob to receive a system error")
+	}
+	if members := hub.RoomMembers("red"); len(members) != 1 || members[0] != "alice" {
+		t.Errorf("Expected only alice in red, got %v", members)
+	}
+}
+
+// TestRoomsPerClientLimit tests that one connection can't join more than MaxRoomsPerClient rooms
+func TestRoomsPerClientLimit(t *testing.T) {
+	hub := NewHub()
+	hub.MaxRoomsPerClient = 2
+
+	alice := newTestClient("alice")
+	for _, room := range []string{"red", "blue"} {
+		if _, err := hub.JoinRoom(alice, room); err != nil {
+			t.Fatalf("Expected alice to join %s, got %v", room, err)
+		}
+	}
+	if _, err := hub.JoinRoom(alice, "green"); err != ErrTooManyClientRooms {
+		t.Errorf("Expected ErrTooManyClientRooms, got %v", err)
+	}
+	if _, err := hub.JoinRoom(alice, "red"); err != nil {
+		t.Errorf("Expected rejoining a room to succeed, got %v", err)
+	}
+	if _, err := hub.JoinRoom(newTestClient("bob"), "green"); err != nil {
+		t.Errorf("Expected the limit to apply per connection, got %v", err)
+	}
+}
+
+// TestUnregisterFromManyRooms tests that a client in more rooms than the broadcast queue holds can disconnect
+func TestUnregisterFromManyRooms(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	hub.Register <- alice
+	hub.Register <- bob
+	waitForClientCount(t, hub, 2)
+
+	for i := 0; i < cap(hub.Broadcast)+50; i++ {
+		if _, err := hub.JoinRoom(alice, fmt.Sprintf("room-%d", i)); err != nil {
+			t.Fatalf("Failed to join room %d: %v", i, err)
+		}
+	}
+	drainMessages(t, bob)
+
+	hub.Unregister <- alice
+	waitForClientCount(t, hub, 1)
+	if count := hub.RoomCount(); count != 0 {
+		t.Errorf("Expected every room to be removed, got %d", count)
+	}
+
+	// The hub keeps relaying afterwards
+	hub.Relay([]byte(`{"type":"system","content":"still here","sender":"System"}`))
+	messages := drainMessages(t, bob)
+	if len(messages) == 0 || messages[len(messages)-1].Content != "still here" {
+		t.Errorf("Expected bob to receive the hub's next message, got %+v", messages)
+	}
+}
+
+// TestEvictedClientLeavesRooms tests that a client dropped for a full send queue is removed from its rooms
+func TestEvictedClientLeavesRooms(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	hub.Register <- alice
+	hub.Register <- bob
+	waitForClientCount(t, hub, 2)
+	for _, room := range []string{"red", "blue"} {
+		if _, err := hub.JoinRoom(alice, room); err != nil {
+			t.Fatalf("Failed to join %s: %v", room, err)
+		}
+	}
+	if _, err := hub.JoinRoom(bob, "red"); err != nil {
+		t.Fatalf("Failed to join red: %v", err)
+	}
+	drainMessages(t, alice)
+	drainMessages(t, bob)
+
+	// alice stops reading, so her queue fills
+	for len(alice.Send) < cap(alice.Send) {
+		alice.Send <- []byte("{}")
+	}
+	hub.Relay([]byte(`{"type":"encrypted_message","content":"secret","sender":"bob","room":"red"}`))
+	waitForClientCount(t, hub, 1)
+
+	if members := hub.RoomMembers("red"); len(members) != 1 || members[0] != "bob" {
+		t.Errorf("Expected only bob left in red, got %v", members)
+	}
+	if count := hub.RoomCount(); count != 1 {
+		t.Errorf("Expected alice's empty room to be removed, got %d rooms", count)
+	}
+	if hub.IsConnected("alice") {
+		t.Error("Expected alice to no longer be connected")
+	}
+
+	messages := drainMessages(t, bob)
+	if countType(messages, types.MessageTypeLeaveRoom) != 1 || countType(messages, types.MessageTypeSystem) != 1 {
+		t.Errorf("Expected bob to see alice leave red and the chat, got %+v", messages)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,17 +20,39 @@ import (
 // Client represents a connected WebSocket client
 type Client struct {
 	types.BaseClient
-	Send chan []byte
+	Send        chan []byte
+	IsGuest     bool   // Connected without a registered account
+	LeaveReason string // Optional reason sent by the client before quitting
+	ConnID      string // Short ID correlating log lines for this connection
+}
+
+// Logf logs a message prefixed with the client's connection ID
+func (c *Client) Logf(format string, args ...any) {
+	log.Printf("[conn %s] "+format, append([]any{c.ConnID}, args...)...)
 }
 
 // Hub manages all connected clients (server doesn't store private keys)
 type Hub struct {
-	Clients        map[*Client]bool
-	ConnectedUsers map[string]bool // Track connected users by username
-	Broadcast      chan []byte
-	Register       chan *Client
-	Unregister     chan *Client
-	Mutex          sync.RWMutex
+	Clients           map[*Client]bool
+	ConnectedUsers    map[string]bool // Track connected users by username
+	Broadcast         chan []byte
+	Register          chan *Client
+	Unregister        chan *Client
+	Moderator         ModerationHook // Optional metadata-only moderation, nil disables it
+	GuestModerator    ModerationHook // Moderation for guest connections instead of Moderator, nil falls back to Moderator
+	Broadcaster       Broadcaster    // Shares messages with other server instances, nil keeps them in this process
+	MaxClients        int            // Maximum connected clients, 0 means unlimited
+	MaxRooms          int            // Maximum rooms in use, 0 means unlimited
+	MaxRoomMembers    int            // Maximum connections per room, 0 means unlimited
+	MaxRoomsPerClient int            // Maximum rooms one connection may be in, 0 means unlimited
+	RequireRecipient  bool           // Refuse encrypted messages without a recipient instead of relaying them to everyone
+	Mutex             sync.RWMutex
+	reserved          int                         // Slots reserved by connections not yet registered
+	presence          map[string]string           // Away messages by username, never persisted
+	rooms             map[string]map[*Client]bool // Room members by room name
+	messageCounts     map[string]int              // Broadcast messages by type, unknown types counted as "other"
+	instanceID        string                      // Tells this hub apart from other instances sharing its Broadcaster
+	userInstances     map[string]map[string]bool  // Instances each user is connected to, tracked with a Broadcaster
 }
 
 // Session management
@@ -38,6 +63,7 @@ type Session struct {
 
 // User management
 type User struct {
+	ID           int       `json:"id"`
 	Username     string    `json:"username"`
 	Created      time.Time `json:"created"`
 	LastLogin    time.Time `json:"last_login"`
@@ -49,8 +75,11 @@ type User struct {
 // WebAuthnUser implements the webauthn.User interface
 type WebAuthnUser struct {
 	*User
+	Credentials []webauthn.Credential
 }
 
+var _ webauthn.User = (*WebAuthnUser)(nil)
+
 func (u *WebAuthnUser) WebAuthnID() []byte {
 	return []byte(u.Username)
 }
@@ -63,14 +92,8 @@ func (u *WebAuthnUser) WebAuthnDisplayName() string {
 	return u.Username
 }
 
-func (u *WebAuthnUser) WebAuthnIcon() string {
-	return ""
-}
-
 func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
-	// For now, we'll store credentials in the User struct
-	// In a real implementation, you'd have a separate credentials table
-	return []webauthn.Credential{}
+	return u.Credentials
 }
 
 // NewHub creates a new hub instance
@@ -81,98 +104,406 @@ func NewHub() *Hub {
 		Broadcast:      make(chan []byte, 100),
 		Register:       make(chan *Client, 10),
 		Unregister:     make(chan *Client, 10),
+		presence:       make(map[string]string),
+		rooms:          make(map[string]map[*Client]bool),
+		messageCounts:  make(map[string]int),
+		instanceID:     newInstanceID(),
+		userInstances:  make(map[string]map[string]bool),
+		Moderator:      NewRateModerator(100, time.Second),
+		GuestModerator: NewRateLimiter(20, time.Second),
+	}
+}
+
+// ClientCount returns the number of connected clients
+func (h *Hub) ClientCount() int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return len(h.Clients)
+}
+
+// IsConnected reports whether a user has at least one connection, to this instance or to another sharing its Broadcaster
+func (h *Hub) IsConnected(username string) bool {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return h.isOnline(username)
+}
+
+// isOnline is IsConnected for callers that already hold the mutex
+func (h *Hub) isOnline(username string) bool {
+	return h.ConnectedUsers[username] || len(h.userInstances[username]) > 0
+}
+
+// MessageCounts returns a copy of how many broadcast messages of each type the hub has relayed
+func (h *Hub) MessageCounts() map[string]int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	counts := make(map[string]int, len(h.messageCounts))
+	for messageType, count := range h.messageCounts {
+		counts[messageType] = count
+	}
+	return counts
+}
+
+// UsernamesSnapshot returns a sorted copy of the connected usernames
+func (h *Hub) UsernamesSnapshot() []string {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	usernames := make([]string, 0, len(h.ConnectedUsers))
+	for username := range h.ConnectedUsers {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// PresenceSnapshot returns a copy of the away messages of users who are away
+func (h *Hub) PresenceSnapshot() map[string]string {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	presence := make(map[string]string, len(h.presence))
+	for username, status := range h.presence {
+		presence[username] = status
+	}
+	return presence
+}
+
+// ReserveSlot reserves room for a new client, returning false when the hub is full
+func (h *Hub) ReserveSlot() bool {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if h.MaxClients > 0 && len(h.Clients)+h.reserved >= h.MaxClients {
+		return false
+	}
+	h.reserved++
+	return true
+}
+
+// ReleaseSlot releases a reservation that won't be registered
+func (h *Hub) ReleaseSlot() {
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	if h.reserved > 0 {
+		h.reserved--
 	}
 }
 
 // Run starts the hub's main loop
 func (h *Hub) Run() {
+	h.subscribe()
+
 	for {
 		select {
 		case client := <-h.Register:
 			h.Mutex.Lock()
 			h.Clients[client] = true
+			if h.reserved > 0 {
+				h.reserved--
+			}
+			client.Logf("Registered %s", client.Username)
 
 			// Check if this user is already connected (page refresh)
 			isNewUser := !h.ConnectedUsers[client.Username]
 			if isNewUser {
 				h.ConnectedUsers[client.Username] = true
 			}
+
+			// Bring the new connection up to date with who is away
+			for username, status := range h.presence {
+				presenceMsg := types.Message{
+					Type:      types.MessageTypePresence,
+					Content:   status,
+					Sender:    username,
+					Timestamp: time.Now().Unix(),
+				}
+				presenceBytes, _ := json.Marshal(presenceMsg)
+				select {
+				case client.Send <- presenceBytes:
+				default:
+				}
+			}
 			h.Mutex.Unlock()
 
 			// Only send welcome message for new users (not page refreshes)
 			if isNewUser {
-				welcomeMsg := types.Message{
-					Type:      types.MessageTypeSystem,
-					Content:   fmt.Sprintf("User %s joined the chat", client.Username),
-					Sender:    types.SystemSender,
-					Timestamp: time.Now().Unix(),
-				}
-				welcomeBytes, _ := json.Marshal(welcomeMsg)
-				h.Broadcast <- welcomeBytes
+				h.announce(h.joinNotice(client.Username))
 			}
 
 		case client := <-h.Unregister:
+			var notices [][]byte
 			h.Mutex.Lock()
 			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				close(client.Send)
-
-				// Check if this was the last connection for this user
-				userStillConnected := false
-				for c := range h.Clients {
-					if c.Username == client.Username {
-						userStillConnected = true
-						break
-					}
-				}
-
-				// Only send leave message if user is completely disconnected
-				if !userStillConnected {
-					delete(h.ConnectedUsers, client.Username)
-
-					leaveMsg := types.Message{
-						Type:      types.MessageTypeSystem,
-						Content:   fmt.Sprintf("User %s left the chat", client.Username),
-						Sender:    types.SystemSender,
-						Timestamp: time.Now().Unix(),
-					}
-					leaveBytes, _ := json.Marshal(leaveMsg)
-					h.Broadcast <- leaveBytes
-				}
+				client.Logf("Unregistered %s", client.Username)
+				notices = h.removeClient(client)
 			}
 			h.Mutex.Unlock()
+			h.announce(notices...)
 
 		case message := <-h.Broadcast:
-			// Parse the message to get sender information
-			var msg types.Message
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Printf("Error parsing broadcast message: %v", err)
-				continue
-			}
+			h.deliver(message)
+		}
+	}
+}
 
-			h.Mutex.Lock()
-			clientsToRemove := []*Client{}
-			for client := range h.Clients {
-				// Don't send encrypted messages back to the sender
-				if msg.Type == types.MessageTypeEncrypted && client.Username == msg.Sender {
-					continue
-				}
+// announce relays notices generated by the hub itself. Without a Broadcaster they are delivered
+// here directly: h.Broadcast is only drained by Run, so sending to it from Run could block forever.
+func (h *Hub) announce(notices ...[]byte) {
+	for len(notices) > 0 {
+		message := notices[0]
+		notices = notices[1:]
+		if h.Broadcaster != nil {
+			h.Relay(message)
+			continue
+		}
+		notices = append(notices, h.dispatch(message)...)
+	}
+}
 
-				select {
-				case client.Send <- message:
-					// Message sent successfully
-				default:
-					close(client.Send)
-					clientsToRemove = append(clientsToRemove, client)
-				}
-			}
-			// Remove failed clients
-			for _, client := range clientsToRemove {
-				delete(h.Clients, client)
-			}
-			h.Mutex.Unlock()
+// deliver sends a message to this hub's clients and announces the departure of any that had to be dropped
+func (h *Hub) deliver(message []byte) {
+	h.announce(h.dispatch(message)...)
+}
+
+// dispatch queues a message for the clients it is meant for. Clients whose queue is full are
+// dropped, and the leave notices for them are returned for the caller to announce.
+func (h *Hub) dispatch(message []byte) [][]byte {
+	// Parse the message to get sender information
+	var msg types.Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		log.Printf("Error parsing broadcast message: %v", err)
+		return nil
+	}
+
+	// Hub-to-hub messages are handled here and never reach clients
+	if isInstanceMessage(msg.Type) {
+		return h.dispatchInstance(msg)
+	}
+
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+
+	// Clients may send any type, so only known types get their own counter
+	if slices.Contains(types.MessageTypes, msg.Type) {
+		h.messageCounts[msg.Type]++
+	} else {
+		h.messageCounts["other"]++
+	}
+
+	if msg.Type == types.MessageTypePresence {
+		if msg.Content == "" {
+			delete(h.presence, msg.Sender)
+		} else if h.isOnline(msg.Sender) {
+			h.presence[msg.Sender] = msg.Content
+		}
+	}
+
+	clientsToRemove := []*Client{}
+	queued := false
+	for client := range h.Clients {
+		// Don't send encrypted messages back to the sender
+		if msg.Type == types.MessageTypeEncrypted && client.Username == msg.Sender {
+			continue
+		}
+
+		// Directed messages go to every connection of the recipient and no one else
+		if isDirected(msg) && client.Username != msg.Recipient {
+			continue
+		}
+
+		// Room messages only go to the room's members
+		if msg.Room != "" && !h.rooms[msg.Room][client] {
+			continue
+		}
+
+		select {
+		case client.Send <- message:
+			// Message sent successfully
+			queued = true
+		default:
+			clientsToRemove = append(clientsToRemove, client)
+		}
+	}
+
+	// Remove failed clients, as if they had disconnected
+	var notices [][]byte
+	for _, client := range clientsToRemove {
+		client.Logf("Dropped %s: send queue full", client.Username)
+		notices = append(notices, h.removeClient(client)...)
+	}
+
+	// Tell the sender a directed message reached its recipient's queue
+	if queued && isDirected(msg) && msg.ID != "" {
+		if ack := h.ackSender(msg); ack != nil {
+			notices = append(notices, ack)
+		}
+	}
+	return notices
+}
+
+// removeClient unregisters a connection, returning the room and chat leave notices to announce (caller holds the lock)
+func (h *Hub) removeClient(client *Client) [][]byte {
+	delete(h.Clients, client)
+	close(client.Send)
+
+	// Tell the rooms this connection was in
+	var notices [][]byte
+	for _, room := range h.leaveAllRooms(client) {
+		notices = append(notices, roomMessage(types.MessageTypeLeaveRoom, client.Username, room))
+	}
+
+	// Only send leave message if user is completely disconnected
+	for c := range h.Clients {
+		if c.Username == client.Username {
+			return notices
+		}
+	}
+	delete(h.ConnectedUsers, client.Username)
+	if h.Broadcaster == nil {
+		delete(h.presence, client.Username) // With a Broadcaster, cleared once the user has left every instance
+	}
+	return append(notices, h.leaveNotice(client))
+}
+
+// Shutdown closes every client connection with a going-away close frame and waits up to timeout
+// for the hub to unregister them, so leave notices are relayed before the process exits
+func (h *Hub) Shutdown(timeout time.Duration) {
+	h.Mutex.RLock()
+	conns := make([]*websocket.Conn, 0, len(h.Clients))
+	for client := range h.Clients {
+		if client.Conn != nil {
+			conns = append(conns, client.Conn)
+		}
+	}
+	h.Mutex.RUnlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(timeout)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, closeMessage, deadline)
+		conn.Close()
+	}
+
+	for h.ClientCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if remaining := h.ClientCount(); remaining > 0 {
+		log.Printf("Hub shutdown timed out with %d clients still registered", remaining)
+	}
+}
+
+// joinNotice builds the announcement for a user's first connection to this hub. With a Broadcaster
+// it is a membership update, which only becomes a join message if no other instance has the user.
+func (h *Hub) joinNotice(username string) []byte {
+	notice := fmt.Sprintf("User %s joined the chat", username)
+	if h.Broadcaster != nil {
+		return h.membershipMessage(messageTypeInstanceJoin, username, notice)
+	}
+	return systemNotice(notice)
+}
+
+// leaveNotice builds the announcement for a user's last connection to this hub leaving. With a
+// Broadcaster it is a membership update, which only becomes a leave message if no other instance has the user.
+func (h *Hub) leaveNotice(client *Client) []byte {
+	if h.Broadcaster != nil {
+		return h.membershipMessage(messageTypeInstanceLeave, client.Username, leaveMessage(client))
+	}
+	return systemNotice(leaveMessage(client))
+}
+
+// systemNotice builds a system message for every client
+func systemNotice(content string) []byte {
+	notice := types.Message{
+		Type:      types.MessageTypeSystem,
+		Content:   content,
+		Sender:    types.SystemSender,
+		Timestamp: time.Now().Unix(),
+	}
+	noticeBytes, _ := json.Marshal(notice)
+	return noticeBytes
+}
+
+// leaveMessage builds the system notification for a client leaving the chat
+func leaveMessage(client *Client) string {
+	if client.LeaveReason == "" {
+		return fmt.Sprintf("User %s left the chat", client.Username)
+	}
+	return fmt.Sprintf("User %s left the chat: %s", client.Username, client.LeaveReason)
+}
+
+// ackSender sends a server_ack for msg to the sender's connections, returning the ack to relay when
+// the sender is only connected to another instance; the caller must hold the mutex
+func (h *Hub) ackSender(msg types.Message) []byte {
+	if h.sendToUsername(msg.Sender, serverAck(msg.ID, msg.Recipient)) > 0 || h.Broadcaster == nil {
+		return nil
+	}
+	return relayedAck(msg)
+}
+
+// serverAck builds the server_ack telling a sender their message ID was queued for recipient
+func serverAck(id, recipient string) []byte {
+	ack := types.Message{
+		Type:      types.MessageTypeServerAck,
+		ID:        id,
+		Sender:    types.SystemSender,
+		Recipient: recipient,
+		Timestamp: time.Now().Unix(),
+	}
+	ackBytes, _ := json.Marshal(ack)
+	return ackBytes
+}
+
+// SendToUsername queues a payload on every connection of a user and returns how many it reached.
+// Connections whose queue is full are skipped, not disconnected.
+func (h *Hub) SendToUsername(username string, payload []byte) int {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+	return h.sendToUsername(username, payload)
+}
+
+// SendToClient queues a payload on one connection, returning false if the hub already dropped it
+// or its queue is full. Goroutines other than Run must send this way: the hub closes a dropped
+// client's queue under the mutex, while its ReadPump may still be running.
+func (h *Hub) SendToClient(client *Client, payload []byte) bool {
+	h.Mutex.RLock()
+	defer h.Mutex.RUnlock()
+
+	if !h.Clients[client] {
+		return false
+	}
+	select {
+	case client.Send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendToUsername is SendToUsername for callers that already hold the mutex
+func (h *Hub) sendToUsername(username string, payload []byte) int {
+	sent := 0
+	for client := range h.Clients {
+		if client.Username != username {
+			continue
 		}
+		select {
+		case client.Send <- payload:
+			sent++
+		default:
+		}
+	}
+	return sent
+}
+
+// isDirected reports whether a message should only be delivered to its recipient
+func isDirected(msg types.Message) bool {
+	if msg.Recipient == "" {
+		return false
 	}
+	return msg.Type == types.MessageTypeEncrypted || msg.Type == types.MessageTypeRequestKeys || msg.Type == types.MessageTypeEcho
 }
 
 // ReadPump handles reading messages from the WebSocket connection
@@ -186,84 +517,183 @@ func (c *Client) ReadPump(hub *Hub) {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseNoStatusReceived) {
-				log.Printf("error: %v", err)
+				c.Logf("error: %v", err)
 			}
 			break
 		}
 
-		// Message received (server cannot read encrypted content)
-
-		// Parse the message (server can see metadata but not content)
-		var msg types.Message
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Error parsing message: %v", err)
-			continue
+		if !c.handleMessage(hub, message) {
+			return
 		}
+	}
+}
+
+// handleMessage processes one message read from the connection, returning false when the client should disconnect
+func (c *Client) handleMessage(hub *Hub, message []byte) bool {
+	// Message received (server cannot read encrypted content)
 
-		// Set the sender if not already set
-		if msg.Sender == "" {
-			msg.Sender = c.Username
+	// Parse the message (server can see metadata but not content)
+	var msg types.Message
+	if err := json.Unmarshal(message, &msg); err != nil {
+		c.Logf("Error parsing message: %v", err)
+		return true
+	}
+
+	// Let the moderation hook act on metadata only; guests get their own, stricter one
+	moderator := hub.Moderator
+	if c.IsGuest && hub.GuestModerator != nil {
+		moderator = hub.GuestModerator
+	}
+	if moderator != nil {
+		action := moderator.Moderate(MessageMetadata{
+			Sender:   c.Username,
+			Type:     msg.Type,
+			Size:     len(message),
+			Received: time.Now(),
+		})
+		switch action {
+		case ModerationWarn:
+			c.Logf("Moderation: flagged %s message from %s (%d bytes)", msg.Type, c.Username, len(message))
+		case ModerationDrop:
+			return true
+		case ModerationDisconnect:
+			c.Logf("Moderation: disconnecting %s", c.Username)
+			return false
 		}
+	}
+
+	// Track whether the server changed anything, so unchanged messages can be relayed as received
+	mutated := false
+
+	// Messages always come from the connection's own user, so a client can't speak or collect acks for someone else
+	if msg.Sender != c.Username {
+		msg.Sender = c.Username
+		mutated = true
+	}
+
+	// Set timestamp if not already set
+	if msg.Timestamp == 0 {
+		msg.Timestamp = time.Now().Unix()
+		mutated = true
+	}
 
-		// Set timestamp if not already set
-		if msg.Timestamp == 0 {
-			msg.Timestamp = time.Now().Unix()
+	// Only members can send into a room
+	if msg.Room != "" && msg.Type != types.MessageTypeJoinRoom && !hub.InRoom(c, msg.Room) {
+		c.sendSystem(hub, fmt.Sprintf("You are not in room %s", msg.Room), msg.Room)
+		return true
+	}
+
+	// Handle different message types
+	switch msg.Type {
+	case types.MessageTypeKeyExchange:
+		// Handle key exchange - broadcast public key to all clients
+		hub.Relay(encodeMessage(msg, message, mutated))
+
+	case types.MessageTypeEncrypted, types.MessageTypeEcho:
+		// Handle encrypted message - server cannot decrypt
+		if msg.Type == types.MessageTypeEncrypted && msg.Recipient == "" && hub.RequireRecipient {
+			c.sendDeliveryFailed(hub, msg)
+			return true
+		}
+		// The recipient may be connected to another instance, which IsConnected also knows about
+		if msg.Recipient != "" && !hub.IsConnected(msg.Recipient) {
+			c.sendDeliveryFailed(hub, msg)
+			return true
 		}
+		hub.Relay(encodeMessage(msg, message, mutated))
 
-		// Handle different message types
-		switch msg.Type {
-		case types.MessageTypeKeyExchange:
-			// Handle key exchange - broadcast public key to all clients
-			messageBytes, _ := json.Marshal(msg)
-			hub.Broadcast <- messageBytes
+	case types.MessageTypePublicKeyShare:
+		// Handle public key sharing
+		hub.Relay(encodeMessage(msg, message, mutated))
 
-		case types.MessageTypeEncrypted:
-			// Handle encrypted message - server cannot decrypt
-			messageBytes, _ := json.Marshal(msg)
-			hub.Broadcast <- messageBytes
+	case types.MessageTypeRequestKeys:
+		// Handle key request - broadcast to all clients
+		hub.Relay(encodeMessage(msg, message, mutated))
 
-		case types.MessageTypePublicKeyShare:
-			// Handle public key sharing
-			messageBytes, _ := json.Marshal(msg)
-			hub.Broadcast <- messageBytes
+	case types.MessageTypeJoinRoom:
+		c.joinRoom(hub, msg.Room)
 
-		case types.MessageTypeRequestKeys:
-			// Handle key request - broadcast to all clients
-			messageBytes, _ := json.Marshal(msg)
-			hub.Broadcast <- messageBytes
+	case types.MessageTypeLeaveRoom:
+		c.leaveRoom(hub, msg.Room)
 
-		default:
-			// Handle regular message
-			messageBytes, _ := json.Marshal(msg)
-			hub.Broadcast <- messageBytes
+	case messageTypeInstanceJoin, messageTypeInstanceLeave, messageTypeInstanceSync, messageTypeInstanceAck:
+		// Only hubs exchange these among themselves
+		c.Logf("Dropped %s message from %s", msg.Type, c.Username)
+
+	case types.MessageTypeLeave:
+		// Client is quitting - keep the reason for the leave notification and disconnect
+		reason := strings.TrimSpace(msg.Content)
+		if runes := []rune(reason); len(runes) > types.MaxLeaveReasonLength {
+			reason = string(runes[:types.MaxLeaveReasonLength])
 		}
+		c.LeaveReason = reason
+		return false
+
+	default:
+		// Handle regular message
+		hub.Relay(encodeMessage(msg, message, mutated))
+	}
+	return true
+}
+
+// sendDeliveryFailed tells the sending connection that a directed message had no one to go to,
+// either because the recipient is offline or because it named none
+func (c *Client) sendDeliveryFailed(hub *Hub, msg types.Message) {
+	failed := types.Message{
+		Type:      types.MessageTypeDeliveryFailed,
+		Sender:    types.SystemSender,
+		Recipient: msg.Recipient,
+		Room:      msg.Room,
+		Timestamp: time.Now().Unix(),
+	}
+	failedBytes, _ := json.Marshal(failed)
+	hub.SendToClient(c, failedBytes)
+}
+
+// encodeMessage returns the bytes to relay for msg, reusing the original bytes unless the server mutated it
+func encodeMessage(msg types.Message, original []byte, mutated bool) []byte {
+	if !mutated {
+		return original
 	}
+	messageBytes, _ := json.Marshal(msg)
+	return messageBytes
 }
 
-// WritePump handles writing messages to the WebSocket connection
+// WritePump handles writing messages to the WebSocket connection. A write stalled past writeWait
+// closes the connection, which makes ReadPump unregister the client.
 func (c *Client) WritePump() {
 	defer func() {
 		c.Conn.Close()
 	}()
 
 	for message := range c.Send {
+		c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 		w, err := c.Conn.NextWriter(websocket.TextMessage)
 		if err != nil {
+			c.Logf("write failed: %v", err)
+			return
+		}
+		if _, err := w.Write(message); err != nil {
+			c.Logf("write failed: %v", err)
 			return
 		}
-		w.Write(message)
 
 		if err := w.Close(); err != nil {
+			c.Logf("write failed: %v", err)
 			return
 		}
 	}
 }
 
+// writeWait is how long a single message write may block on a slow connection
+var writeWait = 10 * time.Second
+
 // Global variables (will be moved to appropriate modules)
 var (
 	Sessions     = make(map[string]*Session)
 	SessionMutex sync.RWMutex
 	Users        = make(map[string]*User)
+	NextUserID   = 1 // Next ID for users created in memory (guarded by UsersMutex)
 	UsersMutex   sync.RWMutex
 	Upgrader     = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
@@ -0,0 +1,861 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chapp/pkg/types"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/websocket"
+)
+
+// newTestClient creates a client without a WebSocket connection
+func newTestClient(username string) *Client {
+	return &Client{
+		BaseClient: types.BaseClient{Username: username},
+		Send:       make(chan []byte, 256),
+	}
+}
+
+// waitForClientCount waits until the hub reports the expected client count
+func waitForClientCount(t testing.TB, hub *Hub, expected int) {
+	deadline := time.Now().Add(time.Second)
+	for hub.ClientCount() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d clients, got %d", expected, hub.ClientCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestHubClientCount tests ClientCount and UsernamesSnapshot
+func TestHubClientCount(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	if count := hub.ClientCount(); count != 0 {
+		t.Errorf("Expected 0 clients, got %d", count)
+	}
+
+	bob := newTestClient("bob")
+	hub.Register <- bob
+	hub.Register <- newTestClient("alice")
+	hub.Register <- newTestClient("alice")
+	waitForClientCount(t, hub, 3)
+
+	usernames := hub.UsernamesSnapshot()
+	if len(usernames) != 2 || usernames[0] != "alice" || usernames[1] != "bob" {
+		t.Errorf("Expected [alice bob], got %v", usernames)
+	}
+
+	hub.Unregister <- bob
+	waitForClientCount(t, hub, 2)
+
+	usernames = hub.UsernamesSnapshot()
+	if len(usernames) != 1 || usernames[0] != "alice" {
+		t.Errorf("Expected [alice], got %v", usernames)
+	}
+}
+
+// TestHubClientCountConcurrent calls ClientCount while clients register and unregister (run with -race)
+func TestHubClientCountConcurrent(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	clients := make([]*Client, 10)
+	for i := range clients {
+		clients[i] = newTestClient(fmt.Sprintf("user%d", i))
+	}
+
+	// Query the hub from another goroutine for the whole test
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hub.ClientCount()
+				hub.UsernamesSnapshot()
+			}
+		}
+	}()
+
+	for _, client := range clients {
+		go func(c *Client) { hub.Register <- c }(client)
+	}
+	waitForClientCount(t, hub, len(clients))
+
+	for _, client := range clients {
+		go func(c *Client) { hub.Unregister <- c }(client)
+	}
+	waitForClientCount(t, hub, 0)
+
+	close(stop)
+	wg.Wait()
+}
+
+// drainMessages returns all messages queued for a client after a short wait
+func drainMessages(t *testing.T, client *Client) []types.Message {
+	time.Sleep(50 * time.Millisecond)
+
+	var messages []types.Message
+	for {
+		select {
+		case data := <-client.Send:
+			var msg types.Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatalf("Failed to decode message: %v", err)
+			}
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+// countType counts the messages of a given type
+func countType(messages []types.Message, messageType string) int {
+	count := 0
+	for _, msg := range messages {
+		if msg.Type == messageType {
+			count++
+		}
+	}
+	return count
+}
+
+// TestTargetedKeyRequest tests that a request_keys with a Recipient reaches only that peer
+func TestTargetedKeyRequest(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	carol := newTestClient("carol")
+	hub.Register <- alice
+	hub.Register <- bob
+	hub.Register <- carol
+	waitForClientCount(t, hub, 3)
+	drainMessages(t, bob)
+	drainMessages(t, carol)
+
+	request, _ := json.Marshal(types.Message{
+		Type:      types.MessageTypeRequestKeys,
+		Sender:    "alice",
+		Recipient: "bob",
+	})
+	hub.Broadcast <- request
+
+	if count := countType(drainMessages(t, bob), types.MessageTypeRequestKeys); count != 1 {
+		t.Errorf("Expected bob to receive 1 key request, got %d", count)
+	}
+
+	if count := countType(drainMessages(t, carol), types.MessageTypeRequestKeys); count != 0 {
+		t.Errorf("Expected carol to receive no key request, got %d", count)
+	}
+
+	// Untargeted requests still reach everyone
+	request, _ = json.Marshal(types.Message{
+		Type:   types.MessageTypeRequestKeys,
+		Sender: "alice",
+	})
+	hub.Broadcast <- request
+
+	if count := countType(drainMessages(t, carol), types.MessageTypeRequestKeys); count != 1 {
+		t.Errorf("Expected carol to receive 1 broadcast key request, got %d", count)
+	}
+}
+
+// TestMessageTypeInterop tests that every shared message type, and unknown ones, are relayed unchanged
+func TestMessageTypeInterop(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	listener := newTestClient("listener")
+	hub.Register <- listener
+	sender := dialTestClient(t, hub, "sender")
+	waitForClientCount(t, hub, 2)
+	drainMessages(t, listener)
+
+	messageTypes := append([]string{"future_type"}, types.MessageTypes...)
+	for _, messageType := range messageTypes {
+		switch messageType {
+		case types.MessageTypeLeave, types.MessageTypeJoinRoom, types.MessageTypeLeaveRoom:
+			continue // Consumed by the server, covered by TestLeaveReason and the room tests
+		}
+
+		sent := types.Message{
+			Type:      messageType,
+			Content:   "payload-" + messageType,
+			Sender:    "sender",
+			Recipient: "listener",
+			Timestamp: 1700000000,
+		}
+		if err := sender.WriteJSON(sent); err != nil {
+			t.Fatalf("Failed to send %s: %v", messageType, err)
+		}
+
+		received := drainMessages(t, listener)
+		if len(received) != 1 {
+			t.Errorf("Expected 1 relayed %s message, got %d", messageType, len(received))
+			continue
+		}
+
+		if received[0] != sent {
+			t.Errorf("Message type %s was changed in transit:\n got %+v\nwant %+v", messageType, received[0], sent)
+		}
+	}
+}
+
+// TestDuplicateConnectionsDelivery tests that encrypted messages reach every connection of the recipient
+func TestDuplicateConnectionsDelivery(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	bobLaptop := newTestClient("bob")
+	bobPhone := newTestClient("bob")
+	carol := newTestClient("carol")
+	hub.Register <- bobLaptop
+	hub.Register <- bobPhone
+	hub.Register <- carol
+	waitForClientCount(t, hub, 3)
+	drainMessages(t, bobLaptop)
+	drainMessages(t, bobPhone)
+	drainMessages(t, carol)
+
+	message, _ := json.Marshal(types.Message{
+		Type:      types.MessageTypeEncrypted,
+		Content:   "ciphertext-for-bob",
+		Sender:    "alice",
+		Recipient: "bob",
+	})
+	hub.Broadcast <- message
+
+	for name, client := range map[string]*Client{"laptop": bobLaptop, "phone": bobPhone} {
+		if count := countType(drainMessages(t, client), types.MessageTypeEncrypted); count != 1 {
+			t.Errorf("Expected bob's %s to receive 1 encrypted message, got %d", name, count)
+		}
+	}
+
+	if count := countType(drainMessages(t, carol), types.MessageTypeEncrypted); count != 0 {
+		t.Errorf("Expected carol to receive no encrypted message, got %d", count)
+	}
+}
+
+// TestLeaveReason tests that a quit reason is included in the leave notification
+func TestLeaveReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		reason   string
+		expected string
+	}{
+		{"with reason", "  brb  ", "User quitter left the chat: brb"},
+		{"without reason", "", "User quitter left the chat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			go hub.Run()
+
+			listener := newTestClient("listener")
+			hub.Register <- listener
+			quitter := dialTestClient(t, hub, "quitter")
+			waitForClientCount(t, hub, 2)
+			drainMessages(t, listener)
+
+			leave := types.Message{Type: types.MessageTypeLeave, Content: tt.reason}
+			if err := quitter.WriteJSON(leave); err != nil {
+				t.Fatalf("Failed to send leave: %v", err)
+			}
+			waitForClientCount(t, hub, 1)
+
+			received := drainMessages(t, listener)
+			if len(received) != 1 {
+				t.Fatalf("Expected 1 leave notification, got %d", len(received))
+			}
+
+			if received[0].Type != types.MessageTypeSystem {
+				t.Errorf("Expected type '%s', got '%s'", types.MessageTypeSystem, received[0].Type)
+			}
+
+			if received[0].Content != tt.expected {
+				t.Errorf("Expected '%s', got '%s'", tt.expected, received[0].Content)
+			}
+		})
+	}
+}
+
+// TestPresence tests the presence round trip and the roster reflecting state changes
+func TestPresence(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	listener := newTestClient("listener")
+	hub.Register <- listener
+	alice := dialTestClient(t, hub, "alice")
+	waitForClientCount(t, hub, 2)
+	drainMessages(t, listener)
+
+	// Going away is relayed with the sender forced to the connection's user
+	away := types.Message{Type: types.MessageTypePresence, Content: "lunch", Sender: "mallory"}
+	if err := alice.WriteJSON(away); err != nil {
+		t.Fatalf("Failed to send presence: %v", err)
+	}
+
+	received := drainMessages(t, listener)
+	if countType(received, types.MessageTypePresence) != 1 {
+		t.Fatalf("Expected 1 presence message, got %d", countType(received, types.MessageTypePresence))
+	}
+	if received[0].Sender != "alice" || received[0].Content != "lunch" {
+		t.Errorf("Expected alice away with 'lunch', got %s '%s'", received[0].Sender, received[0].Content)
+	}
+
+	if status := hub.PresenceSnapshot()["alice"]; status != "lunch" {
+		t.Errorf("Expected roster to show alice away with 'lunch', got '%s'", status)
+	}
+
+	// New joiners learn the current presence
+	bob := newTestClient("bob")
+	hub.Register <- bob
+	waitForClientCount(t, hub, 3)
+
+	replayed := drainMessages(t, bob)
+	if countType(replayed, types.MessageTypePresence) != 1 {
+		t.Errorf("Expected new joiner to receive 1 presence message, got %d", countType(replayed, types.MessageTypePresence))
+	}
+
+	// Coming back clears the away message
+	back := types.Message{Type: types.MessageTypePresence}
+	if err := alice.WriteJSON(back); err != nil {
+		t.Fatalf("Failed to send presence: %v", err)
+	}
+	drainMessages(t, listener)
+
+	if _, away := hub.PresenceSnapshot()["alice"]; away {
+		t.Error("Expected alice to be back")
+	}
+}
+
+// TestPresenceClearedOnLeave tests that presence is not kept after a user disconnects
+func TestPresenceClearedOnLeave(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	hub.Register <- alice
+	waitForClientCount(t, hub, 1)
+
+	awayMsg, _ := json.Marshal(types.Message{Type: types.MessageTypePresence, Content: "afk", Sender: "alice"})
+	hub.Broadcast <- awayMsg
+	drainMessages(t, alice)
+
+	if len(hub.PresenceSnapshot()) != 1 {
+		t.Fatal("Expected alice to be away")
+	}
+
+	hub.Unregister <- alice
+	waitForClientCount(t, hub, 0)
+
+	if len(hub.PresenceSnapshot()) != 0 {
+		t.Error("Presence should be cleared when the user leaves")
+	}
+}
+
+// TestUntargetedEncryptedBroadcast tests that encrypted messages without a recipient reach everyone but the sender
+func TestUntargetedEncryptedBroadcast(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	carol := newTestClient("carol")
+	hub.Register <- alice
+	hub.Register <- bob
+	hub.Register <- carol
+	waitForClientCount(t, hub, 3)
+	drainMessages(t, alice)
+	drainMessages(t, bob)
+	drainMessages(t, carol)
+
+	message, _ := json.Marshal(types.Message{
+		Type:    types.MessageTypeEncrypted,
+		Content: "ciphertext",
+		Sender:  "alice",
+	})
+	hub.Broadcast <- message
+
+	for name, client := range map[string]*Client{"bob": bob, "carol": carol} {
+		if count := countType(drainMessages(t, client), types.MessageTypeEncrypted); count != 1 {
+			t.Errorf("Expected %s to receive 1 encrypted message, got %d", name, count)
+		}
+	}
+
+	if count := countType(drainMessages(t, alice), types.MessageTypeEncrypted); count != 0 {
+		t.Errorf("Expected the sender to receive no echo, got %d", count)
+	}
+}
+
+// TestHandleMessageEncoding tests that unchanged messages are relayed as received and mutated ones are re-encoded
+func TestHandleMessageEncoding(t *testing.T) {
+	hub := NewHub()
+	hub.ConnectedUsers["bob"] = true
+	alice := newTestClient("alice")
+
+	// Sender and timestamp already set: the original bytes are relayed
+	original := []byte(`{"type":"encrypted_message","content":"ciphertext","sender":"alice","timestamp":1700000000}`)
+	alice.handleMessage(hub, original)
+	if relayed := <-hub.Broadcast; !bytes.Equal(relayed, original) {
+		t.Errorf("Expected original bytes to be relayed, got %s", relayed)
+	}
+
+	// Missing sender and timestamp: the server fills them in
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","recipient":"bob"}`))
+	var msg types.Message
+	if err := json.Unmarshal(<-hub.Broadcast, &msg); err != nil {
+		t.Fatalf("Failed to decode relayed message: %v", err)
+	}
+	if msg.Sender != "alice" || msg.Timestamp == 0 {
+		t.Errorf("Expected sender and timestamp to be set, got sender '%s' timestamp %d", msg.Sender, msg.Timestamp)
+	}
+	if msg.Content != "ciphertext" || msg.Recipient != "bob" {
+		t.Errorf("Expected content and recipient to be preserved, got %+v", msg)
+	}
+
+	// A spoofed sender is rewritten on any message type
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","sender":"mallory","recipient":"bob","timestamp":1700000000}`))
+	if err := json.Unmarshal(<-hub.Broadcast, &msg); err != nil {
+		t.Fatalf("Failed to decode relayed message: %v", err)
+	}
+	if msg.Sender != "alice" {
+		t.Errorf("Expected message sender 'alice', got '%s'", msg.Sender)
+	}
+
+	// Presence with a spoofed sender is rewritten
+	alice.handleMessage(hub, []byte(`{"type":"presence","content":"away","sender":"mallory","timestamp":1700000000}`))
+	if err := json.Unmarshal(<-hub.Broadcast, &msg); err != nil {
+		t.Fatalf("Failed to decode relayed presence: %v", err)
+	}
+	if msg.Sender != "alice" {
+		t.Errorf("Expected presence sender 'alice', got '%s'", msg.Sender)
+	}
+}
+
+// TestKeyRotationSender tests that a key rotation can only be announced for the connection's own user
+func TestKeyRotationSender(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient("alice")
+
+	alice.handleMessage(hub, []byte(`{"type":"key_rotation","content":"new-key","sender":"bob","timestamp":1700000000}`))
+
+	var msg types.Message
+	if err := json.Unmarshal(<-hub.Broadcast, &msg); err != nil {
+		t.Fatalf("Failed to decode relayed rotation: %v", err)
+	}
+	if msg.Sender != "alice" {
+		t.Errorf("Expected rotation sender 'alice', got '%s'", msg.Sender)
+	}
+	if msg.Content != "new-key" {
+		t.Errorf("Expected the new key to be relayed, got '%s'", msg.Content)
+	}
+}
+
+// TestDeliveryFailedForOfflineRecipient tests that messaging an offline user notifies the sender instead of broadcasting
+func TestDeliveryFailedForOfflineRecipient(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient("alice")
+	hub.Clients[alice] = true
+	hub.JoinRoom(alice, "red")
+
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","sender":"alice","recipient":"bob","room":"red","timestamp":1700000000}`))
+
+	select {
+	case relayed := <-hub.Broadcast:
+		t.Errorf("Expected nothing to be broadcast, got %s", relayed)
+	default:
+	}
+
+	messages := drainMessages(t, alice)
+	if len(messages) != 1 || messages[0].Type != types.MessageTypeDeliveryFailed {
+		t.Fatalf("Expected one delivery_failed notice, got %+v", messages)
+	}
+	if messages[0].Recipient != "bob" || messages[0].Room != "red" {
+		t.Errorf("Expected the notice to name bob in red, got %+v", messages[0])
+	}
+	if messages[0].Content != "" {
+		t.Errorf("Expected no ciphertext in the notice, got '%s'", messages[0].Content)
+	}
+}
+
+// TestDeliveryFailedAfterDrop tests that a client the hub dropped for a full queue can keep sending
+// from its ReadPump without the server writing to its closed queue
+func TestDeliveryFailedAfterDrop(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient("alice")
+	hub.Clients[alice] = true
+	hub.ConnectedUsers["alice"] = true
+	for len(alice.Send) < cap(alice.Send) {
+		alice.Send <- []byte(`{}`)
+	}
+
+	hub.dispatch([]byte(`{"type":"public_key_share","content":"key","sender":"bob","timestamp":1700000000}`))
+	if hub.ClientCount() != 0 {
+		t.Fatalf("Expected alice to be dropped, got %d clients", hub.ClientCount())
+	}
+
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","recipient":"bob","timestamp":1700000000}`))
+}
+
+// TestRoomRepliesAfterDrop tests that room replies to a client the hub dropped for a full queue
+// aren't written to its closed queue
+func TestRoomRepliesAfterDrop(t *testing.T) {
+	hub := NewHub()
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	hub.Clients[alice] = true
+	hub.Clients[bob] = true
+	hub.ConnectedUsers["alice"] = true
+	hub.JoinRoom(bob, "red")
+	for len(alice.Send) < cap(alice.Send) {
+		alice.Send <- []byte(`{}`)
+	}
+
+	hub.dispatch([]byte(`{"type":"public_key_share","content":"key","sender":"bob","timestamp":1700000000}`))
+	if hub.ClientCount() != 1 {
+		t.Fatalf("Expected alice to be dropped, got %d clients", hub.ClientCount())
+	}
+
+	alice.handleMessage(hub, []byte(`{"type":"join_room","room":"bad room!"}`))
+	alice.handleMessage(hub, []byte(`{"type":"join_room","room":"red"}`))
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","room":"blue","timestamp":1700000000}`))
+}
+
+// TestRecipientlessEncryptedPolicy tests that encrypted messages without a recipient are relayed
+// to everyone in broadcast mode and refused in directed mode
+func TestRecipientlessEncryptedPolicy(t *testing.T) {
+	tests := []struct {
+		name             string
+		requireRecipient bool
+	}{
+		{"broadcast", false},
+		{"directed", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			hub.RequireRecipient = tt.requireRecipient
+			alice := newTestClient("alice")
+			hub.Clients[alice] = true
+
+			alice.handleMessage(hub, []byte(`{"type":"encrypted_message","content":"ciphertext","sender":"alice","timestamp":1700000000}`))
+
+			select {
+			case relayed := <-hub.Broadcast:
+				if tt.requireRecipient {
+					t.Errorf("Expected nothing to be broadcast, got %s", relayed)
+				}
+			default:
+				if !tt.requireRecipient {
+					t.Error("Expected the message to be broadcast")
+				}
+			}
+
+			messages := drainMessages(t, alice)
+			if !tt.requireRecipient {
+				if len(messages) != 0 {
+					t.Errorf("Expected no notice, got %+v", messages)
+				}
+				return
+			}
+			if len(messages) != 1 || messages[0].Type != types.MessageTypeDeliveryFailed {
+				t.Fatalf("Expected one delivery_failed notice, got %+v", messages)
+			}
+			if messages[0].Recipient != "" || messages[0].Content != "" {
+				t.Errorf("Expected a notice without recipient or ciphertext, got %+v", messages[0])
+			}
+		})
+	}
+}
+
+// TestSendToUsername tests that a payload reaches every connection of one user and no one else
+func TestSendToUsername(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	aliceLaptop := newTestClient("alice")
+	alicePhone := newTestClient("alice")
+	bob := newTestClient("bob")
+	stalled := &Client{BaseClient: types.BaseClient{Username: "alice"}, Send: make(chan []byte, 8)}
+	for _, client := range []*Client{aliceLaptop, alicePhone, bob, stalled} {
+		hub.Register <- client
+	}
+	waitForClientCount(t, hub, 4)
+	for _, client := range []*Client{aliceLaptop, alicePhone, bob} {
+		drainMessages(t, client)
+	}
+	for len(stalled.Send) < cap(stalled.Send) {
+		stalled.Send <- []byte(`{}`) // Leave stalled's queue full
+	}
+
+	payload := []byte(`{"type":"system","content":"for alice"}`)
+	if sent := hub.SendToUsername("alice", payload); sent != 2 {
+		t.Errorf("Expected 2 connections reached, got %d", sent)
+	}
+
+	for _, client := range []*Client{aliceLaptop, alicePhone} {
+		messages := drainMessages(t, client)
+		if len(messages) != 1 || messages[0].Content != "for alice" {
+			t.Errorf("Expected each of alice's connections to get the payload, got %+v", messages)
+		}
+	}
+	if messages := drainMessages(t, bob); len(messages) != 0 {
+		t.Errorf("Expected bob to get nothing, got %+v", messages)
+	}
+	if hub.ClientCount() != 4 {
+		t.Errorf("Expected the stalled connection to be kept, got %d clients", hub.ClientCount())
+	}
+
+	if sent := hub.SendToUsername("nobody", payload); sent != 0 {
+		t.Errorf("Expected no connections reached for an unknown user, got %d", sent)
+	}
+}
+
+// TestServerAck tests that a queued directed message is acked to its sender and a dropped one isn't
+func TestServerAck(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	stalled := &Client{BaseClient: types.BaseClient{Username: "stalled"}, Send: make(chan []byte, 8)}
+	hub.Register <- alice
+	hub.Register <- bob
+	hub.Register <- stalled
+	waitForClientCount(t, hub, 3)
+	drainMessages(t, alice)
+	drainMessages(t, stalled)
+	for len(stalled.Send) < cap(stalled.Send) {
+		stalled.Send <- []byte(`{}`) // Leave stalled's queue full
+	}
+
+	hub.Broadcast <- []byte(`{"type":"encrypted_message","id":"m1","content":"ciphertext","sender":"alice","recipient":"bob","timestamp":1700000000}`)
+	messages := drainMessages(t, alice)
+	if len(messages) != 1 || messages[0].Type != types.MessageTypeServerAck {
+		t.Fatalf("Expected one server_ack, got %+v", messages)
+	}
+	if messages[0].ID != "m1" || messages[0].Recipient != "bob" {
+		t.Errorf("Expected the ack to name m1 for bob, got %+v", messages[0])
+	}
+
+	// stalled's queue has no room, so the message is dropped and not acked
+	hub.Broadcast <- []byte(`{"type":"encrypted_message","id":"m2","content":"ciphertext","sender":"alice","recipient":"stalled","timestamp":1700000000}`)
+	if count := countType(drainMessages(t, alice), types.MessageTypeServerAck); count != 0 {
+		t.Errorf("Expected no ack for a dropped message, got %d", count)
+	}
+}
+
+// TestServerAckSpoofedSender tests that a directed message claiming another sender is acked to the real one
+func TestServerAckSpoofedSender(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := newTestClient("alice")
+	bob := newTestClient("bob")
+	carol := newTestClient("carol")
+	hub.Register <- alice
+	hub.Register <- bob
+	hub.Register <- carol
+	waitForClientCount(t, hub, 3)
+	drainMessages(t, alice)
+	drainMessages(t, carol)
+
+	alice.handleMessage(hub, []byte(`{"type":"encrypted_message","id":"m1","content":"ciphertext","sender":"carol","recipient":"bob","timestamp":1700000000}`))
+	if count := countType(drainMessages(t, alice), types.MessageTypeServerAck); count != 1 {
+		t.Errorf("Expected alice to get the ack, got %d", count)
+	}
+	if count := countType(drainMessages(t, carol), types.MessageTypeServerAck); count != 0 {
+		t.Errorf("Expected carol to get no ack, got %d", count)
+	}
+}
+
+// TestMessageCounts tests that broadcast messages are counted by type
+func TestMessageCounts(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	for _, messageType := range []string{types.MessageTypePublicKeyShare, types.MessageTypePublicKeyShare, types.MessageTypePresence, "made_up"} {
+		data, _ := json.Marshal(types.Message{Type: messageType, Sender: "alice"})
+		hub.Broadcast <- data
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for hub.MessageCounts()["other"] == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	counts := hub.MessageCounts()
+	expected := map[string]int{
+		types.MessageTypePublicKeyShare: 2,
+		types.MessageTypePresence:       1,
+		"other":                         1,
+	}
+	for messageType, count := range expected {
+		if counts[messageType] != count {
+			t.Errorf("Expected %d %s messages, got %d", count, messageType, counts[messageType])
+		}
+	}
+	if _, ok := counts["made_up"]; ok {
+		t.Error("Unknown types should not get their own counter")
+	}
+}
+
+// TestEchoRoundTrip tests that an echo and its reply only travel between the two peers
+func TestEchoRoundTrip(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	alice := dialRoomTestClient(t, hub, "alice")
+	bob := dialRoomTestClient(t, hub, "bob")
+	carol := dialRoomTestClient(t, hub, "carol")
+	waitForClientCount(t, hub, 3)
+	for _, client := range []*roomTestClient{alice, bob, carol} {
+		readRoomMessages(t, client)
+	}
+
+	// echoes returns the contents of the echo messages among received
+	echoes := func(received []types.Message) []string {
+		var contents []string
+		for _, msg := range received {
+			if msg.Type == types.MessageTypeEcho {
+				contents = append(contents, msg.Content)
+			}
+		}
+		return contents
+	}
+
+	if err := alice.WriteJSON(types.Message{Type: types.MessageTypeEcho, Content: "nonce-for-bob", Sender: "alice", Recipient: "bob"}); err != nil {
+		t.Fatalf("Failed to send echo: %v", err)
+	}
+	if got := echoes(readRoomMessages(t, bob)); len(got) != 1 || got[0] != "nonce-for-bob" {
+		t.Fatalf("Expected bob to receive the echo, got %v", got)
+	}
+
+	if err := bob.WriteJSON(types.Message{Type: types.MessageTypeEcho, Content: "nonce-for-alice", Sender: "bob", Recipient: "alice"}); err != nil {
+		t.Fatalf("Failed to send echo reply: %v", err)
+	}
+	if got := echoes(readRoomMessages(t, alice)); len(got) != 1 || got[0] != "nonce-for-alice" {
+		t.Fatalf("Expected alice to receive the reply, got %v", got)
+	}
+
+	if got := echoes(readRoomMessages(t, carol)); len(got) != 0 {
+		t.Errorf("Expected carol to see no echoes, got %v", got)
+	}
+}
+
+// TestWritePumpTimeout tests that a client that stops reading is disconnected once a write stalls
+func TestWritePumpTimeout(t *testing.T) {
+	defer func(wait time.Duration) { writeWait = wait }(writeWait)
+	writeWait = 50 * time.Millisecond
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	hub := NewHub()
+	go hub.Run()
+
+	// The test side never reads, so the server's socket buffers fill and its writes block
+	dialTestClient(t, hub, "stalled")
+	waitForClientCount(t, hub, 1)
+
+	// Far more than the socket buffers hold, but too few messages to fill Send and trigger eviction
+	content := strings.Repeat("x", 512*1024)
+	for i := 0; i < 64; i++ {
+		data, _ := json.Marshal(types.Message{Type: types.MessageTypeSystem, Content: content, Sender: "System"})
+		hub.Broadcast <- data
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.ClientCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Stalled client should have been disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.IsConnected("stalled") {
+		t.Error("Stalled client should no longer be connected")
+	}
+}
+
+// TestHubShutdown tests that shutdown tells every client the server is going away and waits for them to unregister
+func TestHubShutdown(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	conns := []*websocket.Conn{dialTestClient(t, hub, "alice"), dialTestClient(t, hub, "bob")}
+	waitForClientCount(t, hub, 2)
+
+	hub.Shutdown(time.Second)
+
+	if count := hub.ClientCount(); count != 0 {
+		t.Errorf("Expected no clients after shutdown, got %d", count)
+	}
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var err error
+		for err == nil {
+			_, _, err = conn.ReadMessage()
+		}
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("Expected a going away close, got %v", err)
+		}
+	}
+}
+
+// TestWebAuthnUser tests that a WebAuthnUser exposes its account and stored credentials to the library
+func TestWebAuthnUser(t *testing.T) {
+	credential := webauthn.Credential{ID: []byte("credential-1"), PublicKey: []byte("key")}
+	user := &WebAuthnUser{
+		User:        &User{ID: 1, Username: "alice"},
+		Credentials: []webauthn.Credential{credential},
+	}
+
+	if string(user.WebAuthnID()) != "alice" {
+		t.Errorf("Expected ID 'alice', got '%s'", user.WebAuthnID())
+	}
+	if user.WebAuthnName() != "alice" || user.WebAuthnDisplayName() != "alice" {
+		t.Errorf("Expected name 'alice', got '%s'/'%s'", user.WebAuthnName(), user.WebAuthnDisplayName())
+	}
+	if creds := user.WebAuthnCredentials(); len(creds) != 1 || string(creds[0].ID) != "credential-1" {
+		t.Errorf("Expected the stored credential, got %+v", creds)
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "Chapp",
+		RPOrigins:     []string{"http://localhost:8080"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create WebAuthn: %v", err)
+	}
+
+	options, _, err := w.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration rejected the user: %v", err)
+	}
+	if options.Response.User.Name != "alice" {
+		t.Errorf("Expected registration options for alice, got '%s'", options.Response.User.Name)
+	}
+}
@@ -1,22 +1,39 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"chapp/cmd/server/auth"
+	"chapp/cmd/server/config"
 	"chapp/cmd/server/handlers"
+	"chapp/cmd/server/shutdown"
 	"chapp/cmd/server/types"
 	"chapp/pkg/database"
+	"chapp/pkg/pubsub"
 )
 
 func main() {
+	// Load configuration
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal("Failed to load configuration: ", err)
+	}
+	config.SetConfig(cfg)
+
 	// Initialize database
-	db, err := database.NewSQLite("chapp.db")
+	db, err := database.NewSQLite(cfg.DBPath)
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
-	defer db.Close()
+
+	if cfg.DBBatchInterval > 0 {
+		db.EnableWriteBatching(cfg.DBBatchInterval)
+	}
 
 	// Set global database instance
 	database.SetDatabase(db)
@@ -24,11 +41,23 @@ func main() {
 	// Initialize WebAuthn (needed for session validation)
 	auth.InitializeWebAuthn()
 
+	// Load admin usernames
+	auth.SetAdmins(cfg.Admins)
+
 	// Start session cleanup goroutine
 	auth.StartSessionCleanup()
 
 	// Create and start hub
 	hub := types.NewHub()
+	hub.MaxClients = cfg.MaxClients
+	hub.MaxRooms = cfg.MaxRooms
+	hub.MaxRoomMembers = cfg.MaxRoomMembers
+	hub.MaxRoomsPerClient = cfg.MaxRoomsPerClient
+	hub.RequireRecipient = cfg.EncryptedRouting == "directed"
+	if cfg.RedisAddr != "" {
+		hub.Broadcaster = pubsub.NewRedis(cfg.RedisAddr, "chapp:broadcast")
+		log.Printf("Sharing broadcasts through Redis at %s", cfg.RedisAddr)
+	}
 	go hub.Run()
 
 	// WebSocket server routes
@@ -36,10 +65,32 @@ func main() {
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		handlers.ServeWs(hub, w, r)
 	})
+	mux.HandleFunc("/version", handlers.ServeVersion)
+	mux.HandleFunc("/readyz", handlers.ServeReady)
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ServeStats(hub, w, r)
+	})
+
+	// Admin routes
+	mux.HandleFunc("/api/broadcast", func(w http.ResponseWriter, r *http.Request) {
+		handlers.ServeAdminBroadcast(hub, w, r)
+	})
+
+	log.Printf("Chapp WebSocket server starting on %s", cfg.WSAddr)
 
-	log.Println("Chapp WebSocket server starting on :8081")
+	// On SIGINT/SIGTERM: stop accepting connections, disconnect clients, then flush and close the database
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	err = http.ListenAndServe(":8081", mux)
+	err = shutdown.Serve(ctx, &http.Server{Addr: cfg.WSAddr, Handler: mux},
+		func() { hub.Shutdown(shutdown.Timeout) },
+		func() {
+			if hub.Broadcaster != nil {
+				hub.Broadcaster.Close()
+			}
+		},
+		func() { db.Close() },
+	)
 	if err != nil {
 		log.Fatal("WebSocket server error: ", err)
 	}
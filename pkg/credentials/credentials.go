@@ -0,0 +1,64 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// storedCredential is the serialized form of a WebAuthn credential
+type storedCredential struct {
+	Credential webauthn.Credential         `json:"credential"`
+	RawFlags   protocol.AuthenticatorFlags `json:"raw_flags"` // Flags keep their raw value unexported
+}
+
+// EncodeCredentialID converts a raw credential ID to its database form
+func EncodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// DecodeCredentialID converts a database credential ID back to raw bytes
+func DecodeCredentialID(id string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode credential ID: %v", err)
+	}
+	return decoded, nil
+}
+
+// EncodeCredential converts a WebAuthn credential to its database form (credential ID and data)
+func EncodeCredential(cred *webauthn.Credential) (string, string, error) {
+	if cred == nil || len(cred.ID) == 0 {
+		return "", "", fmt.Errorf("credential ID is required")
+	}
+
+	data, err := json.Marshal(storedCredential{
+		Credential: *cred,
+		RawFlags:   cred.Flags.ProtocolValue(),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode credential: %v", err)
+	}
+
+	return EncodeCredentialID(cred.ID), base64.StdEncoding.EncodeToString(data), nil
+}
+
+// DecodeCredential converts credential data from the database back to a WebAuthn credential
+func DecodeCredential(data string) (*webauthn.Credential, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode credential data: %v", err)
+	}
+
+	var stored storedCredential
+	if err := json.Unmarshal(decoded, &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode credential: %v", err)
+	}
+
+	cred := stored.Credential
+	cred.Flags = webauthn.NewCredentialFlags(stored.RawFlags)
+	return &cred, nil
+}
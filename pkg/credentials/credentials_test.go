@@ -0,0 +1,81 @@
+package credentials
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// TestCredentialRoundTrip tests encoding and decoding a realistic credential
+func TestCredentialRoundTrip(t *testing.T) {
+	cred := &webauthn.Credential{
+		ID:              []byte{0x01, 0xfe, 0x7a, 0x00, 0x42, 0x99, 0xff},
+		PublicKey:       []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20},
+		AttestationType: "packed",
+		Transport:       []protocol.AuthenticatorTransport{protocol.USB, protocol.NFC, protocol.Internal},
+		Flags: webauthn.NewCredentialFlags(
+			protocol.FlagUserPresent | protocol.FlagUserVerified | protocol.FlagBackupEligible,
+		),
+		Authenticator: webauthn.Authenticator{
+			AAGUID:     []byte{0xad, 0xce, 0x00, 0x02, 0x35, 0xbc, 0xc6, 0x0a},
+			SignCount:  42,
+			Attachment: protocol.CrossPlatform,
+		},
+		Attestation: webauthn.CredentialAttestation{
+			ClientDataJSON:     []byte(`{"type":"webauthn.create"}`),
+			ClientDataHash:     []byte{0x10, 0x20, 0x30},
+			AuthenticatorData:  []byte{0x49, 0x96, 0x0d, 0xe5},
+			PublicKeyAlgorithm: -7,
+			Object:             []byte{0xa3, 0x63, 0x66, 0x6d, 0x74},
+		},
+	}
+
+	credentialID, data, err := EncodeCredential(cred)
+	if err != nil {
+		t.Fatalf("Failed to encode credential: %v", err)
+	}
+
+	decodedID, err := DecodeCredentialID(credentialID)
+	if err != nil {
+		t.Fatalf("Failed to decode credential ID: %v", err)
+	}
+
+	if !bytes.Equal(decodedID, cred.ID) {
+		t.Errorf("Expected credential ID %x, got %x", cred.ID, decodedID)
+	}
+
+	decoded, err := DecodeCredential(data)
+	if err != nil {
+		t.Fatalf("Failed to decode credential: %v", err)
+	}
+
+	if !reflect.DeepEqual(decoded, cred) {
+		t.Errorf("Decoded credential does not match original:\n got %+v\nwant %+v", decoded, cred)
+	}
+
+	if decoded.Flags.ProtocolValue() != cred.Flags.ProtocolValue() {
+		t.Errorf("Expected raw flags %v, got %v", cred.Flags.ProtocolValue(), decoded.Flags.ProtocolValue())
+	}
+}
+
+// TestCredentialDecodeErrors tests that invalid stored data is rejected
+func TestCredentialDecodeErrors(t *testing.T) {
+	if _, _, err := EncodeCredential(&webauthn.Credential{}); err == nil {
+		t.Error("Encoding a credential without an ID should fail")
+	}
+
+	if _, err := DecodeCredential("not base64!"); err == nil {
+		t.Error("Decoding invalid base64 should fail")
+	}
+
+	if _, err := DecodeCredential("bm90IGpzb24="); err == nil {
+		t.Error("Decoding invalid JSON should fail")
+	}
+
+	if _, err := DecodeCredentialID("not base64!"); err == nil {
+		t.Error("Decoding an invalid credential ID should fail")
+	}
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pendingAuditEvent is an audit insert waiting to be flushed
+type pendingAuditEvent struct {
+	event    string
+	username string
+	remoteIP string
+}
+
+// writeBatch queues audit inserts and writes them in a single transaction
+type writeBatch struct {
+	auditEvents []pendingAuditEvent
+	mutex       sync.Mutex
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+// EnableWriteBatching queues audit inserts and flushes them every interval. Sessions are
+// still written immediately, so the other server binary can see them as soon as they exist.
+// Reads of the audit log flush first, so callers always see their own writes.
+// Errors from a background flush are logged since the original caller has already returned.
+func (s *SQLiteDB) EnableWriteBatching(interval time.Duration) {
+	batch := &writeBatch{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.mutex.Lock()
+	s.batch = batch
+	s.mutex.Unlock()
+
+	go func() {
+		defer close(batch.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					log.Printf("Failed to flush batched writes: %v", err)
+				}
+			case <-batch.stop:
+				return
+			}
+		}
+	}()
+}
+
+// writeBatch returns the current write batch, nil when batching is disabled
+func (s *SQLiteDB) writeBatch() *writeBatch {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.batch
+}
+
+// queueAuditEvent adds an audit insert to the batch, returning false when batching is disabled
+func (s *SQLiteDB) queueAuditEvent(event pendingAuditEvent) bool {
+	batch := s.writeBatch()
+	if batch == nil {
+		return false
+	}
+
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+	batch.auditEvents = append(batch.auditEvents, event)
+	return true
+}
+
+// Flush writes all queued inserts to the database. A batch that fails to write is dropped
+// rather than retried, so one bad flush doesn't fail every later one.
+func (s *SQLiteDB) Flush() error {
+	return s.flushBatch(s.writeBatch())
+}
+
+// flushBatch writes and empties a batch's queued inserts
+func (s *SQLiteDB) flushBatch(batch *writeBatch) error {
+	if batch == nil {
+		return nil
+	}
+
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+
+	events := batch.auditEvents
+	batch.auditEvents = nil
+	if len(events) == 0 {
+		return nil
+	}
+
+	if err := s.writeAuditEvents(events); err != nil {
+		return fmt.Errorf("dropped %d batched audit events: %v", len(events), err)
+	}
+	return nil
+}
+
+// writeAuditEvents inserts audit events in one transaction
+func (s *SQLiteDB) writeAuditEvents(events []pendingAuditEvent) error {
+	tx, err := s.begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, event := range events {
+		_, err := tx.Exec(`INSERT INTO audit_log (event, username, remote_ip, created_at) 
+			  VALUES (?, ?, ?, CURRENT_TIMESTAMP)`,
+			event.event, event.username, event.remoteIP)
+		if err != nil {
+			return fmt.Errorf("failed to record audit event: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batched writes: %v", err)
+	}
+	return nil
+}
+
+// stopWriteBatching stops the flush goroutine and writes any queued inserts
+func (s *SQLiteDB) stopWriteBatching() error {
+	batch := s.writeBatch()
+	if batch == nil {
+		return nil
+	}
+
+	close(batch.stop)
+	<-batch.done
+
+	// Later inserts are written directly, then whatever was queued is flushed
+	s.mutex.Lock()
+	s.batch = nil
+	s.mutex.Unlock()
+	return s.flushBatch(batch)
+}
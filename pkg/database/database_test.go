@@ -0,0 +1,498 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testDatabase runs the shared test suite against a Database implementation
+func testDatabase(t *testing.T, db Database) {
+	t.Run("Users and sessions", func(t *testing.T) {
+		testUsersAndSessions(t, db)
+	})
+	t.Run("Not found and duplicates", func(t *testing.T) {
+		testNotFoundAndDuplicates(t, db)
+	})
+	t.Run("Audit log", func(t *testing.T) {
+		testAuditLog(t, db)
+	})
+	t.Run("Invites", func(t *testing.T) {
+		testInvites(t, db)
+	})
+	t.Run("User data", func(t *testing.T) {
+		testUserData(t, db)
+	})
+}
+
+func testUsersAndSessions(t *testing.T, db Database) {
+	// Test user creation
+	user, err := db.CreateUser("testuser")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	if user == nil {
+		t.Fatal("User should not be nil")
+	}
+
+	if user.Username != "testuser" {
+		t.Errorf("Expected username 'testuser', got '%s'", user.Username)
+	}
+
+	if user.ID == 0 {
+		t.Error("User ID should not be zero")
+	}
+
+	// Test user retrieval
+	retrievedUser, err := db.GetUser("testuser")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if retrievedUser == nil {
+		t.Fatal("Retrieved user should not be nil")
+	}
+
+	if retrievedUser.Username != "testuser" {
+		t.Errorf("Expected username 'testuser', got '%s'", retrievedUser.Username)
+	}
+
+	// Test session creation
+	sessionID := "test-session-id"
+	err = db.CreateSession(sessionID, "testuser", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	// Test session retrieval
+	session, err := db.GetSession(sessionID)
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+
+	if session == nil {
+		t.Fatal("Session should not be nil")
+	}
+
+	if session.ID != sessionID {
+		t.Errorf("Expected session ID '%s', got '%s'", sessionID, session.ID)
+	}
+
+	if session.Username != "testuser" {
+		t.Errorf("Expected username 'testuser', got '%s'", session.Username)
+	}
+
+	if remaining := time.Until(session.ExpiresAt); remaining < 59*time.Minute || remaining > 61*time.Minute {
+		t.Errorf("Expected the session to expire in an hour, got %v", remaining)
+	}
+
+	// Test session deletion
+	err = db.DeleteSession(sessionID)
+	if err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+
+	// Verify session is deleted
+	deletedSession, err := db.GetSession(sessionID)
+	if err != nil {
+		t.Fatalf("Failed to get deleted session: %v", err)
+	}
+
+	if deletedSession != nil {
+		t.Error("Session should be nil after deletion")
+	}
+
+	// Test user update
+	err = db.UpdateUserLastLogin("testuser")
+	if err != nil {
+		t.Fatalf("Failed to update user last login: %v", err)
+	}
+
+	// Test passkey ID update
+	err = db.UpdateUserPasskeyID("testuser", "test-passkey-id")
+	if err != nil {
+		t.Fatalf("Failed to update passkey ID: %v", err)
+	}
+
+	// Test finding user by passkey ID
+	foundUser, err := db.FindUserByPasskeyID("test-passkey-id")
+	if err != nil {
+		t.Fatalf("Failed to find user by passkey ID: %v", err)
+	}
+
+	if foundUser == nil {
+		t.Fatal("User should be found by passkey ID")
+	}
+
+	if foundUser.Username != "testuser" {
+		t.Errorf("Expected username 'testuser', got '%s'", foundUser.Username)
+	}
+
+	// Test credential storage
+	err = db.StoreCredential(user.ID, "test-credential-id", "test-public-key", "Laptop")
+	if err != nil {
+		t.Fatalf("Failed to store credential: %v", err)
+	}
+
+	// Test credential retrieval
+	credential, err := db.GetCredential("test-credential-id")
+	if err != nil {
+		t.Fatalf("Failed to get credential: %v", err)
+	}
+
+	if credential == nil {
+		t.Fatal("Credential should not be nil")
+	}
+
+	if credential.CredentialID != "test-credential-id" {
+		t.Errorf("Expected credential ID 'test-credential-id', got '%s'", credential.CredentialID)
+	}
+
+	if credential.PublicKey != "test-public-key" {
+		t.Errorf("Expected public key 'test-public-key', got '%s'", credential.PublicKey)
+	}
+
+	if credential.DeviceLabel != "Laptop" {
+		t.Errorf("Expected device label 'Laptop', got '%s'", credential.DeviceLabel)
+	}
+
+	// Test resolving a discoverable credential's owner from its user handle
+	handleUser, err := db.FindUserByCredentialHandle("test-credential-id", []byte("testuser"))
+	if err != nil {
+		t.Fatalf("Failed to find user by credential handle: %v", err)
+	}
+
+	if handleUser == nil || handleUser.ID != user.ID {
+		t.Errorf("Expected user %d for the credential handle, got %v", user.ID, handleUser)
+	}
+
+	// Test credential updates
+	if err := db.UpdateCredential("test-credential-id", "updated-public-key"); err != nil {
+		t.Fatalf("Failed to update credential: %v", err)
+	}
+
+	if credential, err = db.GetCredential("test-credential-id"); err != nil || credential == nil || credential.PublicKey != "updated-public-key" {
+		t.Errorf("Expected the updated credential data, got %+v, %v", credential, err)
+	}
+
+	if err := db.UpdateCredential("missing", "data"); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("Expected ErrCredentialNotFound, got %v", err)
+	}
+
+	// Test credential deletion
+	if err := db.StoreCredential(user.ID, "second-credential-id", "second-public-key", ""); err != nil {
+		t.Fatalf("Failed to store second credential: %v", err)
+	}
+
+	if err := db.DeleteCredential("second-credential-id"); err != nil {
+		t.Fatalf("Failed to delete credential: %v", err)
+	}
+
+	credentials, err := db.GetCredentialsByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get credentials: %v", err)
+	}
+
+	if len(credentials) != 1 || credentials[0].CredentialID != "test-credential-id" {
+		t.Errorf("Expected only 'test-credential-id' to remain, got %v", credentials)
+	}
+
+	if err := db.DeleteCredential("second-credential-id"); !errors.Is(err, ErrCredentialNotFound) {
+		t.Errorf("Expected ErrCredentialNotFound, got %v", err)
+	}
+
+	// Test cleanup
+	err = db.CleanupExpiredSessions()
+	if err != nil {
+		t.Fatalf("Failed to cleanup expired sessions: %v", err)
+	}
+}
+
+func testNotFoundAndDuplicates(t *testing.T, db Database) {
+	if _, err := db.CreateUser("dupuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// Duplicates are rejected
+	if _, err := db.CreateUser("dupuser"); err == nil {
+		t.Error("Creating a duplicate user should fail")
+	}
+
+	if err := db.CreateSession("dup-session", "dupuser", time.Hour); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := db.CreateSession("dup-session", "dupuser", time.Hour); err == nil {
+		t.Error("Creating a duplicate session should fail")
+	}
+
+	user, err := db.GetUser("dupuser")
+	if err != nil || user == nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	if err := db.StoreCredential(user.ID, "dup-credential", "key", ""); err != nil {
+		t.Fatalf("Failed to store credential: %v", err)
+	}
+	if err := db.StoreCredential(user.ID, "dup-credential", "key", ""); err == nil {
+		t.Error("Storing a duplicate credential should fail")
+	}
+
+	// Lookups return nil without error when nothing matches
+	if user, err := db.GetUser("missing"); err != nil || user != nil {
+		t.Errorf("Expected nil user without error, got %v, %v", user, err)
+	}
+	if user, err := db.GetUserByID(999999); err != nil || user != nil {
+		t.Errorf("Expected nil user without error, got %v, %v", user, err)
+	}
+	if user, err := db.FindUserByPasskeyID("missing"); err != nil || user != nil {
+		t.Errorf("Expected nil user without error, got %v, %v", user, err)
+	}
+	if session, err := db.GetSession("missing"); err != nil || session != nil {
+		t.Errorf("Expected nil session without error, got %v, %v", session, err)
+	}
+	if cred, err := db.GetCredential("missing"); err != nil || cred != nil {
+		t.Errorf("Expected nil credential without error, got %v, %v", cred, err)
+	}
+	if user, err := db.FindUserByCredentialHandle("missing", []byte("dupuser")); err != nil || user != nil {
+		t.Errorf("Expected nil user without error, got %v, %v", user, err)
+	}
+	if user, err := db.FindUserByCredentialHandle("dup-credential", []byte("someone-else")); err != nil || user != nil {
+		t.Errorf("Expected nil user for a mismatched handle, got %v, %v", user, err)
+	}
+
+	// Updates and deletes of missing records fail
+	if err := db.UpdateUserLastLogin("missing"); err == nil {
+		t.Error("Updating a missing user should fail")
+	}
+	if err := db.UpdateUserPasskeyID("missing", "id"); err == nil {
+		t.Error("Updating a missing user should fail")
+	}
+	if err := db.UpdateUserPublicKey("missing", "key"); err == nil {
+		t.Error("Updating a missing user should fail")
+	}
+	if err := db.SetUserRegistered("missing", true); err == nil {
+		t.Error("Updating a missing user should fail")
+	}
+	if err := db.CreateSession("orphan-session", "missing", time.Hour); err == nil {
+		t.Error("Creating a session for a missing user should fail")
+	}
+	if err := db.DeleteSession("missing"); err == nil {
+		t.Error("Deleting a missing session should fail")
+	}
+
+	// Updates are visible on later reads
+	if err := db.UpdateUserPublicKey("dupuser", "chat-key"); err != nil {
+		t.Fatalf("Failed to update public key: %v", err)
+	}
+	if _, err := db.ClaimUserRegistration("missing"); err == nil {
+		t.Error("Claiming a missing user should fail")
+	}
+	if claimed, err := db.ClaimUserRegistration("dupuser"); err != nil || !claimed {
+		t.Fatalf("Expected the first claim to succeed, got %v, %v", claimed, err)
+	}
+	if claimed, err := db.ClaimUserRegistration("dupuser"); err != nil || claimed {
+		t.Errorf("Expected a second claim to fail, got %v, %v", claimed, err)
+	}
+	if err := db.SetUserRegistered("dupuser", true); err != nil {
+		t.Fatalf("Failed to set user registered: %v", err)
+	}
+	user, err = db.GetUserByID(user.ID)
+	if err != nil || user == nil {
+		t.Fatalf("Failed to get user by ID: %v", err)
+	}
+	if user.PublicKey != "chat-key" || !user.IsRegistered {
+		t.Errorf("Expected updated user, got %+v", user)
+	}
+
+	// All users are ordered by username
+	users, err := db.GetAllUsers()
+	if err != nil {
+		t.Fatalf("Failed to get all users: %v", err)
+	}
+	for i := 1; i < len(users); i++ {
+		if users[i-1].Username > users[i].Username {
+			t.Errorf("Users are not ordered by username: %s before %s", users[i-1].Username, users[i].Username)
+		}
+	}
+
+	creds, err := db.GetCredentialsByUserID(user.ID)
+	if err != nil {
+		t.Fatalf("Failed to get credentials: %v", err)
+	}
+	if len(creds) != 1 || creds[0].CredentialID != "dup-credential" {
+		t.Errorf("Expected 1 credential, got %+v", creds)
+	}
+}
+
+func testAuditLog(t *testing.T, db Database) {
+	// Test recording events
+	if err := db.RecordAuditEvent("login_failure", "alice", "192.0.2.1"); err != nil {
+		t.Fatalf("Failed to record audit event: %v", err)
+	}
+	if err := db.RecordAuditEvent("login_success", "bob", "192.0.2.2"); err != nil {
+		t.Fatalf("Failed to record audit event: %v", err)
+	}
+
+	// Test retrieval (newest first)
+	events, err := db.GetRecentAuditEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to get audit events: %v", err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 audit events, got %d", len(events))
+	}
+
+	if events[0].Event != "login_success" || events[0].Username != "bob" || events[0].RemoteIP != "192.0.2.2" {
+		t.Errorf("Unexpected newest audit event: %+v", events[0])
+	}
+
+	if events[1].Event != "login_failure" || events[1].Username != "alice" {
+		t.Errorf("Unexpected oldest audit event: %+v", events[1])
+	}
+
+	// Test limit
+	events, err = db.GetRecentAuditEvents(1)
+	if err != nil {
+		t.Fatalf("Failed to get audit events: %v", err)
+	}
+
+	if len(events) != 1 {
+		t.Errorf("Expected 1 audit event, got %d", len(events))
+	}
+}
+
+func testInvites(t *testing.T, db Database) {
+	future := time.Now().Add(time.Hour)
+
+	// Test valid single-use invite
+	if err := db.CreateInvite("single", "alice", future, true); err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+
+	// Checking leaves it usable
+	for i := 0; i < 2; i++ {
+		if invite, err := db.CheckInvite("single"); err != nil || invite.CreatedBy != "alice" || invite.Consumed {
+			t.Fatalf("Expected check %d to find an unused invite, got %+v (%v)", i+1, invite, err)
+		}
+	}
+
+	invite, err := db.ConsumeInvite("single")
+	if err != nil {
+		t.Fatalf("Failed to consume invite: %v", err)
+	}
+
+	if invite.CreatedBy != "alice" {
+		t.Errorf("Expected creator 'alice', got '%s'", invite.CreatedBy)
+	}
+
+	if !invite.SingleUse || !invite.Consumed {
+		t.Errorf("Expected a consumed single-use invite, got %+v", invite)
+	}
+
+	// Test already-consumed invite
+	if _, err := db.ConsumeInvite("single"); !errors.Is(err, ErrInviteConsumed) {
+		t.Errorf("Expected ErrInviteConsumed, got %v", err)
+	}
+	if _, err := db.CheckInvite("single"); !errors.Is(err, ErrInviteConsumed) {
+		t.Errorf("Expected ErrInviteConsumed from a check, got %v", err)
+	}
+
+	// Test reusable invite
+	if err := db.CreateInvite("reusable", "alice", future, false); err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := db.ConsumeInvite("reusable"); err != nil {
+			t.Errorf("Reusable invite should be accepted on use %d: %v", i+1, err)
+		}
+	}
+
+	// Test expired invite
+	if err := db.CreateInvite("expired", "alice", time.Now().Add(-time.Minute), true); err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	if _, err := db.ConsumeInvite("expired"); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("Expected ErrInviteExpired, got %v", err)
+	}
+	if _, err := db.CheckInvite("expired"); !errors.Is(err, ErrInviteExpired) {
+		t.Errorf("Expected ErrInviteExpired from a check, got %v", err)
+	}
+
+	// Test unknown invite
+	if _, err := db.ConsumeInvite("unknown"); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound, got %v", err)
+	}
+	if _, err := db.CheckInvite("unknown"); !errors.Is(err, ErrInviteNotFound) {
+		t.Errorf("Expected ErrInviteNotFound from a check, got %v", err)
+	}
+
+	// Test duplicate token
+	if err := db.CreateInvite("single", "bob", future, true); err == nil {
+		t.Error("Duplicate invite token should fail")
+	}
+}
+
+func testUserData(t *testing.T, db Database) {
+	for _, username := range []string{"exporter", "neighbour"} {
+		user, err := db.CreateUser(username)
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		if err := db.StoreCredential(user.ID, username+"-credential", "secret-key", "Laptop"); err != nil {
+			t.Fatalf("Failed to store credential: %v", err)
+		}
+		if err := db.CreateSession(username+"-session", username, time.Hour); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		if err := db.RecordAuditEvent("login_success", username, "192.0.2.1"); err != nil {
+			t.Fatalf("Failed to record audit event: %v", err)
+		}
+	}
+
+	data, err := ExportUserData(db, "exporter")
+	if err != nil {
+		t.Fatalf("Failed to export user data: %v", err)
+	}
+	if data.User == nil || data.User.Username != "exporter" {
+		t.Fatalf("Expected the exporter's user row, got %+v", data.User)
+	}
+	if len(data.Credentials) != 1 || data.Credentials[0].CredentialID != "exporter-credential" || data.Credentials[0].DeviceLabel != "Laptop" {
+		t.Errorf("Expected the exporter's credential, got %+v", data.Credentials)
+	}
+	if len(data.Sessions) != 1 || data.Sessions[0].ExpiresAt.IsZero() {
+		t.Errorf("Expected the exporter's session, got %+v", data.Sessions)
+	}
+	if len(data.AuditEvents) != 1 || data.AuditEvents[0].Username != "exporter" {
+		t.Errorf("Expected the exporter's audit event, got %+v", data.AuditEvents)
+	}
+
+	if missing, err := ExportUserData(db, "nobody"); err != nil || missing != nil {
+		t.Errorf("Expected nil export for unknown user, got %+v (%v)", missing, err)
+	}
+
+	if err := db.DeleteUserData("exporter"); err != nil {
+		t.Fatalf("Failed to delete user data: %v", err)
+	}
+	if user, _ := db.GetUser("exporter"); user != nil {
+		t.Error("Expected the user to be deleted")
+	}
+	if cred, _ := db.GetCredential("exporter-credential"); cred != nil {
+		t.Error("Expected the credential to be deleted")
+	}
+	if session, _ := db.GetSession("exporter-session"); session != nil {
+		t.Error("Expected the session to be deleted")
+	}
+	if events, _ := db.GetAuditEventsByUsername("exporter"); len(events) != 0 {
+		t.Errorf("Expected the audit events to be deleted, got %d", len(events))
+	}
+
+	// Other users' data is untouched
+	if data, _ := ExportUserData(db, "neighbour"); data == nil || len(data.Credentials) != 1 || len(data.Sessions) != 1 || len(data.AuditEvents) != 1 {
+		t.Errorf("Expected the neighbour's data to remain, got %+v", data)
+	}
+
+	if err := db.DeleteUserData("exporter"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound, got %v", err)
+	}
+}
@@ -1,9 +1,23 @@
 package database
 
 import (
+	"errors"
 	"time"
 )
 
+// Invite errors returned by CheckInvite and ConsumeInvite
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInviteExpired  = errors.New("invite expired")
+	ErrInviteConsumed = errors.New("invite already used")
+)
+
+// ErrCredentialNotFound is returned by DeleteCredential when no credential matches
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// ErrUserNotFound is returned by DeleteUserData when the user doesn't exist
+var ErrUserNotFound = errors.New("user not found")
+
 // User represents a user in the database
 type User struct {
 	ID           int       `json:"id"`
@@ -30,9 +44,29 @@ type WebAuthnCredential struct {
 	UserID       int       `json:"user_id"`
 	CredentialID string    `json:"credential_id"`
 	PublicKey    string    `json:"public_key"`
+	DeviceLabel  string    `json:"device_label,omitempty"`
 	Created      time.Time `json:"created"`
 }
 
+// AuditEvent represents an authentication audit log entry
+type AuditEvent struct {
+	ID       int       `json:"id"`
+	Event    string    `json:"event"`
+	Username string    `json:"username"`
+	RemoteIP string    `json:"remote_ip"`
+	Created  time.Time `json:"created"`
+}
+
+// Invite represents a join link token
+type Invite struct {
+	Token     string    `json:"token"`
+	CreatedBy string    `json:"created_by"`
+	Created   time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SingleUse bool      `json:"single_use"`
+	Consumed  bool      `json:"consumed"`
+}
+
 // Database interface defines the contract for database operations
 type Database interface {
 	// User operations
@@ -44,20 +78,39 @@ type Database interface {
 	UpdateUserPasskeyID(username, passkeyID string) error
 	UpdateUserPublicKey(username, publicKey string) error
 	SetUserRegistered(username string, registered bool) error
+	ClaimUserRegistration(username string) (bool, error) // Marks an unregistered user registered, false if they already were
 	FindUserByPasskeyID(passkeyID string) (*User, error)
 
 	// Session operations
-	CreateSession(sessionID, username string) error
+	CreateSession(sessionID, username string, ttl time.Duration) error
 	GetSession(sessionID string) (*Session, error)
+	GetSessionsByUserID(userID int) ([]*Session, error)
 	DeleteSession(sessionID string) error
 	CleanupExpiredSessions() error
 
 	// WebAuthn operations
-	StoreCredential(userID int, credentialID, publicKey string) error
+	StoreCredential(userID int, credentialID, publicKey, deviceLabel string) error
 	GetCredential(credentialID string) (*WebAuthnCredential, error)
 	GetCredentialsByUserID(userID int) ([]*WebAuthnCredential, error)
+	FindUserByCredentialHandle(credentialID string, userHandle []byte) (*User, error)
+	UpdateCredential(credentialID, publicKey string) error // Replaces the stored credential data, e.g. after a login moved its sign count
+	DeleteCredential(credentialID string) error
+
+	// Audit operations
+	RecordAuditEvent(event, username, remoteIP string) error
+	GetRecentAuditEvents(limit int) ([]*AuditEvent, error)
+	GetAuditEventsByUsername(username string) ([]*AuditEvent, error)
+
+	// Invite operations
+	CreateInvite(token, createdBy string, expiresAt time.Time, singleUse bool) error
+	CheckInvite(token string) (*Invite, error)
+	ConsumeInvite(token string) (*Invite, error)
+
+	// Account operations
+	DeleteUserData(username string) error // Removes the user with their credentials, sessions and audit events in one transaction
 
 	// Utility operations
 	Close() error
 	Init() error
+	Healthy() bool // Reports whether the database currently answers queries
 }
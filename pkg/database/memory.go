@@ -0,0 +1,504 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDB implements the Database interface with in-memory maps (for tests)
+type MemoryDB struct {
+	users       map[int]*User
+	sessions    map[string]*Session
+	credentials map[string]*WebAuthnCredential
+	auditEvents []*AuditEvent
+	invites     map[string]*Invite
+	nextUserID  int
+	nextCredID  int
+	mutex       sync.RWMutex
+}
+
+// NewMemory creates a new empty in-memory database
+func NewMemory() *MemoryDB {
+	db := &MemoryDB{}
+	db.Init()
+	return db
+}
+
+// Init resets the database to an empty state
+func (m *MemoryDB) Init() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.users = make(map[int]*User)
+	m.sessions = make(map[string]*Session)
+	m.credentials = make(map[string]*WebAuthnCredential)
+	m.auditEvents = nil
+	m.invites = make(map[string]*Invite)
+	m.nextUserID = 1
+	m.nextCredID = 1
+	return nil
+}
+
+// findUser returns the stored user with the given username (caller holds the lock)
+func (m *MemoryDB) findUser(username string) *User {
+	for _, user := range m.users {
+		if user.Username == username {
+			return user
+		}
+	}
+	return nil
+}
+
+// CreateUser creates a new user
+func (m *MemoryDB) CreateUser(username string) (*User, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.findUser(username) != nil {
+		return nil, fmt.Errorf("failed to create user: username %s already exists", username)
+	}
+
+	now := time.Now().UTC()
+	user := &User{
+		ID:        m.nextUserID,
+		Username:  username,
+		Created:   now,
+		LastLogin: now,
+	}
+	m.users[user.ID] = user
+	m.nextUserID++
+
+	copied := *user
+	return &copied, nil
+}
+
+// GetUser retrieves a user by username
+func (m *MemoryDB) GetUser(username string) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	user := m.findUser(username)
+	if user == nil {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// GetUserByID retrieves a user by ID
+func (m *MemoryDB) GetUserByID(id int) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	user, exists := m.users[id]
+	if !exists {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// GetAllUsers retrieves all users ordered by username
+func (m *MemoryDB) GetAllUsers() ([]*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var users []*User
+	for _, user := range m.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users, nil
+}
+
+// updateUser applies a change to a stored user (caller must not hold the lock)
+func (m *MemoryDB) updateUser(username string, update func(*User)) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user := m.findUser(username)
+	if user == nil {
+		return fmt.Errorf("user not found: %s", username)
+	}
+	update(user)
+	return nil
+}
+
+// UpdateUserLastLogin updates the user's last login time
+func (m *MemoryDB) UpdateUserLastLogin(username string) error {
+	return m.updateUser(username, func(user *User) {
+		user.LastLogin = time.Now().UTC()
+	})
+}
+
+// UpdateUserPasskeyID updates the user's passkey ID
+func (m *MemoryDB) UpdateUserPasskeyID(username, passkeyID string) error {
+	return m.updateUser(username, func(user *User) {
+		user.PasskeyID = passkeyID
+	})
+}
+
+// UpdateUserPublicKey updates the user's public key
+func (m *MemoryDB) UpdateUserPublicKey(username, publicKey string) error {
+	return m.updateUser(username, func(user *User) {
+		user.PublicKey = publicKey
+	})
+}
+
+// SetUserRegistered sets the user's registration status
+func (m *MemoryDB) SetUserRegistered(username string, registered bool) error {
+	return m.updateUser(username, func(user *User) {
+		user.IsRegistered = registered
+	})
+}
+
+// ClaimUserRegistration marks an unregistered user registered, returning false if they already were
+func (m *MemoryDB) ClaimUserRegistration(username string) (bool, error) {
+	claimed := false
+	err := m.updateUser(username, func(user *User) {
+		claimed = !user.IsRegistered
+		user.IsRegistered = true
+	})
+	return claimed, err
+}
+
+// FindUserByPasskeyID finds a user by their passkey ID
+func (m *MemoryDB) FindUserByPasskeyID(passkeyID string) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, user := range m.users {
+		if user.PasskeyID == passkeyID {
+			copied := *user
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+// CreateSession creates a new session that expires after ttl
+func (m *MemoryDB) CreateSession(sessionID, username string, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user := m.findUser(username)
+	if user == nil {
+		return fmt.Errorf("user not found: %s", username)
+	}
+
+	if _, exists := m.sessions[sessionID]; exists {
+		return fmt.Errorf("failed to create session: session %s already exists", sessionID)
+	}
+
+	now := time.Now().UTC()
+	m.sessions[sessionID] = &Session{
+		ID:        sessionID,
+		UserID:    user.ID,
+		Username:  username,
+		Created:   now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+// GetSession retrieves a session by ID
+func (m *MemoryDB) GetSession(sessionID string) (*Session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return nil, nil
+	}
+	copied := *session
+	return &copied, nil
+}
+
+// GetSessionsByUserID retrieves all sessions of a user, oldest first
+func (m *MemoryDB) GetSessionsByUserID(userID int) ([]*Session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var sessions []*Session
+	for _, session := range m.sessions {
+		if session.UserID == userID {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Created.Before(sessions[j].Created)
+	})
+	return sessions, nil
+}
+
+// DeleteSession deletes a session
+func (m *MemoryDB) DeleteSession(sessionID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.sessions[sessionID]; !exists {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+	delete(m.sessions, sessionID)
+	return nil
+}
+
+// CleanupExpiredSessions removes expired sessions
+func (m *MemoryDB) CleanupExpiredSessions() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now().UTC()
+	for id, session := range m.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(m.sessions, id)
+		}
+	}
+	return nil
+}
+
+// StoreCredential stores a WebAuthn credential
+func (m *MemoryDB) StoreCredential(userID int, credentialID, publicKey, deviceLabel string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.credentials[credentialID]; exists {
+		return fmt.Errorf("failed to store credential: credential %s already exists", credentialID)
+	}
+
+	m.credentials[credentialID] = &WebAuthnCredential{
+		ID:           m.nextCredID,
+		UserID:       userID,
+		CredentialID: credentialID,
+		PublicKey:    publicKey,
+		DeviceLabel:  deviceLabel,
+		Created:      time.Now().UTC(),
+	}
+	m.nextCredID++
+	return nil
+}
+
+// GetCredential retrieves a WebAuthn credential by ID
+func (m *MemoryDB) GetCredential(credentialID string) (*WebAuthnCredential, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	cred, exists := m.credentials[credentialID]
+	if !exists {
+		return nil, nil
+	}
+	copied := *cred
+	return &copied, nil
+}
+
+// FindUserByCredentialHandle finds the owner of a credential, provided the user handle names them
+func (m *MemoryDB) FindUserByCredentialHandle(credentialID string, userHandle []byte) (*User, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	cred, exists := m.credentials[credentialID]
+	if !exists {
+		return nil, nil
+	}
+	user, exists := m.users[cred.UserID]
+	if !exists || user.Username != string(userHandle) {
+		return nil, nil
+	}
+	copied := *user
+	return &copied, nil
+}
+
+// GetCredentialsByUserID retrieves all credentials for a user
+func (m *MemoryDB) GetCredentialsByUserID(userID int) ([]*WebAuthnCredential, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var credentials []*WebAuthnCredential
+	for _, cred := range m.credentials {
+		if cred.UserID == userID {
+			copied := *cred
+			credentials = append(credentials, &copied)
+		}
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].ID < credentials[j].ID
+	})
+	return credentials, nil
+}
+
+// UpdateCredential replaces a WebAuthn credential's stored data
+func (m *MemoryDB) UpdateCredential(credentialID, publicKey string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	cred, exists := m.credentials[credentialID]
+	if !exists {
+		return ErrCredentialNotFound
+	}
+	cred.PublicKey = publicKey
+	return nil
+}
+
+// DeleteCredential removes a WebAuthn credential
+func (m *MemoryDB) DeleteCredential(credentialID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.credentials[credentialID]; !exists {
+		return ErrCredentialNotFound
+	}
+	delete(m.credentials, credentialID)
+	return nil
+}
+
+// RecordAuditEvent stores an authentication audit event
+func (m *MemoryDB) RecordAuditEvent(event, username, remoteIP string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.auditEvents = append(m.auditEvents, &AuditEvent{
+		ID:       len(m.auditEvents) + 1,
+		Event:    event,
+		Username: username,
+		RemoteIP: remoteIP,
+		Created:  time.Now().UTC(),
+	})
+	return nil
+}
+
+// GetRecentAuditEvents retrieves the most recent audit events, newest first
+func (m *MemoryDB) GetRecentAuditEvents(limit int) ([]*AuditEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var events []*AuditEvent
+	for i := len(m.auditEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		copied := *m.auditEvents[i]
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+// GetAuditEventsByUsername retrieves every audit event recorded for a user, oldest first
+func (m *MemoryDB) GetAuditEventsByUsername(username string) ([]*AuditEvent, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var events []*AuditEvent
+	for _, event := range m.auditEvents {
+		if event.Username == username {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+	return events, nil
+}
+
+// CreateInvite stores a new invite token
+func (m *MemoryDB) CreateInvite(token, createdBy string, expiresAt time.Time, singleUse bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, exists := m.invites[token]; exists {
+		return fmt.Errorf("failed to create invite: token already exists")
+	}
+
+	m.invites[token] = &Invite{
+		Token:     token,
+		CreatedBy: createdBy,
+		Created:   time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+		SingleUse: singleUse,
+	}
+	return nil
+}
+
+// CheckInvite validates an invite token without using it up
+func (m *MemoryDB) CheckInvite(token string) (*Invite, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	invite, exists := m.invites[token]
+	if !exists {
+		return nil, ErrInviteNotFound
+	}
+	if invite.Consumed {
+		return nil, ErrInviteConsumed
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+
+	copied := *invite
+	return &copied, nil
+}
+
+// ConsumeInvite validates an invite token, marking single-use invites as used
+func (m *MemoryDB) ConsumeInvite(token string) (*Invite, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	invite, exists := m.invites[token]
+	if !exists {
+		return nil, ErrInviteNotFound
+	}
+	if invite.Consumed {
+		return nil, ErrInviteConsumed
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+
+	if invite.SingleUse {
+		invite.Consumed = true
+	}
+	copied := *invite
+	return &copied, nil
+}
+
+// DeleteUserData removes a user together with their credentials, sessions and audit events
+func (m *MemoryDB) DeleteUserData(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	user := m.findUser(username)
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	for id, cred := range m.credentials {
+		if cred.UserID == user.ID {
+			delete(m.credentials, id)
+		}
+	}
+	for id, session := range m.sessions {
+		if session.UserID == user.ID {
+			delete(m.sessions, id)
+		}
+	}
+	var kept []*AuditEvent
+	for _, event := range m.auditEvents {
+		if event.Username != username {
+			kept = append(kept, event)
+		}
+	}
+	m.auditEvents = kept
+	delete(m.users, user.ID)
+	return nil
+}
+
+// Close is a no-op for the in-memory database
+func (m *MemoryDB) Close() error {
+	return nil
+}
+
+// Healthy always reports true: memory can't become unavailable
+func (m *MemoryDB) Healthy() bool {
+	return true
+}
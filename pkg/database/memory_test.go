@@ -0,0 +1,12 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestMemoryDatabase(t *testing.T) {
+	db := NewMemory()
+	defer db.Close()
+
+	testDatabase(t, db)
+}
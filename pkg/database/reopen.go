@@ -0,0 +1,109 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reopen settings: after this many consecutive failures the database file is reopened,
+// waiting longer between attempts while it keeps failing
+var (
+	reopenAfterFailures = 3
+	reopenBackoff       = time.Second
+	maxReopenBackoff    = time.Minute
+)
+
+// healthState tracks consecutive failures of health checks and transactions
+type healthState struct {
+	mutex      sync.Mutex
+	failures   int           // Consecutive failures
+	backoff    time.Duration // Wait after the last reopen attempt, 0 before the first
+	nextReopen time.Time
+}
+
+// handle returns the current connection pool
+func (s *SQLiteDB) handle() *sql.DB {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db
+}
+
+// Healthy checks that the database file can be queried. Repeated failures reopen it,
+// so a readiness probe polling this also drives recovery.
+func (s *SQLiteDB) Healthy() bool {
+	var version int
+	err := s.handle().QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	s.recordResult(err)
+	return err == nil
+}
+
+// recordResult counts consecutive failures and reopens the database once there are enough,
+// backing off between attempts
+func (s *SQLiteDB) recordResult(err error) {
+	h := &s.health
+	h.mutex.Lock()
+	if err == nil {
+		h.failures = 0
+		h.backoff = 0
+		h.mutex.Unlock()
+		return
+	}
+
+	h.failures++
+	failures := h.failures
+	if failures < reopenAfterFailures || time.Now().Before(h.nextReopen) {
+		h.mutex.Unlock()
+		return
+	}
+	if h.backoff == 0 {
+		h.backoff = reopenBackoff
+	} else {
+		h.backoff = min(h.backoff*2, maxReopenBackoff)
+	}
+	h.nextReopen = time.Now().Add(h.backoff)
+	h.mutex.Unlock()
+
+	log.Printf("Database failed %d times in a row, reopening: %v", failures, err)
+	if err := s.reopen(); err != nil {
+		log.Printf("Failed to reopen database: %v", err)
+	}
+}
+
+// reopen opens the database file again and swaps it in once its schema is up to date.
+// A file without a schema was lost or replaced, so it is refused rather than migrated into
+// an empty database; the server stays unhealthy until an operator restores it.
+func (s *SQLiteDB) reopen() error {
+	db, err := sql.Open("sqlite", s.dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to read schema version, refusing to serve an empty database: %v", err)
+	}
+	if version == 0 {
+		db.Close()
+		return fmt.Errorf("database has no schema, refusing to serve an empty database")
+	}
+
+	// Apply any migrations the file is missing before serving queries from it
+	fresh := &SQLiteDB{db: db}
+	if err := fresh.migrate(migrations); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to initialize database: %v", err)
+	}
+
+	s.mutex.Lock()
+	old := s.db
+	s.db = db
+	s.mutex.Unlock()
+
+	old.Close()
+	log.Printf("Database reopened")
+	return nil
+}
@@ -0,0 +1,60 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Retry settings for writes that still find the database locked after busy_timeout,
+// e.g. while the other server binary holds a long write transaction
+const (
+	busyRetries = 5
+	busyBackoff = 20 * time.Millisecond
+)
+
+// isBusy reports whether an error is SQLite's "database is locked"
+func isBusy(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "SQLITE_BUSY") || strings.Contains(msg, "database is locked")
+}
+
+// retryOnBusy runs op, retrying with exponential backoff while the database is locked
+func retryOnBusy(op func() error) error {
+	backoff := busyBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isBusy(err) || attempt == busyRetries {
+			return err
+		}
+		log.Printf("Database locked, retrying in %v (attempt %d/%d)", backoff, attempt, busyRetries)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// exec runs a write statement, retrying while the database is locked
+func (s *SQLiteDB) exec(query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := retryOnBusy(func() error {
+		var err error
+		result, err = s.handle().Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// begin starts a write transaction, retrying while the database is locked
+func (s *SQLiteDB) begin() (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := retryOnBusy(func() error {
+		var err error
+		tx, err = s.handle().Begin()
+		return err
+	})
+	if err == nil || !isBusy(err) {
+		s.recordResult(err)
+	}
+	return tx, err
+}
@@ -4,23 +4,37 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"time"
 
 	_ "modernc.org/sqlite"
 )
 
 // SQLiteDB implements the Database interface using SQLite
 type SQLiteDB struct {
-	db *sql.DB
+	db     *sql.DB
+	dsn    string       // Data source name, kept to reopen the database
+	mutex  sync.RWMutex // Guards db while reopen swaps it, and batch
+	health healthState
+	batch  *writeBatch // Optional write batching, nil when disabled
 }
 
 // NewSQLite creates a new SQLite database connection
 func NewSQLite(dbPath string) (*SQLiteDB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Wait for locks held by other connections (batched flushes, the other server binary).
+	// Transactions take the write lock up front, so they wait too instead of failing on upgrade.
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+	dsn := dbPath + separator + "_pragma=busy_timeout(5000)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	sqliteDB := &SQLiteDB{db: db}
+	sqliteDB := &SQLiteDB{db: db, dsn: dsn}
 
 	// Initialize the database with tables
 	if err := sqliteDB.Init(); err != nil {
@@ -31,8 +45,36 @@ func NewSQLite(dbPath string) (*SQLiteDB, error) {
 	return sqliteDB, nil
 }
 
-// Init creates the database tables
+// Init brings the database schema up to date by applying any pending migrations
 func (s *SQLiteDB) Init() error {
+	if err := s.migrate(migrations); err != nil {
+		return err
+	}
+
+	log.Println("Database initialized successfully")
+	return nil
+}
+
+// migration is one step in the schema's history. Migrations are applied in order and never edited
+// once released; schema changes go in a new migration appended to the list.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations lists every schema change, oldest first
+var migrations = []migration{
+	{1, "create tables", createTables},
+	{2, "add webauthn_credentials.device_label", func(tx *sql.Tx) error {
+		// Databases created before device_label existed have the table without it
+		return addColumnIfMissing(tx, "webauthn_credentials", "device_label", "TEXT")
+	}},
+}
+
+// createTables creates the original schema. Tables may already exist in databases that predate
+// schema versioning, so every statement tolerates that.
+func createTables(tx *sql.Tx) error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -59,20 +101,120 @@ func (s *SQLiteDB) Init() error {
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (user_id) REFERENCES users (id)
 		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event TEXT NOT NULL,
+			username TEXT NOT NULL,
+			remote_ip TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS invites (
+			token TEXT PRIMARY KEY,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			single_use BOOLEAN DEFAULT TRUE,
+			consumed BOOLEAN DEFAULT FALSE
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)`,
 		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_sessions_expires_at ON sessions(expires_at)`,
 		`CREATE INDEX IF NOT EXISTS idx_credentials_user_id ON webauthn_credentials(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_credentials_credential_id ON webauthn_credentials(credential_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at)`,
 	}
 
 	for _, query := range queries {
-		if _, err := s.db.Exec(query); err != nil {
+		if _, err := tx.Exec(query); err != nil {
 			return fmt.Errorf("failed to execute query: %v", err)
 		}
 	}
+	return nil
+}
 
-	log.Println("Database initialized successfully")
+// migrate applies each migration newer than the database's schema version, each in its own
+// transaction together with the version bump, so a failed step leaves the previous version intact
+func (s *SQLiteDB) migrate(steps []migration) error {
+	if _, err := s.handle().Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+
+	for _, step := range steps {
+		if err := s.applyMigration(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a migration unless the database already has it. The version is read inside
+// the transaction, so servers starting together against one file don't apply a step twice.
+func (s *SQLiteDB) applyMigration(step migration) error {
+	tx, err := s.handle().Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d: %v", step.version, err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if version >= step.version {
+		return nil
+	}
+
+	if err := step.apply(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %v", step.version, step.description, err)
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, description) VALUES (?, ?)", step.version, step.description); err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", step.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migration %d: %v", step.version, err)
+	}
+
+	log.Printf("Applied migration %d: %s", step.version, step.description)
+	return nil
+}
+
+// schemaVersion returns the newest migration applied to the database
+func (s *SQLiteDB) schemaVersion() (int, error) {
+	var version int
+	if err := s.handle().QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return version, nil
+}
+
+// addColumnIfMissing adds a column to an existing table unless it is already there
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect table %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return fmt.Errorf("failed to inspect table %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %v", table, column, err)
+	}
 	return nil
 }
 
@@ -80,7 +222,7 @@ func (s *SQLiteDB) Init() error {
 func (s *SQLiteDB) CreateUser(username string) (*User, error) {
 	query := `INSERT INTO users (username, created_at, last_login) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`
 
-	result, err := s.db.Exec(query, username)
+	result, err := s.exec(query, username)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create user: %v", err)
 	}
@@ -100,7 +242,7 @@ func (s *SQLiteDB) GetUser(username string) (*User, error) {
 
 	var user User
 	var passkeyID, publicKey sql.NullString
-	err := s.db.QueryRow(query, username).Scan(
+	err := s.handle().QueryRow(query, username).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Created,
@@ -135,7 +277,7 @@ func (s *SQLiteDB) GetUserByID(id int) (*User, error) {
 
 	var user User
 	var passkeyID, publicKey sql.NullString
-	err := s.db.QueryRow(query, id).Scan(
+	err := s.handle().QueryRow(query, id).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Created,
@@ -168,7 +310,7 @@ func (s *SQLiteDB) GetAllUsers() ([]*User, error) {
 	query := `SELECT id, username, created_at, last_login, passkey_id, public_key, is_registered 
 			  FROM users ORDER BY username`
 
-	rows, err := s.db.Query(query)
+	rows, err := s.handle().Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all users: %v", err)
 	}
@@ -209,7 +351,7 @@ func (s *SQLiteDB) GetAllUsers() ([]*User, error) {
 func (s *SQLiteDB) UpdateUserLastLogin(username string) error {
 	query := `UPDATE users SET last_login = CURRENT_TIMESTAMP WHERE username = ?`
 
-	result, err := s.db.Exec(query, username)
+	result, err := s.exec(query, username)
 	if err != nil {
 		return fmt.Errorf("failed to update last login: %v", err)
 	}
@@ -230,7 +372,7 @@ func (s *SQLiteDB) UpdateUserLastLogin(username string) error {
 func (s *SQLiteDB) UpdateUserPasskeyID(username, passkeyID string) error {
 	query := `UPDATE users SET passkey_id = ? WHERE username = ?`
 
-	result, err := s.db.Exec(query, passkeyID, username)
+	result, err := s.exec(query, passkeyID, username)
 	if err != nil {
 		return fmt.Errorf("failed to update passkey ID: %v", err)
 	}
@@ -251,7 +393,7 @@ func (s *SQLiteDB) UpdateUserPasskeyID(username, passkeyID string) error {
 func (s *SQLiteDB) UpdateUserPublicKey(username, publicKey string) error {
 	query := `UPDATE users SET public_key = ? WHERE username = ?`
 
-	result, err := s.db.Exec(query, publicKey, username)
+	result, err := s.exec(query, publicKey, username)
 	if err != nil {
 		return fmt.Errorf("failed to update public key: %v", err)
 	}
@@ -272,7 +414,7 @@ func (s *SQLiteDB) UpdateUserPublicKey(username, publicKey string) error {
 func (s *SQLiteDB) SetUserRegistered(username string, registered bool) error {
 	query := `UPDATE users SET is_registered = ? WHERE username = ?`
 
-	result, err := s.db.Exec(query, registered, username)
+	result, err := s.exec(query, registered, username)
 	if err != nil {
 		return fmt.Errorf("failed to set user registered: %v", err)
 	}
@@ -289,6 +431,32 @@ func (s *SQLiteDB) SetUserRegistered(username string, registered bool) error {
 	return nil
 }
 
+// ClaimUserRegistration marks an unregistered user registered, returning false if they already were
+func (s *SQLiteDB) ClaimUserRegistration(username string) (bool, error) {
+	result, err := s.exec(`UPDATE users SET is_registered = 1 WHERE username = ? AND is_registered = 0`, username)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim user registration: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %v", err)
+	}
+	if rowsAffected == 1 {
+		return true, nil
+	}
+
+	// Nothing changed: tell an already registered user from a missing one
+	user, err := s.GetUser(username)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, fmt.Errorf("user not found: %s", username)
+	}
+	return false, nil
+}
+
 // FindUserByPasskeyID finds a user by their passkey ID
 func (s *SQLiteDB) FindUserByPasskeyID(passkeyID string) (*User, error) {
 	query := `SELECT id, username, created_at, last_login, passkey_id, public_key, is_registered 
@@ -296,7 +464,7 @@ func (s *SQLiteDB) FindUserByPasskeyID(passkeyID string) (*User, error) {
 
 	var user User
 	var userPasskeyID, publicKey sql.NullString
-	err := s.db.QueryRow(query, passkeyID).Scan(
+	err := s.handle().QueryRow(query, passkeyID).Scan(
 		&user.ID,
 		&user.Username,
 		&user.Created,
@@ -324,8 +492,8 @@ func (s *SQLiteDB) FindUserByPasskeyID(passkeyID string) (*User, error) {
 	return &user, nil
 }
 
-// CreateSession creates a new session
-func (s *SQLiteDB) CreateSession(sessionID, username string) error {
+// CreateSession creates a new session that expires after ttl
+func (s *SQLiteDB) CreateSession(sessionID, username string, ttl time.Duration) error {
 	// First get the user ID
 	user, err := s.GetUser(username)
 	if err != nil {
@@ -336,9 +504,9 @@ func (s *SQLiteDB) CreateSession(sessionID, username string) error {
 	}
 
 	query := `INSERT INTO sessions (id, user_id, username, created_at, expires_at) 
-			  VALUES (?, ?, ?, CURRENT_TIMESTAMP, datetime('now', '+24 hours'))`
+			  VALUES (?, ?, ?, CURRENT_TIMESTAMP, datetime('now', ?))`
 
-	_, err = s.db.Exec(query, sessionID, user.ID, username)
+	_, err = s.exec(query, sessionID, user.ID, username, fmt.Sprintf("+%d seconds", int64(ttl/time.Second)))
 	if err != nil {
 		return fmt.Errorf("failed to create session: %v", err)
 	}
@@ -351,7 +519,7 @@ func (s *SQLiteDB) GetSession(sessionID string) (*Session, error) {
 	query := `SELECT id, user_id, username, created_at, expires_at FROM sessions WHERE id = ?`
 
 	var session Session
-	err := s.db.QueryRow(query, sessionID).Scan(
+	err := s.handle().QueryRow(query, sessionID).Scan(
 		&session.ID,
 		&session.UserID,
 		&session.Username,
@@ -369,11 +537,40 @@ func (s *SQLiteDB) GetSession(sessionID string) (*Session, error) {
 	return &session, nil
 }
 
+// GetSessionsByUserID retrieves all sessions of a user, oldest first
+func (s *SQLiteDB) GetSessionsByUserID(userID int) ([]*Session, error) {
+	query := `SELECT id, user_id, username, created_at, expires_at FROM sessions WHERE user_id = ? ORDER BY created_at`
+
+	rows, err := s.handle().Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.Username,
+			&session.Created,
+			&session.ExpiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan session: %v", err)
+		}
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
 // DeleteSession deletes a session
 func (s *SQLiteDB) DeleteSession(sessionID string) error {
 	query := `DELETE FROM sessions WHERE id = ?`
 
-	result, err := s.db.Exec(query, sessionID)
+	result, err := s.exec(query, sessionID)
 	if err != nil {
 		return fmt.Errorf("failed to delete session: %v", err)
 	}
@@ -394,7 +591,7 @@ func (s *SQLiteDB) DeleteSession(sessionID string) error {
 func (s *SQLiteDB) CleanupExpiredSessions() error {
 	query := `DELETE FROM sessions WHERE expires_at < CURRENT_TIMESTAMP`
 
-	result, err := s.db.Exec(query)
+	result, err := s.exec(query)
 	if err != nil {
 		return fmt.Errorf("failed to cleanup expired sessions: %v", err)
 	}
@@ -412,11 +609,11 @@ func (s *SQLiteDB) CleanupExpiredSessions() error {
 }
 
 // StoreCredential stores a WebAuthn credential
-func (s *SQLiteDB) StoreCredential(userID int, credentialID, publicKey string) error {
-	query := `INSERT INTO webauthn_credentials (user_id, credential_id, public_key, created_at) 
-			  VALUES (?, ?, ?, CURRENT_TIMESTAMP)`
+func (s *SQLiteDB) StoreCredential(userID int, credentialID, publicKey, deviceLabel string) error {
+	query := `INSERT INTO webauthn_credentials (user_id, credential_id, public_key, device_label, created_at) 
+			  VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)`
 
-	_, err := s.db.Exec(query, userID, credentialID, publicKey)
+	_, err := s.exec(query, userID, credentialID, publicKey, deviceLabel)
 	if err != nil {
 		return fmt.Errorf("failed to store credential: %v", err)
 	}
@@ -426,15 +623,17 @@ func (s *SQLiteDB) StoreCredential(userID int, credentialID, publicKey string) e
 
 // GetCredential retrieves a WebAuthn credential by ID
 func (s *SQLiteDB) GetCredential(credentialID string) (*WebAuthnCredential, error) {
-	query := `SELECT id, user_id, credential_id, public_key, created_at 
+	query := `SELECT id, user_id, credential_id, public_key, device_label, created_at 
 			  FROM webauthn_credentials WHERE credential_id = ?`
 
 	var cred WebAuthnCredential
-	err := s.db.QueryRow(query, credentialID).Scan(
+	var deviceLabel sql.NullString
+	err := s.handle().QueryRow(query, credentialID).Scan(
 		&cred.ID,
 		&cred.UserID,
 		&cred.CredentialID,
 		&cred.PublicKey,
+		&deviceLabel,
 		&cred.Created,
 	)
 
@@ -444,16 +643,53 @@ func (s *SQLiteDB) GetCredential(credentialID string) (*WebAuthnCredential, erro
 	if err != nil {
 		return nil, fmt.Errorf("failed to get credential: %v", err)
 	}
+	cred.DeviceLabel = deviceLabel.String
 
 	return &cred, nil
 }
 
+// FindUserByCredentialHandle finds the owner of a credential, provided the user handle names them
+func (s *SQLiteDB) FindUserByCredentialHandle(credentialID string, userHandle []byte) (*User, error) {
+	query := `SELECT u.id, u.username, u.created_at, u.last_login, u.passkey_id, u.public_key, u.is_registered 
+			  FROM webauthn_credentials c JOIN users u ON u.id = c.user_id
+			  WHERE c.credential_id = ? AND u.username = ?`
+
+	var user User
+	var passkeyID, publicKey sql.NullString
+	err := s.handle().QueryRow(query, credentialID, string(userHandle)).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Created,
+		&user.LastLogin,
+		&passkeyID,
+		&publicKey,
+		&user.IsRegistered,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find user by credential handle: %v", err)
+	}
+
+	// Handle NULL values
+	if passkeyID.Valid {
+		user.PasskeyID = passkeyID.String
+	}
+	if publicKey.Valid {
+		user.PublicKey = publicKey.String
+	}
+
+	return &user, nil
+}
+
 // GetCredentialsByUserID retrieves all credentials for a user
 func (s *SQLiteDB) GetCredentialsByUserID(userID int) ([]*WebAuthnCredential, error) {
-	query := `SELECT id, user_id, credential_id, public_key, created_at 
-			  FROM webauthn_credentials WHERE user_id = ?`
+	query := `SELECT id, user_id, credential_id, public_key, device_label, created_at 
+			  FROM webauthn_credentials WHERE user_id = ? ORDER BY id`
 
-	rows, err := s.db.Query(query, userID)
+	rows, err := s.handle().Query(query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get credentials: %v", err)
 	}
@@ -462,23 +698,276 @@ func (s *SQLiteDB) GetCredentialsByUserID(userID int) ([]*WebAuthnCredential, er
 	var credentials []*WebAuthnCredential
 	for rows.Next() {
 		var cred WebAuthnCredential
+		var deviceLabel sql.NullString
 		err := rows.Scan(
 			&cred.ID,
 			&cred.UserID,
 			&cred.CredentialID,
 			&cred.PublicKey,
+			&deviceLabel,
 			&cred.Created,
 		)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan credential: %v", err)
 		}
+		cred.DeviceLabel = deviceLabel.String
 		credentials = append(credentials, &cred)
 	}
 
 	return credentials, nil
 }
 
+// UpdateCredential replaces a WebAuthn credential's stored data
+func (s *SQLiteDB) UpdateCredential(credentialID, publicKey string) error {
+	result, err := s.exec(`UPDATE webauthn_credentials SET public_key = ? WHERE credential_id = ?`, publicKey, credentialID)
+	if err != nil {
+		return fmt.Errorf("failed to update credential: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrCredentialNotFound
+	}
+
+	return nil
+}
+
+// DeleteCredential removes a WebAuthn credential
+func (s *SQLiteDB) DeleteCredential(credentialID string) error {
+	query := `DELETE FROM webauthn_credentials WHERE credential_id = ?`
+
+	result, err := s.exec(query, credentialID)
+	if err != nil {
+		return fmt.Errorf("failed to delete credential: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %v", err)
+	}
+
+	if rowsAffected == 0 {
+		return ErrCredentialNotFound
+	}
+
+	return nil
+}
+
+// RecordAuditEvent stores an authentication audit event
+func (s *SQLiteDB) RecordAuditEvent(event, username, remoteIP string) error {
+	if s.queueAuditEvent(pendingAuditEvent{event: event, username: username, remoteIP: remoteIP}) {
+		return nil
+	}
+
+	query := `INSERT INTO audit_log (event, username, remote_ip, created_at) 
+			  VALUES (?, ?, ?, CURRENT_TIMESTAMP)`
+
+	_, err := s.exec(query, event, username, remoteIP)
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %v", err)
+	}
+
+	return nil
+}
+
+// GetRecentAuditEvents retrieves the most recent audit events, newest first
+func (s *SQLiteDB) GetRecentAuditEvents(limit int) ([]*AuditEvent, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, event, username, remote_ip, created_at 
+			  FROM audit_log ORDER BY id DESC LIMIT ?`
+
+	rows, err := s.handle().Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %v", err)
+	}
+	return scanAuditEvents(rows)
+}
+
+// GetAuditEventsByUsername retrieves every audit event recorded for a user, oldest first
+func (s *SQLiteDB) GetAuditEventsByUsername(username string) ([]*AuditEvent, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, event, username, remote_ip, created_at 
+			  FROM audit_log WHERE username = ? ORDER BY id`
+
+	rows, err := s.handle().Query(query, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get audit events: %v", err)
+	}
+	return scanAuditEvents(rows)
+}
+
+// scanAuditEvents reads audit_log rows, closing them when done
+func scanAuditEvents(rows *sql.Rows) ([]*AuditEvent, error) {
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.Event,
+			&event.Username,
+			&event.RemoteIP,
+			&event.Created,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan audit event: %v", err)
+		}
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
+
+// CreateInvite stores a new invite token
+func (s *SQLiteDB) CreateInvite(token, createdBy string, expiresAt time.Time, singleUse bool) error {
+	query := `INSERT INTO invites (token, created_by, created_at, expires_at, single_use) 
+			  VALUES (?, ?, CURRENT_TIMESTAMP, ?, ?)`
+
+	_, err := s.exec(query, token, createdBy, expiresAt.UTC(), singleUse)
+	if err != nil {
+		return fmt.Errorf("failed to create invite: %v", err)
+	}
+
+	return nil
+}
+
+// CheckInvite validates an invite token without using it up
+func (s *SQLiteDB) CheckInvite(token string) (*Invite, error) {
+	query := `SELECT token, created_by, created_at, expires_at, single_use, consumed FROM invites WHERE token = ?`
+
+	var invite Invite
+	err := s.handle().QueryRow(query, token).Scan(
+		&invite.Token,
+		&invite.CreatedBy,
+		&invite.Created,
+		&invite.ExpiresAt,
+		&invite.SingleUse,
+		&invite.Consumed,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invite: %v", err)
+	}
+
+	if invite.Consumed {
+		return nil, ErrInviteConsumed
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+
+	return &invite, nil
+}
+
+// ConsumeInvite validates an invite token, marking single-use invites as used
+func (s *SQLiteDB) ConsumeInvite(token string) (*Invite, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT token, created_by, created_at, expires_at, single_use, consumed FROM invites WHERE token = ?`
+
+	var invite Invite
+	err = tx.QueryRow(query, token).Scan(
+		&invite.Token,
+		&invite.CreatedBy,
+		&invite.Created,
+		&invite.ExpiresAt,
+		&invite.SingleUse,
+		&invite.Consumed,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get invite: %v", err)
+	}
+
+	if invite.Consumed {
+		return nil, ErrInviteConsumed
+	}
+	if time.Now().After(invite.ExpiresAt) {
+		return nil, ErrInviteExpired
+	}
+
+	if invite.SingleUse {
+		if _, err := tx.Exec(`UPDATE invites SET consumed = TRUE WHERE token = ?`, token); err != nil {
+			return nil, fmt.Errorf("failed to consume invite: %v", err)
+		}
+		invite.Consumed = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit invite: %v", err)
+	}
+
+	return &invite, nil
+}
+
+// DeleteUserData removes a user together with their credentials, sessions and audit events
+func (s *SQLiteDB) DeleteUserData(username string) error {
+	// Queued audit events must be written before they can be deleted
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get user: %v", err)
+	}
+
+	queries := []struct {
+		query string
+		arg   any
+	}{
+		{`DELETE FROM webauthn_credentials WHERE user_id = ?`, userID},
+		{`DELETE FROM sessions WHERE user_id = ?`, userID},
+		{`DELETE FROM audit_log WHERE username = ?`, username},
+		{`DELETE FROM users WHERE id = ?`, userID},
+	}
+	for _, q := range queries {
+		if _, err := tx.Exec(q.query, q.arg); err != nil {
+			return fmt.Errorf("failed to delete user data: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit user data deletion: %v", err)
+	}
+	return nil
+}
+
 // Close closes the database connection
 func (s *SQLiteDB) Close() error {
-	return s.db.Close()
+	if err := s.stopWriteBatching(); err != nil {
+		log.Printf("Failed to flush batched writes on close: %v", err)
+	}
+	return s.handle().Close()
 }
@@ -1,14 +1,21 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSQLiteDatabase(t *testing.T) {
 	// Use a temporary database file
-	dbPath := "test_chapp.db"
-	defer os.Remove(dbPath)
+	dbPath := filepath.Join(t.TempDir(), "test_chapp.db")
 
 	// Create database
 	db, err := NewSQLite(dbPath)
@@ -17,132 +24,647 @@ func TestSQLiteDatabase(t *testing.T) {
 	}
 	defer db.Close()
 
-	// Test user creation
-	user, err := db.CreateUser("testuser")
+	testDatabase(t, db)
+}
+
+func TestWriteBatching(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_batch.db")
+
+	db, err := NewSQLite(dbPath)
 	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// Use a long interval so only explicit and read-triggered flushes happen
+	db.EnableWriteBatching(time.Hour)
+
+	if _, err := db.CreateUser("batchuser"); err != nil {
 		t.Fatalf("Failed to create user: %v", err)
 	}
 
-	if user == nil {
-		t.Fatal("User should not be nil")
+	// Sessions are written immediately, so another process sees them without a flush
+	if err := db.CreateSession("batched-session", "batchuser", time.Hour); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	other, err := NewSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open second handle: %v", err)
+	}
+	defer other.Close()
+	session, err := other.GetSession("batched-session")
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	if session == nil || session.Username != "batchuser" {
+		t.Fatalf("Expected the session to be visible to another handle, got %+v", session)
 	}
 
-	if user.Username != "testuser" {
-		t.Errorf("Expected username 'testuser', got '%s'", user.Username)
+	// Audit events are queued, and reads see their own queued writes
+	if err := db.RecordAuditEvent("login_success", "batchuser", "192.0.2.1"); err != nil {
+		t.Fatalf("Failed to record audit event: %v", err)
+	}
+	if events, err := other.GetRecentAuditEvents(10); err != nil || len(events) != 0 {
+		t.Errorf("Expected the audit event to be queued, got %d events (%v)", len(events), err)
 	}
 
-	if user.ID == 0 {
-		t.Error("User ID should not be zero")
+	events, err := db.GetRecentAuditEvents(10)
+	if err != nil {
+		t.Fatalf("Failed to get audit events: %v", err)
 	}
+	if len(events) != 1 {
+		t.Errorf("Expected 1 audit event, got %d", len(events))
+	}
+}
 
-	// Test user retrieval
-	retrievedUser, err := db.GetUser("testuser")
+func TestWriteBatchingDropsFailedFlush(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test_batch_failure.db"))
 	if err != nil {
-		t.Fatalf("Failed to get user: %v", err)
+		t.Fatalf("Failed to create database: %v", err)
 	}
+	defer db.Close()
+	db.EnableWriteBatching(time.Hour)
 
-	if retrievedUser == nil {
-		t.Fatal("Retrieved user should not be nil")
+	// Hide the audit table so the batch fails to write
+	if _, err := db.handle().Exec("ALTER TABLE audit_log RENAME TO audit_log_hidden"); err != nil {
+		t.Fatalf("Failed to rename audit table: %v", err)
+	}
+	if err := db.RecordAuditEvent("login_failure", "", "192.0.2.1"); err != nil {
+		t.Fatalf("Failed to record audit event: %v", err)
+	}
+	if err := db.Flush(); err == nil || !strings.Contains(err.Error(), "dropped 1 batched audit events") {
+		t.Fatalf("Expected the failed flush to report the dropped event, got %v", err)
+	}
+	if _, err := db.handle().Exec("ALTER TABLE audit_log_hidden RENAME TO audit_log"); err != nil {
+		t.Fatalf("Failed to restore audit table: %v", err)
 	}
 
-	if retrievedUser.Username != "testuser" {
-		t.Errorf("Expected username 'testuser', got '%s'", retrievedUser.Username)
+	// The failed batch is gone, so later events flush normally
+	if err := db.RecordAuditEvent("login_success", "batchuser", "192.0.2.1"); err != nil {
+		t.Fatalf("Failed to record audit event: %v", err)
+	}
+	events, err := db.GetRecentAuditEvents(10)
+	if err != nil {
+		t.Fatalf("Expected flushing to recover, got %v", err)
 	}
+	if len(events) != 1 || events[0].Event != "login_success" {
+		t.Errorf("Expected only the later event, got %+v", events)
+	}
+}
 
-	// Test session creation
-	sessionID := "test-session-id"
-	err = db.CreateSession(sessionID, "testuser")
+// benchmarkRecordAuditEvent measures audit insert throughput with optional batching
+func benchmarkRecordAuditEvent(b *testing.B, batched bool) {
+	dbPath := filepath.Join(b.TempDir(), "bench.db")
+
+	db, err := NewSQLite(dbPath)
 	if err != nil {
-		t.Fatalf("Failed to create session: %v", err)
+		b.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	if batched {
+		db.EnableWriteBatching(10 * time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.RecordAuditEvent("login_success", fmt.Sprintf("user-%d", i), "192.0.2.1"); err != nil {
+			b.Fatalf("Failed to record audit event: %v", err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		b.Fatalf("Failed to flush: %v", err)
 	}
+}
+
+func BenchmarkRecordAuditEvent(b *testing.B) {
+	benchmarkRecordAuditEvent(b, false)
+}
 
-	// Test session retrieval
-	session, err := db.GetSession(sessionID)
+func BenchmarkRecordAuditEventBatched(b *testing.B) {
+	benchmarkRecordAuditEvent(b, true)
+}
+
+func TestSQLiteAddsDeviceLabelColumn(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_migrate.db")
+
+	// Create a credentials table as older releases did, without device_label
+	raw, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		t.Fatalf("Failed to get session: %v", err)
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = raw.Exec(`CREATE TABLE webauthn_credentials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		credential_id TEXT UNIQUE NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatalf("Failed to create old table: %v", err)
+	}
+	if _, err := raw.Exec(`INSERT INTO webauthn_credentials (user_id, credential_id, public_key) VALUES (1, 'old-credential', 'key')`); err != nil {
+		t.Fatalf("Failed to insert old credential: %v", err)
 	}
+	raw.Close()
 
-	if session == nil {
-		t.Fatal("Session should not be nil")
+	db, err := NewSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
 	}
+	defer db.Close()
 
-	if session.ID != sessionID {
-		t.Errorf("Expected session ID '%s', got '%s'", sessionID, session.ID)
+	credential, err := db.GetCredential("old-credential")
+	if err != nil {
+		t.Fatalf("Failed to get old credential: %v", err)
+	}
+	if credential == nil || credential.DeviceLabel != "" {
+		t.Errorf("Expected old credential without a label, got %+v", credential)
 	}
 
-	if session.Username != "testuser" {
-		t.Errorf("Expected username 'testuser', got '%s'", session.Username)
+	if err := db.StoreCredential(1, "new-credential", "key", "Phone"); err != nil {
+		t.Errorf("Failed to store labelled credential after migration: %v", err)
 	}
+}
 
-	// Test session deletion
-	err = db.DeleteSession(sessionID)
+// columnNames returns the columns of a table
+func columnNames(t *testing.T, db *SQLiteDB, table string) []string {
+	t.Helper()
+	rows, err := db.db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
 	if err != nil {
-		t.Fatalf("Failed to delete session: %v", err)
+		t.Fatalf("Failed to inspect table %s: %v", table, err)
 	}
+	defer rows.Close()
 
-	// Verify session is deleted
-	deletedSession, err := db.GetSession(sessionID)
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatalf("Failed to scan column name: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_migrate_empty.db")
+
+	db, err := NewSQLite(dbPath)
 	if err != nil {
-		t.Fatalf("Failed to get deleted session: %v", err)
+		t.Fatalf("Failed to create database: %v", err)
 	}
 
-	if deletedSession != nil {
-		t.Error("Session should be nil after deletion")
+	latest := migrations[len(migrations)-1].version
+	if version, err := db.schemaVersion(); err != nil || version != latest {
+		t.Fatalf("Expected schema version %d, got %d (%v)", latest, version, err)
+	}
+	if columns := columnNames(t, db, "webauthn_credentials"); !slices.Contains(columns, "device_label") {
+		t.Errorf("Expected device_label column, got %v", columns)
 	}
+	db.Close()
 
-	// Test user update
-	err = db.UpdateUserLastLogin("testuser")
+	// Reopening an up-to-date database applies nothing
+	db, err = NewSQLite(dbPath)
 	if err != nil {
-		t.Fatalf("Failed to update user last login: %v", err)
+		t.Fatalf("Failed to reopen database: %v", err)
 	}
+	defer db.Close()
 
-	// Test passkey ID update
-	err = db.UpdateUserPasskeyID("testuser", "test-passkey-id")
+	var applied int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&applied); err != nil {
+		t.Fatalf("Failed to count migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Errorf("Expected %d recorded migrations, got %d", len(migrations), applied)
+	}
+}
+
+func TestMigrateFromPriorVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_migrate_prior.db")
+
+	raw, err := sql.Open("sqlite", dbPath)
 	if err != nil {
-		t.Fatalf("Failed to update passkey ID: %v", err)
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	old := &SQLiteDB{db: raw}
+	if err := old.migrate(migrations[:1]); err != nil {
+		t.Fatalf("Failed to apply first migration: %v", err)
 	}
+	if version, _ := old.schemaVersion(); version != 1 {
+		t.Fatalf("Expected schema version 1, got %d", version)
+	}
+	if _, err := raw.Exec(`INSERT INTO webauthn_credentials (user_id, credential_id, public_key) VALUES (1, 'old-credential', 'key')`); err != nil {
+		t.Fatalf("Failed to insert old credential: %v", err)
+	}
+	raw.Close()
 
-	// Test finding user by passkey ID
-	foundUser, err := db.FindUserByPasskeyID("test-passkey-id")
+	db, err := NewSQLite(dbPath)
 	if err != nil {
-		t.Fatalf("Failed to find user by passkey ID: %v", err)
+		t.Fatalf("Failed to migrate database: %v", err)
 	}
+	defer db.Close()
 
-	if foundUser == nil {
-		t.Fatal("User should be found by passkey ID")
+	latest := migrations[len(migrations)-1].version
+	if version, err := db.schemaVersion(); err != nil || version != latest {
+		t.Errorf("Expected schema version %d, got %d (%v)", latest, version, err)
 	}
+	if err := db.StoreCredential(1, "new-credential", "key", "Phone"); err != nil {
+		t.Errorf("Failed to store labelled credential after migration: %v", err)
+	}
+	if credential, err := db.GetCredential("old-credential"); err != nil || credential == nil {
+		t.Errorf("Expected old credential to survive migration, got %+v (%v)", credential, err)
+	}
+}
 
-	if foundUser.Username != "testuser" {
-		t.Errorf("Expected username 'testuser', got '%s'", foundUser.Username)
+func TestMigrateFailureKeepsVersion(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_migrate_failure.db")
+
+	db, err := NewSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
 	}
+	defer db.Close()
+
+	latest := migrations[len(migrations)-1].version
+	broken := append(slices.Clone(migrations), migration{latest + 1, "broken", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("CREATE TABLE half_done (id INTEGER)"); err != nil {
+			return err
+		}
+		return errors.New("step failed")
+	}})
 
-	// Test credential storage
-	err = db.StoreCredential(user.ID, "test-credential-id", "test-public-key")
+	if err := db.migrate(broken); err == nil {
+		t.Fatal("Expected the broken migration to fail")
+	}
+	if version, _ := db.schemaVersion(); version != latest {
+		t.Errorf("Expected schema version to stay at %d, got %d", latest, version)
+	}
+	if columns := columnNames(t, db, "half_done"); len(columns) != 0 {
+		t.Errorf("Expected the failed migration to be rolled back, got table with %v", columns)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_contention.db")
+
+	// Two handles on one file, like the static and WebSocket servers
+	static, err := NewSQLite(dbPath)
 	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer static.Close()
+
+	websocket, err := NewSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open second handle: %v", err)
+	}
+	defer websocket.Close()
+
+	if _, err := static.CreateUser("busyuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := static.CreateInvite(fmt.Sprintf("invite-%d", i), "busyuser", time.Now().Add(time.Hour), true); err != nil {
+			t.Fatalf("Failed to create invite: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for name, db := range map[string]*SQLiteDB{"static": static, "websocket": websocket} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := db.CreateSession(fmt.Sprintf("%s-session-%d", name, i), "busyuser", time.Hour); err != nil {
+					errs <- err
+				}
+				if err := db.UpdateUserLastLogin("busyuser"); err != nil {
+					errs <- err
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// Both handles race for the same invites; exactly one wins each
+				if _, err := db.ConsumeInvite(fmt.Sprintf("invite-%d", i)); err != nil && !errors.Is(err, ErrInviteConsumed) {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Concurrent write failed: %v", err)
+	}
+
+	for _, name := range []string{"static", "websocket"} {
+		if session, err := static.GetSession(name + "-session-49"); err != nil || session == nil {
+			t.Errorf("Expected %s's last session to be stored, got %v, %v", name, session, err)
+		}
+	}
+}
+
+func TestConcurrentClose(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "test_close.db")
+
+	// Both servers shut down at the same time, each flushing its queued writes
+	handles := make([]*SQLiteDB, 2)
+	for i := range handles {
+		db, err := NewSQLite(dbPath)
+		if err != nil {
+			t.Fatalf("Failed to open handle %d: %v", i, err)
+		}
+		db.EnableWriteBatching(time.Hour)
+		handles[i] = db
+	}
+
+	if _, err := handles[0].CreateUser("closeuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	for i, db := range handles {
+		for j := 0; j < 50; j++ {
+			if err := db.CreateSession(fmt.Sprintf("handle-%d-session-%d", i, j), "closeuser", time.Hour); err != nil {
+				t.Fatalf("Failed to create session: %v", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(handles))
+	for _, db := range handles {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := db.Close(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	db, err := NewSQLite(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil || integrity != "ok" {
+		t.Fatalf("Expected integrity check to pass, got %q, %v", integrity, err)
+	}
+	var sessions int
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessions); err != nil {
+		t.Fatalf("Failed to count sessions: %v", err)
+	}
+	if sessions != 100 {
+		t.Errorf("Expected every queued session to be flushed, got %d", sessions)
+	}
+}
+
+func TestRetryOnBusy(t *testing.T) {
+	// Busy errors are retried until the operation succeeds
+	attempts := 0
+	err := retryOnBusy(func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("database is locked (5) (SQLITE_BUSY)")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected success on attempt 3, got %v after %d attempts", err, attempts)
+	}
+
+	// Other errors are returned immediately
+	attempts = 0
+	err = retryOnBusy(func() error {
+		attempts++
+		return errors.New("UNIQUE constraint failed")
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("Expected one attempt for a non-busy error, got %d", attempts)
+	}
+
+	// Persistent locks give up after busyRetries attempts
+	attempts = 0
+	err = retryOnBusy(func() error {
+		attempts++
+		return errors.New("database is locked")
+	})
+	if err == nil || attempts != busyRetries {
+		t.Errorf("Expected %d attempts before giving up, got %d", busyRetries, attempts)
+	}
+}
+
+func TestPreviewCleanup(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test_preview.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.CreateUser("previewuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	for _, sessionID := range []string{"live", "expired-1", "expired-2"} {
+		if err := db.CreateSession(sessionID, "previewuser", time.Hour); err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+	}
+	if _, err := db.db.Exec(`UPDATE sessions SET expires_at = datetime('now', '-1 hour') WHERE id LIKE 'expired-%'`); err != nil {
+		t.Fatalf("Failed to expire sessions: %v", err)
+	}
+
+	report, err := PreviewCleanup(db)
+	if err != nil {
+		t.Fatalf("Failed to preview cleanup: %v", err)
+	}
+	if report.ExpiredSessions != 2 {
+		t.Errorf("Expected 2 expired sessions, got %d", report.ExpiredSessions)
+	}
+
+	// The preview deletes nothing
+	stats, err := GetDatabaseStats(db)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats.SessionCount != 3 {
+		t.Errorf("Expected all 3 sessions to remain, got %d", stats.SessionCount)
+	}
+
+	if err := CleanupDatabase(db); err != nil {
+		t.Fatalf("Failed to cleanup: %v", err)
+	}
+	if report, _ := PreviewCleanup(db); report.ExpiredSessions != 0 {
+		t.Errorf("Expected no expired sessions after cleanup, got %d", report.ExpiredSessions)
+	}
+}
+
+func TestBackupDatabase(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSQLite(filepath.Join(dir, "test_source.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	if _, err := db.CreateUser("backupuser"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	db.Close()
+
+	if err := BackupDatabase(filepath.Join(dir, "test_source.db"), filepath.Join(dir, "test_backup.db")); err != nil {
+		t.Fatalf("Failed to back up database: %v", err)
+	}
+
+	backup, err := NewSQLite(filepath.Join(dir, "test_backup.db"))
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer backup.Close()
+
+	if user, err := backup.GetUser("backupuser"); err != nil || user == nil {
+		t.Errorf("Expected the backup to contain the user, got %+v (%v)", user, err)
+	}
+}
+
+func TestDeleteUserDataRollsBack(t *testing.T) {
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test_delete_user.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	user, err := db.CreateUser("keeper")
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := db.StoreCredential(user.ID, "keeper-credential", "key", ""); err != nil {
 		t.Fatalf("Failed to store credential: %v", err)
 	}
 
-	// Test credential retrieval
-	credential, err := db.GetCredential("test-credential-id")
+	// Make the last step fail, after the credentials are already deleted
+	if _, err := db.db.Exec(`CREATE TRIGGER keep_users BEFORE DELETE ON users BEGIN SELECT RAISE(ABORT, 'users are kept'); END`); err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+
+	if err := db.DeleteUserData("keeper"); err == nil {
+		t.Fatal("Expected the deletion to fail")
+	}
+	if cred, err := db.GetCredential("keeper-credential"); err != nil || cred == nil {
+		t.Errorf("Expected the credential to survive the failed deletion, got %+v (%v)", cred, err)
+	}
+}
+
+func TestReopenAfterFailures(t *testing.T) {
+	original := reopenBackoff
+	reopenBackoff = 0
+	defer func() { reopenBackoff = original }()
+
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test_reopen.db"))
 	if err != nil {
-		t.Fatalf("Failed to get credential: %v", err)
+		t.Fatalf("Failed to create database: %v", err)
 	}
+	defer db.Close()
 
-	if credential == nil {
-		t.Fatal("Credential should not be nil")
+	if _, err := db.CreateUser("survivor"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if !db.Healthy() {
+		t.Fatal("Expected a fresh database to be healthy")
 	}
 
-	if credential.CredentialID != "test-credential-id" {
-		t.Errorf("Expected credential ID 'test-credential-id', got '%s'", credential.CredentialID)
+	// Simulate a handle that errors forever
+	db.handle().Close()
+	if _, err := db.GetUser("survivor"); err == nil {
+		t.Fatal("Expected queries to fail on the broken handle")
 	}
 
-	if credential.PublicKey != "test-public-key" {
-		t.Errorf("Expected public key 'test-public-key', got '%s'", credential.PublicKey)
+	for i := 1; i < reopenAfterFailures; i++ {
+		if db.Healthy() {
+			t.Fatalf("Expected check %d to fail before reopening", i)
+		}
 	}
+	db.Healthy() // Reaches the threshold and reopens
 
-	// Test cleanup
-	err = db.CleanupExpiredSessions()
+	if !db.Healthy() {
+		t.Fatal("Expected the database to be healthy after reopening")
+	}
+	user, err := db.GetUser("survivor")
+	if err != nil || user == nil {
+		t.Fatalf("Expected the reopened database to serve the stored user, got %+v (%v)", user, err)
+	}
+	if _, err := db.CreateUser("newcomer"); err != nil {
+		t.Errorf("Expected writes to work after reopening: %v", err)
+	}
+}
+
+func TestReopenRefusesMissingFile(t *testing.T) {
+	original := reopenBackoff
+	reopenBackoff = 0
+	defer func() { reopenBackoff = original }()
+
+	path := filepath.Join(t.TempDir(), "test_reopen_missing.db")
+	db, err := NewSQLite(path)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// The file disappears while the handle is broken
+	db.handle().Close()
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		os.Remove(path + suffix)
+	}
+
+	for i := 0; i < 3*reopenAfterFailures; i++ {
+		if db.Healthy() {
+			t.Fatalf("Expected check %d to stay unhealthy without the original file", i+1)
+		}
+	}
+
+	// Nothing was migrated into whatever file the reopen attempts left behind
+	check, err := sql.Open("sqlite", path)
 	if err != nil {
-		t.Fatalf("Failed to cleanup expired sessions: %v", err)
+		t.Fatalf("Failed to open database file: %v", err)
+	}
+	defer check.Close()
+	var tables int
+	if err := check.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil {
+		t.Fatalf("Failed to count tables: %v", err)
+	}
+	if tables != 0 {
+		t.Errorf("Expected no tables to be created, got %d", tables)
+	}
+}
+
+func TestReopenBackoff(t *testing.T) {
+	original := reopenBackoff
+	reopenBackoff = time.Hour
+	defer func() { reopenBackoff = original }()
+
+	db, err := NewSQLite(filepath.Join(t.TempDir(), "test_reopen_backoff.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// The first reopen succeeds, but a handle that breaks again must wait out the backoff
+	db.handle().Close()
+	for i := 0; i < reopenAfterFailures; i++ {
+		db.Healthy()
+	}
+	db.handle().Close()
+	for i := 0; i < 2*reopenAfterFailures; i++ {
+		if db.Healthy() {
+			t.Fatal("Expected no second reopen during the backoff")
+		}
 	}
 }
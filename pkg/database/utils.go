@@ -2,7 +2,10 @@ package database
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"time"
 )
 
 // BackupDatabase creates a backup of the database
@@ -14,9 +17,25 @@ func BackupDatabase(sourcePath, backupPath string) error {
 
 // CopyFile copies a file from source to destination
 func CopyFile(source, destination string) error {
-	// This is a simplified implementation
-	// In production, you'd want to use proper file copying with error handling
 	log.Printf("Backing up database from %s to %s", source, destination)
+
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", source, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", destination, err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy %s to %s: %v", source, destination, err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", destination, err)
+	}
 	return nil
 }
 
@@ -31,7 +50,7 @@ func GetDatabaseStats(db Database) (*DatabaseStats, error) {
 
 	// Count users
 	var userCount int
-	err := sqliteDB.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
+	err := sqliteDB.handle().QueryRow("SELECT COUNT(*) FROM users").Scan(&userCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count users: %v", err)
 	}
@@ -39,7 +58,7 @@ func GetDatabaseStats(db Database) (*DatabaseStats, error) {
 
 	// Count sessions
 	var sessionCount int
-	err = sqliteDB.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessionCount)
+	err = sqliteDB.handle().QueryRow("SELECT COUNT(*) FROM sessions").Scan(&sessionCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count sessions: %v", err)
 	}
@@ -47,7 +66,7 @@ func GetDatabaseStats(db Database) (*DatabaseStats, error) {
 
 	// Count credentials
 	var credentialCount int
-	err = sqliteDB.db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials").Scan(&credentialCount)
+	err = sqliteDB.handle().QueryRow("SELECT COUNT(*) FROM webauthn_credentials").Scan(&credentialCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to count credentials: %v", err)
 	}
@@ -63,6 +82,26 @@ type DatabaseStats struct {
 	CredentialCount int `json:"credential_count"`
 }
 
+// CleanupReport counts the rows a cleanup removes
+type CleanupReport struct {
+	ExpiredSessions int `json:"expired_sessions"`
+}
+
+// PreviewCleanup reports what CleanupDatabase would remove, without changing anything
+func PreviewCleanup(db Database) (*CleanupReport, error) {
+	sqliteDB, ok := db.(*SQLiteDB)
+	if !ok {
+		return nil, fmt.Errorf("database is not SQLite")
+	}
+
+	report := &CleanupReport{}
+	err := sqliteDB.handle().QueryRow("SELECT COUNT(*) FROM sessions WHERE expires_at < CURRENT_TIMESTAMP").Scan(&report.ExpiredSessions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count expired sessions: %v", err)
+	}
+	return report, nil
+}
+
 // CleanupDatabase removes expired sessions and old data
 func CleanupDatabase(db Database) error {
 	// Cleanup expired sessions
@@ -73,3 +112,72 @@ func CleanupDatabase(db Database) error {
 	log.Println("Database cleanup completed")
 	return nil
 }
+
+// UserData is everything stored about one user, as exported on request
+type UserData struct {
+	User        *User                `json:"user"`
+	Credentials []CredentialMetadata `json:"credentials"`
+	Sessions    []SessionMetadata    `json:"sessions"`
+	AuditEvents []*AuditEvent        `json:"audit_events"`
+}
+
+// CredentialMetadata describes a stored passkey without its key material
+type CredentialMetadata struct {
+	CredentialID string    `json:"credential_id"`
+	DeviceLabel  string    `json:"device_label,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// SessionMetadata describes a session without its ID, which would let the holder log in
+type SessionMetadata struct {
+	Created   time.Time `json:"created"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ExportUserData collects everything stored about a user, returning nil if the user doesn't exist
+func ExportUserData(db Database, username string) (*UserData, error) {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %v", err)
+	}
+	if user == nil {
+		return nil, nil
+	}
+
+	credentials, err := db.GetCredentialsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := db.GetSessionsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	auditEvents, err := db.GetAuditEventsByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &UserData{
+		User:        user,
+		Credentials: []CredentialMetadata{},
+		Sessions:    []SessionMetadata{},
+		AuditEvents: auditEvents,
+	}
+	if data.AuditEvents == nil {
+		data.AuditEvents = []*AuditEvent{}
+	}
+	for _, cred := range credentials {
+		data.Credentials = append(data.Credentials, CredentialMetadata{
+			CredentialID: cred.CredentialID,
+			DeviceLabel:  cred.DeviceLabel,
+			Created:      cred.Created,
+		})
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, SessionMetadata{
+			Created:   session.Created,
+			ExpiresAt: session.ExpiresAt,
+		})
+	}
+	return data, nil
+}
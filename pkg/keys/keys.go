@@ -0,0 +1,47 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// MinRSABits is the smallest RSA modulus accepted for chat keys
+const MinRSABits = 2048
+
+// ParsePublicKey decodes a base64 SPKI chat public key and validates it
+func ParsePublicKey(encoded string) (*rsa.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %v", err)
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is not an RSA key")
+	}
+
+	if err := ValidatePublicKey(publicKey); err != nil {
+		return nil, err
+	}
+	return publicKey, nil
+}
+
+// ValidatePublicKey rejects RSA keys that are too small or have a suspicious exponent
+func ValidatePublicKey(publicKey *rsa.PublicKey) error {
+	if bits := publicKey.N.BitLen(); bits < MinRSABits {
+		return fmt.Errorf("public key too small: %d bits, minimum is %d", bits, MinRSABits)
+	}
+
+	// Exponents below 3 or even are insecure or invalid
+	if publicKey.E < 3 || publicKey.E%2 == 0 {
+		return fmt.Errorf("public key has invalid exponent: %d", publicKey.E)
+	}
+	return nil
+}
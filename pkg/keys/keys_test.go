@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"testing"
+)
+
+// encodeKey returns the base64 SPKI encoding of an RSA public key
+func encodeKey(t *testing.T, publicKey *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// TestParsePublicKey tests that 2048-bit keys are accepted and small keys rejected
+func TestParsePublicKey(t *testing.T) {
+	strong, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	publicKey, err := ParsePublicKey(encodeKey(t, &strong.PublicKey))
+	if err != nil {
+		t.Fatalf("2048-bit key should be accepted: %v", err)
+	}
+	if publicKey.N.Cmp(strong.N) != 0 {
+		t.Error("Parsed key should match the original")
+	}
+
+	// A 512-bit modulus; x509 can marshal it even though rsa.GenerateKey refuses such sizes
+	weak := &rsa.PublicKey{N: new(big.Int).Lsh(big.NewInt(1), 511), E: 65537}
+	weak.N.Add(weak.N, big.NewInt(1))
+	if _, err := ParsePublicKey(encodeKey(t, weak)); err == nil {
+		t.Error("512-bit key should be rejected")
+	}
+}
+
+// TestParsePublicKeyInvalid tests malformed input
+func TestParsePublicKeyInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"empty", ""},
+		{"not base64", "!!!"},
+		{"not SPKI", base64.StdEncoding.EncodeToString([]byte("not a key"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePublicKey(tt.encoded); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
+
+// TestValidatePublicKeyExponent tests rejection of suspicious exponents
+func TestValidatePublicKeyExponent(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	for _, e := range []int{1, 2, 65536} {
+		publicKey := &rsa.PublicKey{N: key.N, E: e}
+		if err := ValidatePublicKey(publicKey); err == nil {
+			t.Errorf("Exponent %d should be rejected", e)
+		}
+	}
+
+	if err := ValidatePublicKey(&key.PublicKey); err != nil {
+		t.Errorf("Exponent 65537 should be accepted: %v", err)
+	}
+}
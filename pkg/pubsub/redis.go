@@ -0,0 +1,288 @@
+package pubsub
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// publishQueueSize is how many messages can wait for the Redis connection before new ones are dropped
+const publishQueueSize = 1024
+
+// Timeouts for talking to Redis
+var (
+	dialTimeout = 5 * time.Second
+	retryDelay  = time.Second
+)
+
+// ErrClosed is returned after Close
+var ErrClosed = errors.New("broadcaster closed")
+
+// Redis shares messages between server instances over a Redis pub/sub channel. It speaks just
+// enough of the Redis protocol for PUBLISH and SUBSCRIBE, reconnecting after failures.
+type Redis struct {
+	addr    string
+	channel string
+	queue   chan []byte
+	done    chan struct{}
+
+	mutex     sync.Mutex
+	conns     map[net.Conn]bool // Open connections, closed to interrupt blocked reads on Close
+	closeOnce sync.Once
+}
+
+// NewRedis creates a broadcaster publishing to a channel on the Redis server at addr
+func NewRedis(addr, channel string) *Redis {
+	r := &Redis{
+		addr:    addr,
+		channel: channel,
+		queue:   make(chan []byte, publishQueueSize),
+		done:    make(chan struct{}),
+		conns:   make(map[net.Conn]bool),
+	}
+	go r.publishLoop()
+	return r
+}
+
+// Publish queues a message for the channel without blocking the caller
+func (r *Redis) Publish(message []byte) error {
+	select {
+	case <-r.done:
+		return ErrClosed
+	default:
+	}
+
+	select {
+	case r.queue <- message:
+		return nil
+	default:
+		return fmt.Errorf("publish queue full, dropping message")
+	}
+}
+
+// Subscribe delivers every message published on the channel until Close
+func (r *Redis) Subscribe(deliver func(message []byte)) error {
+	select {
+	case <-r.done:
+		return ErrClosed
+	default:
+	}
+
+	go func() {
+		for {
+			err := r.receive(deliver)
+			select {
+			case <-r.done:
+				return
+			default:
+			}
+			log.Printf("Redis subscription to %s failed, retrying: %v", r.addr, err)
+			if !r.wait() {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops publishing and subscribing
+func (r *Redis) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+
+		r.mutex.Lock()
+		for conn := range r.conns {
+			conn.Close()
+		}
+		r.mutex.Unlock()
+	})
+	return nil
+}
+
+// publishLoop sends queued messages, holding on to a message until it has been published
+func (r *Redis) publishLoop() {
+	var conn net.Conn
+	var reader *bufio.Reader
+	defer func() {
+		if conn != nil {
+			r.release(conn)
+		}
+	}()
+
+	for {
+		var message []byte
+		select {
+		case message = <-r.queue:
+		case <-r.done:
+			return
+		}
+
+		for {
+			if conn == nil {
+				var err error
+				if conn, err = r.dial(); err != nil {
+					log.Printf("Failed to connect to Redis at %s: %v", r.addr, err)
+					if !r.wait() {
+						return
+					}
+					continue
+				}
+				reader = bufio.NewReader(conn)
+			}
+
+			err := writeCommand(conn, "PUBLISH", r.channel, string(message))
+			if err == nil {
+				_, err = readReply(reader)
+			}
+			if err == nil {
+				break
+			}
+
+			log.Printf("Failed to publish to Redis at %s: %v", r.addr, err)
+			r.release(conn)
+			conn = nil
+			if !r.wait() {
+				return
+			}
+		}
+	}
+}
+
+// receive subscribes on a new connection and delivers messages until the connection fails
+func (r *Redis) receive(deliver func(message []byte)) error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer r.release(conn)
+
+	if err := writeCommand(conn, "SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return err
+		}
+
+		// Pushes are ["message", channel, payload]; the subscribe confirmation is skipped
+		push, ok := reply.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].([]byte)
+		payload, _ := push[2].([]byte)
+		if string(kind) == "message" && payload != nil {
+			deliver(payload)
+		}
+	}
+}
+
+// dial opens a tracked connection to Redis
+func (r *Redis) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	select {
+	case <-r.done:
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+	r.conns[conn] = true
+	return conn, nil
+}
+
+// release closes a tracked connection
+func (r *Redis) release(conn net.Conn) {
+	r.mutex.Lock()
+	delete(r.conns, conn)
+	r.mutex.Unlock()
+	conn.Close()
+}
+
+// wait pauses before a retry, returning false if the broadcaster was closed meanwhile
+func (r *Redis) wait() bool {
+	select {
+	case <-time.After(retryDelay):
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+// writeCommand sends a command as a RESP array of bulk strings
+func writeCommand(conn net.Conn, args ...string) error {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// readReply reads one RESP value: strings and bulk strings as []byte, integers as int64,
+// arrays as []any, and error replies as errors
+func readReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, body := line[0], string(line[1:len(line)-2])
+
+	switch kind {
+	case '+':
+		return []byte(body), nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", body)
+	case ':':
+		var n int64
+		if _, err := fmt.Sscan(body, &n); err != nil {
+			return nil, fmt.Errorf("malformed integer %q", body)
+		}
+		return n, nil
+	case '$':
+		var size int
+		if _, err := fmt.Sscan(body, &size); err != nil {
+			return nil, fmt.Errorf("malformed bulk length %q", body)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		var count int
+		if _, err := fmt.Sscan(body, &count); err != nil {
+			return nil, fmt.Errorf("malformed array length %q", body)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unknown reply type %q", kind)
+}
@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal pub/sub server answering PUBLISH and SUBSCRIBE
+type fakeRedis struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &fakeRedis{listener: listener, subscribers: make(map[string][]net.Conn)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		args, ok := reply.([]any)
+		if !ok || len(args) < 2 {
+			return
+		}
+		command, _ := args[0].([]byte)
+		channel, _ := args[1].([]byte)
+
+		switch string(command) {
+		case "SUBSCRIBE":
+			f.mutex.Lock()
+			f.subscribers[string(channel)] = append(f.subscribers[string(channel)], conn)
+			f.mutex.Unlock()
+			writeCommand(conn, "subscribe", string(channel))
+		case "PUBLISH":
+			payload, _ := args[2].([]byte)
+			f.mutex.Lock()
+			for _, sub := range f.subscribers[string(channel)] {
+				writeCommand(sub, "message", string(channel), string(payload))
+			}
+			f.mutex.Unlock()
+			conn.Write([]byte(":1\r\n"))
+		}
+	}
+}
+
+func (f *fakeRedis) subscriberCount(channel string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.subscribers[channel])
+}
+
+func TestRedisSharesMessagesBetweenInstances(t *testing.T) {
+	server := newFakeRedis(t)
+	addr := server.listener.Addr().String()
+
+	first := NewRedis(addr, "chapp:test")
+	defer first.Close()
+	second := NewRedis(addr, "chapp:test")
+	defer second.Close()
+
+	firstReceived := make(chan []byte, 10)
+	secondReceived := make(chan []byte, 10)
+	if err := first.Subscribe(func(m []byte) { firstReceived <- m }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	if err := second.Subscribe(func(m []byte) { secondReceived <- m }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for server.subscriberCount("chapp:test") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for subscriptions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	message := []byte("{\"type\":\"message\",\"content\":\"line one\\r\\nline two\"}")
+	if err := first.Publish(message); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	for name, received := range map[string]chan []byte{"first": firstReceived, "second": secondReceived} {
+		select {
+		case got := <-received:
+			if string(got) != string(message) {
+				t.Errorf("Expected %s instance to receive %q, got %q", name, message, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected %s instance to receive the message", name)
+		}
+	}
+}
+
+func TestRedisClosed(t *testing.T) {
+	server := newFakeRedis(t)
+	r := NewRedis(server.listener.Addr().String(), "chapp:test")
+	r.Close()
+
+	if err := r.Publish([]byte("hello")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from Publish, got %v", err)
+	}
+	if err := r.Subscribe(func([]byte) {}); err != ErrClosed {
+		t.Errorf("Expected ErrClosed from Subscribe, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
-// Message types used throughout the application
+// Message types used throughout the application. The web client mirrors these in
+// MESSAGE_TYPES (static/js/script.js); keep both in sync when adding a type. The
+// server relays types it doesn't handle specially unchanged, so clients can add
+// new types without server changes.
 const (
 	MessageTypeSystem         = "system"
 	MessageTypeEncrypted      = "encrypted_message"
@@ -8,10 +11,39 @@ const (
 	MessageTypeRequestKeys    = "request_keys"
 	MessageTypeUserInfo       = "user_info"
 	MessageTypeKeyExchange    = "key_exchange"
+	MessageTypeLeave          = "leave"    // Content carries an optional quit reason
+	MessageTypePresence       = "presence" // Content is the away message, empty when back
+	MessageTypeJoinRoom       = "join_room"
+	MessageTypeLeaveRoom      = "leave_room"
+	MessageTypeKeyRotation    = "key_rotation"    // Content is the sender's new public key
+	MessageTypeDeliveryFailed = "delivery_failed" // Recipient is the user who couldn't be reached
+	MessageTypeServerAck      = "server_ack"      // ID names a directed message the server queued for its recipient
+	MessageTypeEcho           = "echo"            // Encrypted test nonce the recipient decrypts and sends back
 )
 
+// MessageTypes lists every message type shared between the server and clients
+var MessageTypes = []string{
+	MessageTypeSystem,
+	MessageTypeEncrypted,
+	MessageTypePublicKeyShare,
+	MessageTypeRequestKeys,
+	MessageTypeUserInfo,
+	MessageTypeKeyExchange,
+	MessageTypeLeave,
+	MessageTypePresence,
+	MessageTypeJoinRoom,
+	MessageTypeLeaveRoom,
+	MessageTypeKeyRotation,
+	MessageTypeDeliveryFailed,
+	MessageTypeServerAck,
+	MessageTypeEcho,
+}
+
 // Session cookie name
 const SessionCookieName = "chapp_session"
 
+// MaxLeaveReasonLength caps the quit reason included in leave notifications
+const MaxLeaveReasonLength = 200
+
 // System sender name
 const SystemSender = "System"
@@ -1,10 +1,22 @@
 package types
 
+import "chapp/pkg/vars"
+
 // Message represents a chat message (server can't read encrypted content)
 type Message struct {
-	Type      string `json:"type"`
-	Content   string `json:"content"`
-	Sender    string `json:"sender"`
-	Recipient string `json:"recipient,omitempty"`
-	Timestamp int64  `json:"timestamp"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id,omitempty"` // Optional sender-chosen ID, echoed in server acks
+	Content   string          `json:"content"`
+	Sender    string          `json:"sender"`
+	Recipient string          `json:"recipient,omitempty"`
+	Room      string          `json:"room,omitempty"` // Empty for the lobby everyone is in
+	Timestamp int64           `json:"timestamp"`
+	Version   *vars.BuildInfo `json:"version,omitempty"` // Server build info, sent with user_info
+	Idle      *IdlePolicy     `json:"idle,omitempty"`    // Inactivity policy, sent with user_info
+}
+
+// IdlePolicy tells clients how long they may go without user input, in seconds (0 disables)
+type IdlePolicy struct {
+	AwayAfter       int64 `json:"away_after"`
+	DisconnectAfter int64 `json:"disconnect_after"`
 }
@@ -0,0 +1,26 @@
+package vars
+
+import "runtime"
+
+// Build information, overridden at build time via -ldflags, e.g.
+// go build -ldflags "-X chapp/pkg/vars.Version=v1.2.3 -X chapp/pkg/vars.GitCommit=abc123"
+var (
+	Version   = "dev"
+	GitCommit = "dev"
+)
+
+// BuildInfo describes the running server build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	GoVersion string `json:"go_version"`
+}
+
+// GetBuildInfo returns the build information of the running binary
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+	}
+}
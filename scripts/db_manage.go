@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"chapp/pkg/database"
 )
@@ -14,6 +16,10 @@ func main() {
 		backupPath = flag.String("backup", "", "Backup file path")
 		stats      = flag.Bool("stats", false, "Show database statistics")
 		cleanup    = flag.Bool("cleanup", false, "Cleanup expired sessions")
+		exportUser = flag.String("export-user", "", "Print everything stored about a user as JSON")
+		deleteUser = flag.String("delete-user", "", "Delete a user with all their credentials, sessions and audit events")
+		dryRun     = flag.Bool("dry-run", false, "Report what backup, cleanup and delete-user would do without changing anything")
+		verbose    = flag.Bool("verbose", false, "Show detailed output")
 	)
 	flag.Parse()
 
@@ -24,12 +30,22 @@ func main() {
 	}
 	defer db.Close()
 
+	if *verbose {
+		fmt.Printf("Using database %s\n", *dbPath)
+	}
+
 	// Handle different operations
 	if *backupPath != "" {
-		if err := database.BackupDatabase(*dbPath, *backupPath); err != nil {
-			log.Fatalf("Failed to backup database: %v", err)
+		if *dryRun {
+			fmt.Printf("Dry run: would back up %s to %s\n", *dbPath, *backupPath)
+			printFileSummary(db, *dbPath)
+		} else {
+			if err := database.BackupDatabase(*dbPath, *backupPath); err != nil {
+				log.Fatalf("Failed to backup database: %v", err)
+			}
+			fmt.Printf("Database backed up to %s\n", *backupPath)
+			printFileSummary(db, *backupPath)
 		}
-		fmt.Printf("Database backed up to %s\n", *backupPath)
 	}
 
 	if *stats {
@@ -41,23 +57,94 @@ func main() {
 		fmt.Printf("  Users: %d\n", stats.UserCount)
 		fmt.Printf("  Sessions: %d\n", stats.SessionCount)
 		fmt.Printf("  Credentials: %d\n", stats.CredentialCount)
+
+		if *verbose {
+			report, err := database.PreviewCleanup(db)
+			if err != nil {
+				log.Fatalf("Failed to inspect database: %v", err)
+			}
+			fmt.Printf("  Expired sessions: %d\n", report.ExpiredSessions)
+		}
 	}
 
 	if *cleanup {
-		if err := database.CleanupDatabase(db); err != nil {
-			log.Fatalf("Failed to cleanup database: %v", err)
+		report, err := database.PreviewCleanup(db)
+		if err != nil {
+			log.Fatalf("Failed to inspect database: %v", err)
+		}
+
+		if *dryRun {
+			fmt.Printf("Dry run: cleanup would delete %d expired sessions\n", report.ExpiredSessions)
+		} else {
+			if err := database.CleanupDatabase(db); err != nil {
+				log.Fatalf("Failed to cleanup database: %v", err)
+			}
+			if *verbose {
+				fmt.Printf("  Expired sessions deleted: %d\n", report.ExpiredSessions)
+			}
+			fmt.Println("Database cleanup completed")
 		}
-		fmt.Println("Database cleanup completed")
+	}
+
+	if *exportUser != "" {
+		data, err := database.ExportUserData(db, *exportUser)
+		if err != nil {
+			log.Fatalf("Failed to export user data: %v", err)
+		}
+		if data == nil {
+			log.Fatalf("User not found: %s", *exportUser)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(data)
+	}
+
+	if *deleteUser != "" {
+		data, err := database.ExportUserData(db, *deleteUser)
+		if err != nil {
+			log.Fatalf("Failed to inspect user data: %v", err)
+		}
+		if data == nil {
+			log.Fatalf("User not found: %s", *deleteUser)
+		}
+
+		if *dryRun {
+			fmt.Printf("Dry run: would delete user %s", *deleteUser)
+		} else {
+			if err := db.DeleteUserData(*deleteUser); err != nil {
+				log.Fatalf("Failed to delete user data: %v", err)
+			}
+			fmt.Printf("Deleted user %s", *deleteUser)
+		}
+		fmt.Printf(" with %d credentials, %d sessions and %d audit events\n", len(data.Credentials), len(data.Sessions), len(data.AuditEvents))
 	}
 
 	// If no flags provided, show usage
-	if !*stats && !*cleanup && *backupPath == "" {
+	if !*stats && !*cleanup && *backupPath == "" && *exportUser == "" && *deleteUser == "" {
 		fmt.Println("Chapp Database Management Tool")
 		fmt.Println("Usage:")
 		flag.PrintDefaults()
 		fmt.Println("\nExamples:")
 		fmt.Println("  go run scripts/db_manage.go -stats")
 		fmt.Println("  go run scripts/db_manage.go -cleanup")
+		fmt.Println("  go run scripts/db_manage.go -cleanup -dry-run")
 		fmt.Println("  go run scripts/db_manage.go -backup backup.db")
+		fmt.Println("  go run scripts/db_manage.go -export-user alice > alice.json")
 	}
 }
+
+// printFileSummary prints the size of a database file and the row counts it holds
+func printFileSummary(db database.Database, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Fatalf("Failed to stat %s: %v", path, err)
+	}
+
+	stats, err := database.GetDatabaseStats(db)
+	if err != nil {
+		log.Fatalf("Failed to get database stats: %v", err)
+	}
+
+	fmt.Printf("  Size: %d bytes\n", info.Size())
+	fmt.Printf("  Users: %d, Sessions: %d, Credentials: %d\n", stats.UserCount, stats.SessionCount, stats.CredentialCount)
+}
@@ -15,6 +15,7 @@ document.addEventListener('DOMContentLoaded', function() {
     // WebAuthn variables
     let webauthnClient;
     let isWebAuthnSupported = false;
+    let inviteToken = null; // Invite the page was opened with, used up by registering
 
     // Initialize WebAuthn
     function initializeWebAuthn() {
@@ -118,7 +119,8 @@ document.addEventListener('DOMContentLoaded', function() {
         showLoading(confirmRegisterBtn);
 
         try {
-            await webauthnClient.register(username);
+            await webauthnClient.register(username, inviteToken);
+            inviteToken = null;
             hideLoading(confirmRegisterBtn);
             hideModal();
             
@@ -143,6 +145,8 @@ document.addEventListener('DOMContentLoaded', function() {
                 showModalError('Registration was cancelled or not supported by your device.');
             } else if (errorMessage.includes('NotSupportedError')) {
                 showModalError('Your device does not support passkeys.');
+            } else if (inviteToken && (errorMessage.includes('410') || errorMessage.includes('404'))) {
+                showModalError('This invite link is invalid or has expired.');
             } else if (errorMessage.includes('InvalidStateError')) {
                 showModalError('A passkey already exists for this account.');
             } else if (errorMessage.includes('Registration failed')) {
@@ -242,4 +246,33 @@ document.addEventListener('DOMContentLoaded', function() {
     
     // Call reset on page load
     resetPageState();
+
+    // Open registration directly when arriving through an invite link. The invite is only
+    // checked here; registering with it uses it up, so reloading the page doesn't spend it.
+    async function handleInvite() {
+        const token = new URLSearchParams(window.location.search).get('invite');
+        if (!token) {
+            return;
+        }
+
+        try {
+            const response = await fetch('/api/invites/check', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ token: token })
+            });
+            if (!response.ok) {
+                showError('This invite link is invalid or has expired.');
+                return;
+            }
+            const invite = await response.json();
+            inviteToken = token;
+            showModal();
+            document.querySelector('#registrationModal .help-text').textContent =
+                `You were invited by ${invite.created_by}. Choose a username for your account`;
+        } catch (error) {
+            showError('Could not validate the invite link. Please try again.');
+        }
+    }
+    handleInvite();
 }); 
\ No newline at end of file
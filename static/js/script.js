@@ -5,9 +5,21 @@ const MESSAGE_TYPES = {
     PUBLIC_KEY_SHARE: 'public_key_share',
     REQUEST_KEYS: 'request_keys',
     USER_INFO: 'user_info',
+    KEY_EXCHANGE: 'key_exchange',
+    LEAVE: 'leave',
+    PRESENCE: 'presence',
+    JOIN_ROOM: 'join_room',
+    LEAVE_ROOM: 'leave_room',
+    KEY_ROTATION: 'key_rotation',
+    DELIVERY_FAILED: 'delivery_failed',
+    SERVER_ACK: 'server_ack',
+    ECHO: 'echo',
     LOCAL: 'local_message' // For local display only
 };
 
+// Smallest RSA modulus accepted from peers (matches keys.MinRSABits on the server)
+const MIN_RSA_BITS = 2048;
+
 // Global variables
 let ws = null;
 let username = "Loading...";
@@ -21,16 +33,44 @@ let reconnectTimer = null;
 let isReconnecting = false;
 
 let myKeyPair = null;
+let retiredPrivateKeys = []; // Private keys replaced by /rotate-key, kept briefly for in-flight messages
+const KEY_ROTATION_GRACE = 60 * 1000; // How long a retired key can still decrypt
+const DECRYPTION_FAILED = '[DECRYPTION FAILED]';
+let rekeyAttempts = new Map(); // Map of sender -> key exchanges retried since their last readable message
+let maxRekeyAttempts = 3; // Stop retrying key exchanges with a sender after this many
 let isKeyGenerated = false;
 let hasSharedKey = false; // Prevent infinite loop
 let lastJoinedUser = null; // Track last user who joined
 let needToShareBack = false; // Flag to share back when receiving a new key
 let justSharedKey = false; // Track if we just shared our key recently
+let presence = new Map(); // Map of username -> away message
+let roster = new Set(); // Peers seen joining or sharing a key and not yet left, whether or not we have their key
+let firstSeen = new Map(); // Map of username -> when their public key first arrived this session
+let aloneHintShown = false; // The no-peers hint is shown at most once per page
+let aloneHint = null; // The no-peers hint element, removed when a peer's key arrives
+let pendingMessages = []; // Messages typed before any peer's key was known
+let outbox = []; // Messages typed while reconnecting: {message, room, element}
+let maxOutboxMessages = 50; // Further messages are refused until the outbox is flushed
+const OUTBOX_FLUSH_DELAY = 1000; // How long after reconnecting to wait for peers' current keys
+let myAwayMessage = ''; // Empty when we are present
+let autoAway = false; // Whether we went away because of inactivity
+let idleTimer = null;
+let autoAwayDelay = 5 * 60 * 1000; // Go away after this long without input, 0 disables (set by the server)
+let idleDisconnectDelay = 0; // Disconnect after this long without input, 0 disables (set by the server)
+let idleWarningTimer = null;
+let idleDisconnectTimer = null;
+const IDLE_WARNING = 60 * 1000; // How long before an idle disconnect to warn
+let rooms = new Map(); // Map of joined room -> {members: Set of usernames, unread: count}
+let activeRoom = ''; // Room shown in the message view, '' for the lobby
+let pendingEchoes = new Map(); // Map of /test nonce -> {peer, started}
+let muted = new Set(); // Users whose messages are hidden and who aren't sent ours, saved per identity
+const MUTED_STORAGE_PREFIX = 'chapp.muted.'; // localStorage key of a mute list, followed by the username it belongs to
+const ECHO_TIMEOUT = 10 * 1000; // How long /test waits for a peer's reply
 
 // Update the page title to show current user
 function updateTitle() {
     if (username && username !== "Loading...") {
-        document.title = `Chapp - ${username}`;
+        document.title = activeRoom ? `Chapp - ${username} #${activeRoom}` : `Chapp - ${username}`;
     } else if (username === "Loading...") {
         document.title = 'Chapp - Connecting...';
     } else {
@@ -71,6 +111,64 @@ async function exportPublicKey() {
     }
 }
 
+// Key shares declare how the key is encoded so peers don't have to guess
+const KEY_SHARE_ALGORITHM = 'RSA-OAEP-256';
+const KEY_SHARE_FORMAT = 'spki';
+
+// Wrap an exported public key in a key share payload
+function encodeKeyShare(publicKeyBase64) {
+    return JSON.stringify({
+        algorithm: KEY_SHARE_ALGORITHM,
+        format: KEY_SHARE_FORMAT,
+        key: publicKeyBase64
+    });
+}
+
+// Extract the base64 public key from a key share, accepting bare keys from older clients.
+// Returns null for malformed shares or algorithms we can't use.
+function parseKeyShare(content) {
+    if (!content || !content.startsWith('{')) {
+        return content || null; // Legacy share: the base64 SPKI key itself
+    }
+    try {
+        const share = JSON.parse(content);
+        if (share.algorithm !== KEY_SHARE_ALGORITHM || share.format !== KEY_SHARE_FORMAT || typeof share.key !== 'string') {
+            console.warn('Ignoring unsupported key share:', share.algorithm, share.format);
+            return null;
+        }
+        return share.key;
+    } catch (error) {
+        console.error('Failed to parse key share:', error);
+        return null;
+    }
+}
+
+// Check a peer's public key before trusting it: RSA-OAEP, at least MIN_RSA_BITS, odd exponent of at least 3
+async function isAcceptablePublicKey(publicKeyBase64) {
+    try {
+        const keyData = Uint8Array.from(atob(publicKeyBase64), c => c.charCodeAt(0));
+        const key = await crypto.subtle.importKey(
+            "spki",
+            keyData,
+            {
+                name: "RSA-OAEP",
+                hash: "SHA-256"
+            },
+            false,
+            ["encrypt"]
+        );
+        const exponent = key.algorithm.publicExponent.reduce((value, byte) => value * 256 + byte, 0);
+        if (key.algorithm.modulusLength < MIN_RSA_BITS || exponent < 3 || exponent % 2 === 0) {
+            console.warn('Rejected weak public key:', key.algorithm.modulusLength, 'bits, exponent', exponent);
+            return false;
+        }
+        return true;
+    } catch (error) {
+        console.error('Failed to import public key:', error);
+        return false;
+    }
+}
+
 // Encrypt message for a specific recipient
 async function encryptMessage(message, recipientPublicKey) {
     try {
@@ -88,100 +186,186 @@ async function encryptMessage(message, recipientPublicKey) {
         );
         
         // RSA-2048 can encrypt up to ~190 bytes, so we need to chunk longer messages
-        const maxChunkSize = 180; // Conservative size to account for padding
+        const maxChunkSize = 180; // Conservative size in UTF-8 bytes to account for padding
+        const encoder = new TextEncoder();
+        let chunks = splitMessageIntoChunks(message, maxChunkSize).map(chunk => encoder.encode(chunk));
+        let compressed = false;
         
-        if (message.length <= maxChunkSize) {
-            // Message is short enough to encrypt directly
-            const messageBytes = new TextEncoder().encode(message);
-            const encrypted = await crypto.subtle.encrypt(
-                {
-                    name: "RSA-OAEP"
-                },
-                publicKey,
-                messageBytes
-            );
-            
-            return btoa(String.fromCharCode(...new Uint8Array(encrypted)));
+        // Large texts (pastes, logs) usually shrink a lot, saving RSA operations and bandwidth
+        const messageBytes = encoder.encode(message);
+        if (messageBytes.length >= COMPRESSION_THRESHOLD) {
+            const deflated = await deflate(messageBytes);
+            if (deflated.length < messageBytes.length) {
+                chunks = splitBytes(deflated, maxChunkSize);
+                compressed = true;
+            }
         }
         
-        // Message is too long, split into chunks
-        const chunks = splitMessageIntoChunks(message, maxChunkSize);
         const encryptedChunks = [];
-        
-        for (let i = 0; i < chunks.length; i++) {
-            const chunk = chunks[i];
-            const messageBytes = new TextEncoder().encode(chunk);
+        for (const chunk of chunks) {
             const encrypted = await crypto.subtle.encrypt(
                 {
                     name: "RSA-OAEP"
                 },
                 publicKey,
-                messageBytes
+                chunk
             );
             
             encryptedChunks.push(btoa(String.fromCharCode(...new Uint8Array(encrypted))));
         }
         
-        // Join encrypted chunks with a separator
-        return encryptedChunks.join('|');
+        return encodeEnvelope(encryptedChunks, compressed);
     } catch (error) {
         console.error('Failed to encrypt message:', error);
         return null;
     }
 }
 
-// Helper function to split message into chunks
-function splitMessageIntoChunks(message, chunkSize) {
+// Ciphertext envelope: "v1:" then each base64 chunk prefixed by its length and ":".
+// "v1z:" marks a plaintext that was deflated before encryption.
+// Older clients joined chunks with "|", which we still decode.
+const ENVELOPE_PREFIX = 'v1:';
+const COMPRESSED_ENVELOPE_PREFIX = 'v1z:';
+const COMPRESSION_THRESHOLD = 1024; // Compress plaintexts of at least this many UTF-8 bytes when it helps
+const MAX_INFLATED_BYTES = 1024 * 1024; // Refuse compressed messages that expand beyond this
+
+// Wrap encrypted base64 chunks in an envelope
+function encodeEnvelope(chunks, compressed = false) {
+    const prefix = compressed ? COMPRESSED_ENVELOPE_PREFIX : ENVELOPE_PREFIX;
+    return prefix + chunks.map(chunk => `${chunk.length}:${chunk}`).join('');
+}
+
+// Whether an envelope holds a deflated plaintext
+function isCompressedEnvelope(payload) {
+    return payload.startsWith(COMPRESSED_ENVELOPE_PREFIX);
+}
+
+// Split an envelope (or a legacy "|"-joined payload) into its base64 chunks, or null if malformed
+function decodeEnvelope(payload) {
+    const prefix = isCompressedEnvelope(payload) ? COMPRESSED_ENVELOPE_PREFIX : ENVELOPE_PREFIX;
+    if (!payload.startsWith(prefix)) {
+        const chunks = payload.split('|');
+        return chunks.every(chunk => chunk.length > 0) ? chunks : null;
+    }
+
     const chunks = [];
-    for (let i = 0; i < message.length; i += chunkSize) {
-        const end = Math.min(i + chunkSize, message.length);
-        chunks.push(message.substring(i, end));
+    let position = prefix.length;
+    while (position < payload.length) {
+        const colon = payload.indexOf(':', position);
+        const lengthText = payload.slice(position, colon);
+        if (colon === -1 || !/^[1-9][0-9]{0,5}$/.test(lengthText)) {
+            return null;
+        }
+        const length = Number(lengthText);
+        const chunk = payload.slice(colon + 1, colon + 1 + length);
+        if (chunk.length !== length) {
+            return null;
+        }
+        chunks.push(chunk);
+        position = colon + 1 + length;
     }
+    return chunks.length > 0 ? chunks : null;
+}
+
+// Split a message into chunks of at most maxBytes UTF-8 bytes, never inside a character
+// (slicing by string index could split a surrogate pair or exceed the RSA limit with multi-byte text)
+function splitMessageIntoChunks(message, maxBytes) {
+    const encoder = new TextEncoder();
+    const chunks = [];
+    let current = '';
+    let currentBytes = 0;
+    for (const char of message) {
+        const charBytes = encoder.encode(char).length;
+        if (current && currentBytes + charBytes > maxBytes) {
+            chunks.push(current);
+            current = '';
+            currentBytes = 0;
+        }
+        current += char;
+        currentBytes += charBytes;
+    }
+    chunks.push(current);
     return chunks;
 }
 
-// Decrypt message with our private key
+// Split bytes into slices of at most maxBytes
+function splitBytes(bytes, maxBytes) {
+    const chunks = [];
+    for (let i = 0; i < bytes.length; i += maxBytes) {
+        chunks.push(bytes.subarray(i, i + maxBytes));
+    }
+    return chunks;
+}
+
+// Compress bytes with raw deflate
+async function deflate(bytes) {
+    const stream = new Blob([bytes]).stream().pipeThrough(new CompressionStream('deflate-raw'));
+    return new Uint8Array(await new Response(stream).arrayBuffer());
+}
+
+// Decompress raw deflate bytes, throwing if the output would exceed MAX_INFLATED_BYTES
+async function inflate(bytes) {
+    const reader = new Blob([bytes]).stream().pipeThrough(new DecompressionStream('deflate-raw')).getReader();
+    const parts = [];
+    let total = 0;
+    for (;;) {
+        const { done, value } = await reader.read();
+        if (done) {
+            break;
+        }
+        total += value.length;
+        if (total > MAX_INFLATED_BYTES) {
+            await reader.cancel();
+            throw new Error('Decompressed message too large');
+        }
+        parts.push(value);
+    }
+    return new Uint8Array(await new Blob(parts).arrayBuffer());
+}
+
+// Decrypt message with our private key, falling back to recently retired keys
 async function decryptMessage(encryptedMessage) {
+    for (const key of [myKeyPair.privateKey, ...retiredPrivateKeys]) {
+        const decrypted = await decryptWithKey(encryptedMessage, key);
+        if (decrypted !== null) {
+            return decrypted;
+        }
+    }
+    console.error('Failed to decrypt message with current or retired keys');
+    return DECRYPTION_FAILED;
+}
+
+// Decrypt message with one private key, returning null if it doesn't fit
+async function decryptWithKey(encryptedMessage, privateKey) {
     try {
-        // Check if this is a chunked message (contains separator)
-        if (encryptedMessage.includes('|')) {
-            // Handle chunked message
-            const chunks = encryptedMessage.split('|');
-            const decryptedChunks = [];
+        const chunks = decodeEnvelope(encryptedMessage);
+        if (!chunks) {
+            return null;
+        }
+        
+        const decryptedChunks = [];
+        for (const chunk of chunks) {
+            const encryptedBytes = Uint8Array.from(atob(chunk), c => c.charCodeAt(0));
             
-            for (let i = 0; i < chunks.length; i++) {
-                const chunk = chunks[i];
-                const encryptedBytes = Uint8Array.from(atob(chunk), c => c.charCodeAt(0));
-                
-                const decrypted = await crypto.subtle.decrypt(
-                    {
-                        name: "RSA-OAEP"
-                    },
-                    myKeyPair.privateKey,
-                    encryptedBytes
-                );
-                
-                decryptedChunks.push(new TextDecoder().decode(decrypted));
-            }
+            const decrypted = await crypto.subtle.decrypt(
+                {
+                    name: "RSA-OAEP"
+                },
+                privateKey,
+                encryptedBytes
+            );
             
-            return decryptedChunks.join('');
+            decryptedChunks.push(new Uint8Array(decrypted));
         }
         
-        // Handle single chunk message (original behavior)
-        const encryptedBytes = Uint8Array.from(atob(encryptedMessage), c => c.charCodeAt(0));
-        
-        const decrypted = await crypto.subtle.decrypt(
-            {
-                name: "RSA-OAEP"
-            },
-            myKeyPair.privateKey,
-            encryptedBytes
-        );
-        
-        return new TextDecoder().decode(decrypted);
+        // Join the bytes before decoding so characters split across chunks by older clients survive
+        let plaintext = new Uint8Array(await new Blob(decryptedChunks).arrayBuffer());
+        if (isCompressedEnvelope(encryptedMessage)) {
+            plaintext = await inflate(plaintext);
+        }
+        return new TextDecoder().decode(plaintext);
     } catch (error) {
-        console.error('Failed to decrypt message:', error);
-        return '[DECRYPTION FAILED]';
+        return null;
     }
 }
 
@@ -198,7 +382,7 @@ async function sharePublicKey() {
         if (publicKey) {
             const keyShareMsg = {
                 type: MESSAGE_TYPES.PUBLIC_KEY_SHARE,
-                content: publicKey, // Use actual public key as content
+                content: encodeKeyShare(publicKey),
                 sender: username,
                 timestamp: Math.floor(Date.now() / 1000) // Convert to seconds
             };
@@ -221,6 +405,82 @@ async function sharePublicKey() {
     }
 }
 
+// After a message we can't decrypt, re-share our key and ask for the sender's so their next one
+// is encrypted to our current key; a few attempts at most, reset by a readable message
+function retryKeyExchange(sender) {
+    const attempts = rekeyAttempts.get(sender) || 0;
+    rekeyAttempts.set(sender, attempts + 1);
+    if (attempts >= maxRekeyAttempts) {
+        if (attempts === maxRekeyAttempts) {
+            showLocalNotice(`Still can't decrypt messages from ${sender}; stopped exchanging keys automatically (try /test ${sender})`);
+        }
+        return;
+    }
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+
+    showLocalNotice(`Couldn't decrypt a message from ${sender}; exchanging keys again (attempt ${attempts + 1} of ${maxRekeyAttempts})`);
+    ws.send(JSON.stringify({
+        type: MESSAGE_TYPES.REQUEST_KEYS,
+        sender: username,
+        recipient: sender,
+        timestamp: Math.floor(Date.now() / 1000)
+    }));
+    needToShareBack = true;
+    sharePublicKey();
+}
+
+// Replace our key pair mid-session, keeping the old private key briefly for messages already in flight
+async function rotateKey() {
+    const oldPrivateKey = myKeyPair.privateKey;
+    if (!await generateKeyPair()) {
+        showLocalNotice('Key rotation failed');
+        return;
+    }
+    retiredPrivateKeys.push(oldPrivateKey);
+    setTimeout(() => {
+        retiredPrivateKeys = retiredPrivateKeys.filter(key => key !== oldPrivateKey);
+    }, KEY_ROTATION_GRACE);
+
+    const publicKey = await exportPublicKey();
+    if (publicKey && ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({
+            type: MESSAGE_TYPES.KEY_ROTATION,
+            content: encodeKeyShare(publicKey),
+            sender: username,
+            timestamp: Math.floor(Date.now() / 1000)
+        }));
+    }
+    storePublicKey();
+    showLocalNotice('Your key was rotated; peers will encrypt to the new key');
+}
+
+// Store our public key on the server so peers can encrypt to us while we are offline
+async function storePublicKey() {
+    const publicKey = await exportPublicKey();
+    if (!publicKey) {
+        return false;
+    }
+
+    try {
+        const response = await fetch('/api/publickey', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            credentials: 'same-origin',
+            body: JSON.stringify({ public_key: publicKey })
+        });
+        if (!response.ok) {
+            console.error('Failed to store public key:', response.status);
+            return false;
+        }
+        return true;
+    } catch (error) {
+        console.error('Failed to store public key:', error);
+        return false;
+    }
+}
+
 function updateClientsList() {
     const clientsList = document.getElementById('clientsList');
     clientsList.innerHTML = '';
@@ -232,7 +492,7 @@ function updateClientsList() {
         currentUserItem.innerHTML = `
             <span class="client-username">
                 <i class="fas fa-user"></i>
-                ${username} (you)
+                ${username} (you)${myAwayMessage ? ` <span class="client-presence">away: ${myAwayMessage}</span>` : ''}
             </span>
             <span class="lock-icon" title="Your Public Key (Click to copy)" onclick="copyMyPublicKey()">
                 <i class="fas fa-lock"></i>
@@ -246,12 +506,13 @@ function updateClientsList() {
     for (const clientID of sortedClients) {
         const publicKey = otherClients.get(clientID);
         if (clientID === username || clientID === "Loading...") continue; // skip self and Loading... if present
+        if (activeRoom && !rooms.get(activeRoom).members.has(clientID)) continue; // only show the active room's members
         const clientItem = document.createElement('div');
         clientItem.className = 'client-item';
         clientItem.innerHTML = `
             <span class="client-username">
                 <i class="fas fa-user"></i>
-                ${clientID}
+                ${clientID}${presence.has(clientID) ? ` <span class="client-presence">away: ${presence.get(clientID)}</span>` : ''}${muted.has(clientID) ? ' <span class="client-presence">muted</span>' : ''}
             </span>
             <span class="lock-icon" title="${clientID}'s Public Key (Click to copy)" onclick="copyPublicKey('${clientID}', '${publicKey}')">
                 <i class="fas fa-lock"></i>
@@ -259,6 +520,30 @@ function updateClientsList() {
         `;
         clientsList.appendChild(clientItem);
     }
+    updatePeerSummary();
+}
+
+// Count the online peers in the active room (everyone in the lobby) and how many of them we can encrypt to
+function peerSummary() {
+    const peers = new Set([...roster, ...otherClients.keys()]);
+    peers.delete(username);
+    const visible = Array.from(peers).filter(peer => !activeRoom || rooms.get(activeRoom).members.has(peer));
+    return {
+        peers: visible.length,
+        withKeys: visible.filter(peer => otherClients.has(peer)).length,
+        room: activeRoom ? '#' + activeRoom : 'lobby',
+        connection: document.querySelector('#connectionStatus .connection-text').textContent
+    };
+}
+
+// One-line connection summary, e.g. "3 peers, 2 with keys · #general · Connected"
+function formatPeerSummary(summary) {
+    return `${summary.peers} ${summary.peers === 1 ? 'peer' : 'peers'}, ${summary.withKeys} with keys · ${summary.room} · ${summary.connection}`;
+}
+
+// Refresh the summary line under the users list
+function updatePeerSummary() {
+    document.getElementById('peerSummary').textContent = formatPeerSummary(peerSummary());
 }
 
 async function copyMyPublicKey() {
@@ -288,9 +573,350 @@ function showCopyFeedback() {
     document.dispatchEvent(event);
 }
 
+// Get (creating if needed) the message container for a room; only the active room's is visible
+function getRoomContainer(room) {
+    const messagesDiv = document.getElementById('messages');
+    let container = messagesDiv.querySelector(`.room-messages[data-room="${room}"]`);
+    if (!container) {
+        container = document.createElement('div');
+        container.className = 'room-messages';
+        container.dataset.room = room;
+        container.style.display = room === activeRoom ? '' : 'none';
+        messagesDiv.appendChild(container);
+    }
+    return container;
+}
+
+// Show a room's messages in the message view
+function switchRoom(room) {
+    if (room !== '' && !rooms.has(room)) {
+        showLocalNotice(`You are not in #${room}. Use /join ${room} first.`);
+        return;
+    }
+
+    getRoomContainer(activeRoom).style.display = 'none';
+    activeRoom = room;
+    getRoomContainer(activeRoom).style.display = '';
+
+    let unread = 0;
+    if (room !== '') {
+        unread = rooms.get(room).unread;
+        rooms.get(room).unread = 0;
+    }
+    updateTitle();
+    updateClientsList();
+    showLocalNotice(`Now viewing ${room ? '#' + room : 'the lobby'}${unread ? ` (${unread} unread)` : ''}`);
+
+    const messagesDiv = document.getElementById('messages');
+    messagesDiv.scrollTop = messagesDiv.scrollHeight;
+}
+
+// Ask the server to add us to a room and view it
+function joinRoom(room) {
+    if (!rooms.has(room)) {
+        rooms.set(room, { members: new Set([username]), unread: 0 });
+        ws.send(JSON.stringify({
+            type: MESSAGE_TYPES.JOIN_ROOM,
+            sender: username,
+            room: room,
+            timestamp: Math.floor(Date.now() / 1000)
+        }));
+    }
+    switchRoom(room);
+}
+
+// Leave a room and return to the lobby if it was being viewed
+function leaveRoom(room) {
+    if (!rooms.has(room)) {
+        showLocalNotice(`You are not in #${room}`);
+        return;
+    }
+    ws.send(JSON.stringify({
+        type: MESSAGE_TYPES.LEAVE_ROOM,
+        sender: username,
+        room: room,
+        timestamp: Math.floor(Date.now() / 1000)
+    }));
+    rooms.delete(room);
+    getRoomContainer(room).remove();
+    if (activeRoom === room) {
+        switchRoom('');
+    }
+}
+
+// Check encryption both ways with a peer: they decrypt our nonce and send it back encrypted to us
+async function testPeer(peer) {
+    if (peer === username || !otherClients.has(peer)) {
+        showLocalNotice(`No public key for ${peer}; can't test encryption`);
+        return;
+    }
+    const nonce = crypto.randomUUID();
+    const content = await encryptMessage('ping:' + nonce, otherClients.get(peer));
+    if (!content) {
+        showLocalNotice(`Encrypting to ${peer} failed`);
+        return;
+    }
+    pendingEchoes.set(nonce, { peer: peer, started: performance.now() });
+    setTimeout(() => {
+        if (pendingEchoes.delete(nonce)) {
+            showLocalNotice(`Encryption test with ${peer} timed out`);
+        }
+    }, ECHO_TIMEOUT);
+    sendEcho(peer, content);
+    showLocalNotice(`Testing encryption with ${peer}...`);
+}
+
+// Answer a peer's echo request, or report the result of our own
+async function handleEcho(message) {
+    if (message.recipient !== username || message.sender === username) {
+        return;
+    }
+    const plaintext = await decryptMessage(message.content);
+    if (plaintext.startsWith('ping:')) {
+        if (!otherClients.has(message.sender)) {
+            return;
+        }
+        const content = await encryptMessage('pong:' + plaintext.slice('ping:'.length), otherClients.get(message.sender));
+        if (content) {
+            sendEcho(message.sender, content);
+        }
+    } else if (plaintext.startsWith('pong:')) {
+        const nonce = plaintext.slice('pong:'.length);
+        const pending = pendingEchoes.get(nonce);
+        if (!pending || pending.peer !== message.sender) {
+            return;
+        }
+        pendingEchoes.delete(nonce);
+        const elapsed = Math.round(performance.now() - pending.started);
+        showLocalNotice(`Encryption with ${message.sender} works both ways (${elapsed} ms)`);
+    } else {
+        showLocalNotice(`Couldn't decrypt an encryption test from ${message.sender}`);
+    }
+}
+
+// Send an encrypted echo payload to one peer
+function sendEcho(peer, content) {
+    ws.send(JSON.stringify({
+        type: MESSAGE_TYPES.ECHO,
+        content: content,
+        sender: username,
+        recipient: peer,
+        timestamp: Math.floor(Date.now() / 1000)
+    }));
+}
+
+// Colon-separated SHA-256 of a base64 SPKI public key, for comparing keys out of band
+async function keyFingerprint(publicKeyBase64) {
+    const keyData = Uint8Array.from(atob(publicKeyBase64), c => c.charCodeAt(0));
+    const digest = await crypto.subtle.digest('SHA-256', keyData);
+    return Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join(':');
+}
+
+// Fetch a user's public key as stored on the server, or null if there is none
+async function fetchStoredKey(peer) {
+    try {
+        const response = await fetch(`/api/publickey?username=${encodeURIComponent(peer)}`, { credentials: 'same-origin' });
+        if (!response.ok) {
+            return null;
+        }
+        return (await response.json()).public_key;
+    } catch (error) {
+        return null;
+    }
+}
+
+// Show what we know about a peer: online status, presence, shared rooms and their key's fingerprint.
+// Keys are accepted on first use each session; comparing with the key stored on the server helps spot a swap.
+async function whoisPeer(peer) {
+    if (!peer) {
+        showLocalNotice('Usage: /whois <username>');
+        return;
+    }
+    const name = escapeHTML(peer);
+    const liveKey = otherClients.get(peer);
+    const storedKey = await fetchStoredKey(peer);
+    if (!liveKey && !storedKey) {
+        showLocalNotice(`${name}: offline, no public key known`);
+        return;
+    }
+
+    const lines = [];
+    if (liveKey) {
+        const since = firstSeen.has(peer) ? `, first seen ${firstSeen.get(peer).toLocaleTimeString()}` : '';
+        lines.push(`${name}: online${presence.has(peer) ? ` (away: ${escapeHTML(presence.get(peer))})` : ''}${since}`);
+        const shared = Array.from(rooms.keys()).filter(room => rooms.get(room).members.has(peer));
+        if (shared.length > 0) {
+            lines.push(`Rooms: ${shared.map(room => '#' + escapeHTML(room)).join(', ')}`);
+        }
+        lines.push(`Fingerprint: ${await keyFingerprint(liveKey)}`);
+        if (!storedKey) {
+            lines.push('Trust: unverified, no key stored on the server to compare');
+        } else if (storedKey === liveKey) {
+            lines.push('Trust: matches the key stored on the server');
+        } else {
+            lines.push('Trust: differs from the key stored on the server (they may have reconnected or rotated keys; verify the fingerprint out of band)');
+        }
+    } else {
+        lines.push(`${name}: offline`);
+        lines.push(`Stored key fingerprint: ${await keyFingerprint(storedKey)}`);
+    }
+    showLocalNotice(lines.join('<br>'));
+}
+
+// Hide a user's messages and stop encrypting ours to them
+function mutePeer(peer) {
+    if (!peer) {
+        showLocalNotice('Usage: /mute <username>');
+        return;
+    }
+    if (peer === username) {
+        showLocalNotice("You can't mute yourself");
+        return;
+    }
+    if (muted.has(peer)) {
+        showLocalNotice(escapeHTML(`${peer} is already muted`));
+        return;
+    }
+    muted.add(peer);
+    saveMuted();
+    updateClientsList();
+    showLocalNotice(escapeHTML(`Muted ${peer}: their messages are hidden and yours aren't sent to them`));
+}
+
+// Show a muted user's messages again and include them when sending
+function unmutePeer(peer) {
+    if (!peer) {
+        showLocalNotice('Usage: /unmute <username>');
+        return;
+    }
+    if (!muted.delete(peer)) {
+        showLocalNotice(escapeHTML(`${peer} isn't muted`));
+        return;
+    }
+    saveMuted();
+    updateClientsList();
+    showLocalNotice(escapeHTML(`Unmuted ${peer}`));
+}
+
+// Load the mute list saved for the current identity, starting empty if it is unreadable
+function loadMuted() {
+    muted = new Set();
+    const key = MUTED_STORAGE_PREFIX + username;
+    let saved;
+    try {
+        saved = localStorage.getItem(key);
+    } catch (error) {
+        return; // Storage is disabled, so mutes only last for this page
+    }
+    if (saved === null) {
+        return;
+    }
+
+    try {
+        const list = JSON.parse(saved);
+        if (!Array.isArray(list) || !list.every(peer => typeof peer === 'string')) {
+            throw new Error('not a list of usernames');
+        }
+        muted = new Set(list.filter(peer => peer && peer !== username));
+    } catch (error) {
+        localStorage.removeItem(key);
+        showLocalNotice('Your saved mute list was unreadable and has been reset');
+    }
+}
+
+// Save the mute list for the current identity
+function saveMuted() {
+    try {
+        localStorage.setItem(MUTED_STORAGE_PREFIX + username, JSON.stringify(Array.from(muted)));
+    } catch (error) {
+        showLocalNotice("Couldn't save your mute list; it only lasts for this page");
+    }
+}
+
+// List the muted users
+function listMuted() {
+    if (muted.size === 0) {
+        showLocalNotice('No one is muted');
+        return;
+    }
+    showLocalNotice(escapeHTML(`Muted: ${Array.from(muted).sort((a, b) => a.localeCompare(b)).join(', ')}`));
+}
+
+// Escape text for inclusion in innerHTML
+function escapeHTML(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
+const MAX_SEARCH_RESULTS = 50; // Most recent matches /search shows
+
+// Case-insensitively search the chat messages shown in every room, optionally only one sender's ("@alice term")
+function searchHistory(query) {
+    let sender = null;
+    if (query.startsWith('@')) {
+        const space = query.indexOf(' ');
+        sender = space === -1 ? query.slice(1) : query.slice(1, space);
+        query = space === -1 ? '' : query.slice(space + 1).trim();
+    }
+    if (!query) {
+        showLocalNotice('Usage: /search [@user] <term>');
+        return;
+    }
+
+    const term = query.toLowerCase();
+    const matches = [];
+    document.querySelectorAll('#messages .room-messages').forEach(container => {
+        container.querySelectorAll('.message.own, .message.other').forEach(element => {
+            const from = element.querySelector('.message-username').textContent;
+            const text = element.querySelector('.message-text').textContent;
+            if ((sender === null || from === sender) && text.toLowerCase().includes(term)) {
+                const time = element.querySelector('.message-timestamp').textContent;
+                const where = container.dataset.room ? ` #${container.dataset.room}` : '';
+                matches.push(`[${time}${where}] ${from}: ${text}`);
+            }
+        });
+    });
+
+    const scope = sender === null ? '' : ` from ${sender}`;
+    showLocalNotice(escapeHTML(`${matches.length} message${matches.length === 1 ? '' : 's'}${scope} matching "${query}"`));
+    for (const match of matches.slice(-MAX_SEARCH_RESULTS)) {
+        showLocalNotice(escapeHTML(match));
+    }
+}
+
+// Clear every rendered message and unsent queued message, after confirmation
+function wipeHistory() {
+    if (!confirm('Wipe all messages from this window? This cannot be undone.')) {
+        return;
+    }
+    document.querySelectorAll('#messages .room-messages').forEach(container => {
+        container.replaceChildren();
+    });
+    for (const state of rooms.values()) {
+        state.unread = 0;
+    }
+    pendingMessages = [];
+    outbox = [];
+    updateTitle();
+    showLocalNotice('Message history wiped');
+}
+
+// Display a system-style notice in the active room without sending anything
+function showLocalNotice(content) {
+    return displayMessage({
+        type: MESSAGE_TYPES.SYSTEM,
+        content: content,
+        sender: 'System',
+        room: activeRoom,
+        timestamp: Math.floor(Date.now() / 1000)
+    });
+}
+
 async function displayMessage(message) {
     const messagesDiv = document.getElementById('messages');
     const messageDiv = document.createElement('div');
+    const room = message.room || '';
     
     let className = 'message other';
     if (message.sender === username) {
@@ -317,22 +943,49 @@ async function displayMessage(message) {
             return;
         }
         
+        // Drop muted users' messages unread
+        if (muted.has(message.sender)) {
+            return;
+        }
+        
         // Only try to decrypt messages from others (not from ourselves)
         if (message.sender !== username) {
             const decryptedContent = await decryptMessage(message.content);
             messageContent = decryptedContent;
+            if (decryptedContent === DECRYPTION_FAILED) {
+                retryKeyExchange(message.sender);
+            } else {
+                rekeyAttempts.delete(message.sender);
+            }
         } else {
             // Skip our own encrypted messages (they were meant for others)
             return;
         }
 
     } else if (message.type === MESSAGE_TYPES.PUBLIC_KEY_SHARE) {
-        // Store the client's public key silently
-        if (message.content && message.sender !== username && message.sender !== "Loading...") {
+        // Store the client's public key silently, ignoring keys that are too weak to trust
+        const sharedKey = parseKeyShare(message.content);
+        if (sharedKey && otherClients.get(message.sender) === sharedKey) {
+            return; // Repeat of a key we already have: nothing to store or share back
+        }
+        if (sharedKey && message.sender !== username && message.sender !== "Loading..." && await isAcceptablePublicKey(sharedKey)) {
             // Check if we already have this client's key before storing
             const alreadyHaveKey = otherClients.has(message.sender);
             
-            otherClients.set(message.sender, message.content);
+            otherClients.set(message.sender, sharedKey);
+            roster.add(message.sender);
+            if (!firstSeen.has(message.sender)) {
+                firstSeen.set(message.sender, new Date());
+            }
+            if (aloneHint) {
+                aloneHint.remove();
+                aloneHint = null;
+            }
+            
+            // Send anything typed while we were alone
+            if (pendingMessages.length > 0 && !muted.has(message.sender)) {
+                flushPendingMessages(message.sender);
+            }
             
             // Update clients list immediately when we receive a new public key
             updateClientsList();
@@ -346,9 +999,62 @@ async function displayMessage(message) {
         }
         // Don't display anything for public key sharing
         return;
+    } else if (message.type === MESSAGE_TYPES.KEY_ROTATION) {
+        // A peer replaced their key: encrypt future messages to the new one
+        const rotatedKey = parseKeyShare(message.content);
+        if (message.sender === username || !rotatedKey || !await isAcceptablePublicKey(rotatedKey)) {
+            return;
+        }
+        otherClients.set(message.sender, rotatedKey);
+        roster.add(message.sender);
+        updateClientsList();
+        className = 'message system';
+        messageContent = `${message.sender} rotated their encryption key`;
+    } else if (message.type === MESSAGE_TYPES.ECHO) {
+        await handleEcho(message);
+        return;
+    } else if (message.type === MESSAGE_TYPES.SERVER_ACK) {
+        // We don't set message IDs, so there is nothing to match acks against
+        return;
+    } else if (message.type === MESSAGE_TYPES.DELIVERY_FAILED) {
+        // The server had no connection for a peer we encrypted to, or refused an unaddressed message
+        className = 'message system';
+        messageContent = message.recipient
+            ? `Couldn't deliver to ${message.recipient} (offline)`
+            : "Couldn't deliver a message without a recipient";
     } else if (message.type === MESSAGE_TYPES.LOCAL) {
         // Display local messages (our own messages for local display)
         messageContent = message.content;
+    } else if (message.type === MESSAGE_TYPES.JOIN_ROOM || message.type === MESSAGE_TYPES.LEAVE_ROOM) {
+        // Track room rosters
+        if (!rooms.has(room)) {
+            return;
+        }
+        const joined = message.type === MESSAGE_TYPES.JOIN_ROOM;
+        if (joined) {
+            rooms.get(room).members.add(message.sender);
+        } else {
+            rooms.get(room).members.delete(message.sender);
+        }
+        if (room === activeRoom) {
+            updateClientsList();
+        }
+        if (message.sender === username) {
+            return; // Don't announce our own join
+        }
+        className = 'message system';
+        messageContent = `${message.sender} ${joined ? 'joined' : 'left'} #${room}`;
+    } else if (message.type === MESSAGE_TYPES.PRESENCE) {
+        // Track peers' away state for the clients list
+        if (message.sender !== username) {
+            if (message.content) {
+                presence.set(message.sender, message.content);
+            } else {
+                presence.delete(message.sender);
+            }
+            updateClientsList();
+        }
+        return; // Don't display this message
     } else if (message.type === MESSAGE_TYPES.REQUEST_KEYS) {
         // Another client is requesting our public key
         if (message.sender !== username && isKeyGenerated) {
@@ -369,10 +1075,14 @@ async function displayMessage(message) {
         messageContent = content;
         
         // Handle user join/leave events
-        if (message.content.includes('joined the chat') && isKeyGenerated) {
+        if (message.content.includes('joined the chat')) {
             // Extract username from "User X joined the chat"
             const match = message.content.match(/User (.+) joined the chat/);
-            if (match) {
+            if (match && match[1] !== username) {
+                roster.add(match[1]);
+                updatePeerSummary();
+            }
+            if (match && isKeyGenerated) {
                 lastJoinedUser = match[1];
             }
         } else if (message.content.includes('left the chat')) {
@@ -382,6 +1092,8 @@ async function displayMessage(message) {
                 const leftUsername = match[1];
                 // Remove the user from otherClients map
                 otherClients.delete(leftUsername);
+                roster.delete(leftUsername);
+                presence.delete(leftUsername);
                 // Update the clients list to reflect the change
                 updateClientsList();
             }
@@ -392,7 +1104,7 @@ async function displayMessage(message) {
     
     messageDiv.className = className;
     
-    if (message.type === MESSAGE_TYPES.SYSTEM) {
+    if (className === 'message system') {
         // System messages with simple structure
         messageDiv.innerHTML = `
             <div class="message-content">
@@ -406,6 +1118,7 @@ async function displayMessage(message) {
             <div class="message-header">
                 <span class="message-username">${message.sender}</span>
                 <span class="message-timestamp">${timeString}</span>
+                ${message.queued ? '<span class="message-queued">queued</span>' : ''}
             </div>
             <div class="message-content">
                 <span class="message-text">${messageContent}</span>
@@ -413,53 +1126,331 @@ async function displayMessage(message) {
         `;
     }
     
-    messagesDiv.appendChild(messageDiv);
+    // Buffer messages for rooms we aren't viewing
+    if (room !== activeRoom && rooms.has(room)) {
+        rooms.get(room).unread++;
+    }
+    getRoomContainer(room).appendChild(messageDiv);
     messagesDiv.scrollTop = messagesDiv.scrollHeight;
+    return messageDiv;
 }
 
 async function sendMessage() {
     const messageInput = document.getElementById('messageInput');
     const message = messageInput.value.trim();
     
+    // While reconnecting, queue chat messages in the outbox
+    if (message && username !== "Loading..." && !(ws && ws.readyState === WebSocket.OPEN)) {
+        if (message.startsWith('/')) {
+            showLocalNotice('Commands are unavailable until the connection is restored');
+        } else if (!await queueOutgoing(message)) {
+            return; // Keep the text in the input so it isn't lost
+        }
+        messageInput.value = '';
+        return;
+    }
+    
     if (message && ws && ws.readyState === WebSocket.OPEN && username !== "Loading...") {
+        // Handle /away [message] and /back
+        if (message === '/away' || message.startsWith('/away ')) {
+            setPresence(message.slice('/away'.length).trim() || 'away');
+            messageInput.value = '';
+            return;
+        }
+        if (message === '/back') {
+            setPresence('');
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /join <room>, /part [room] and /switch <room>
+        if (message.startsWith('/join ')) {
+            const room = message.slice('/join '.length).trim();
+            if (/^[A-Za-z0-9_-]{1,32}$/.test(room)) {
+                joinRoom(room);
+            } else {
+                showLocalNotice('Room names are 1-32 letters, digits, underscores or hyphens');
+            }
+            messageInput.value = '';
+            return;
+        }
+        if (message === '/part' || message.startsWith('/part ')) {
+            leaveRoom(message.slice('/part'.length).trim() || activeRoom);
+            messageInput.value = '';
+            return;
+        }
+        if (message === '/switch' || message.startsWith('/switch ')) {
+            const room = message.slice('/switch'.length).trim().replace(/^#/, '');
+            switchRoom(room === 'lobby' ? '' : room);
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /rotate-key
+        if (message === '/rotate-key') {
+            rotateKey();
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /test <username>
+        if (message.startsWith('/test ')) {
+            testPeer(message.slice('/test '.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /whois <username>
+        if (message.startsWith('/whois ')) {
+            whoisPeer(message.slice('/whois '.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /mute <username>, /unmute <username> and /muted
+        if (message === '/mute' || message.startsWith('/mute ')) {
+            mutePeer(message.slice('/mute'.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        if (message === '/unmute' || message.startsWith('/unmute ')) {
+            unmutePeer(message.slice('/unmute'.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        if (message === '/muted') {
+            listMuted();
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /peers
+        if (message === '/peers') {
+            showLocalNotice(escapeHTML(formatPeerSummary(peerSummary())));
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /search [@user] <term>
+        if (message.startsWith('/search ')) {
+            searchHistory(message.slice('/search '.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /wipe
+        if (message === '/wipe') {
+            wipeHistory();
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /invite
+        if (message === '/invite') {
+            createInvite();
+            messageInput.value = '';
+            return;
+        }
+        
+        // Handle /quit [reason]
+        if (message === '/quit' || message.startsWith('/quit ')) {
+            quitChat(message.slice('/quit'.length).trim());
+            messageInput.value = '';
+            return;
+        }
+        
         // Display our own message locally
         const localMessage = {
             type: MESSAGE_TYPES.LOCAL,
             content: message,
             sender: username,
+            room: activeRoom,
             timestamp: Math.floor(Date.now() / 1000)
         };
         displayMessage(localMessage);
         
-        // Send encrypted messages to all other clients (except ourselves)
-        if (otherClients.size > 0) {
-            for (const [clientID, publicKey] of otherClients) {
-                // Skip sending to ourselves
-                if (clientID === username) {
-                    continue;
-                }
-                const encryptedContent = await encryptMessage(message, publicKey);
-                if (encryptedContent) {
-                    const encryptedMsg = {
-                        type: MESSAGE_TYPES.ENCRYPTED,
-                        content: encryptedContent,
-                        sender: username,
-                        recipient: clientID,
-                        timestamp: Math.floor(Date.now() / 1000)
-                    };
-                    ws.send(JSON.stringify(encryptedMsg));
-                }
-            }
-        }
+        await deliverMessage(message, activeRoom);
         
         messageInput.value = '';
     }
 }
 
+// Send encrypted messages to all other clients (except ourselves and muted users).
+// Never send plaintext: with no peers yet, queue until a key arrives.
+// In a room, only its members receive the message.
+async function deliverMessage(message, room) {
+    const peers = Array.from(otherClients.keys()).filter(clientID =>
+        clientID !== username && !muted.has(clientID) && (room === '' || rooms.get(room)?.members.has(clientID)));
+    if (peers.length > 0) {
+        for (const clientID of peers) {
+            await sendEncryptedTo(clientID, message, room);
+        }
+    } else if (room === '') {
+        pendingMessages.push(message);
+    }
+}
+
+// Show a message as queued and hold it until we reconnect, returning false if the outbox is full
+async function queueOutgoing(message) {
+    if (outbox.length >= maxOutboxMessages) {
+        showLocalNotice(`Outbox full (${maxOutboxMessages} messages): wait for the connection to be restored`);
+        return false;
+    }
+    const element = await displayMessage({
+        type: MESSAGE_TYPES.LOCAL,
+        content: message,
+        sender: username,
+        room: activeRoom,
+        queued: true,
+        timestamp: Math.floor(Date.now() / 1000)
+    });
+    outbox.push({ message, room: activeRoom, element });
+    return true;
+}
+
+// Encrypt queued messages to the peers' current keys and send them, stopping if we disconnect again
+async function flushOutbox() {
+    while (outbox.length > 0 && ws && ws.readyState === WebSocket.OPEN) {
+        const entry = outbox.shift();
+        await deliverMessage(entry.message, entry.room);
+        entry.element.querySelector('.message-queued')?.remove();
+    }
+}
+
+// Tell a user with no peers that messages wait for someone to join, once per page
+async function showAloneHint() {
+    if (aloneHintShown || Array.from(otherClients.keys()).some(clientID => clientID !== username)) {
+        return;
+    }
+    aloneHintShown = true;
+    aloneHint = await showLocalNotice("You're the only one here; messages will be delivered once others join");
+}
+
+// Give up on queued messages once we won't reconnect
+function closeOutbox() {
+    document.getElementById('messageInput').disabled = true;
+    document.getElementById('sendButton').disabled = true;
+    if (outbox.length > 0) {
+        showLocalNotice(`${outbox.length} queued message(s) could not be sent`);
+        outbox = [];
+    }
+}
+
+// Encrypt a message for one peer and send it
+async function sendEncryptedTo(clientID, message, room = '') {
+    const encryptedContent = await encryptMessage(message, otherClients.get(clientID));
+    if (encryptedContent) {
+        const encryptedMsg = {
+            type: MESSAGE_TYPES.ENCRYPTED,
+            content: encryptedContent,
+            sender: username,
+            recipient: clientID,
+            room: room || undefined,
+            timestamp: Math.floor(Date.now() / 1000)
+        };
+        ws.send(JSON.stringify(encryptedMsg));
+    }
+}
+
+// Deliver messages typed while alone to the first peer whose key arrives
+async function flushPendingMessages(clientID) {
+    const queued = pendingMessages;
+    pendingMessages = [];
+    for (const message of queued) {
+        await sendEncryptedTo(clientID, message);
+    }
+}
+
+// Broadcast our presence; an empty away message means we are back
+function setPresence(awayMessage) {
+    autoAway = false;
+    myAwayMessage = awayMessage;
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        const presenceMsg = {
+            type: MESSAGE_TYPES.PRESENCE,
+            content: awayMessage,
+            sender: username,
+            timestamp: Math.floor(Date.now() / 1000)
+        };
+        ws.send(JSON.stringify(presenceMsg));
+    }
+    updateClientsList();
+}
+
+// Restart the idle timer, coming back if we went away automatically
+function resetIdleTimer() {
+    if (autoAway) {
+        setPresence('');
+    }
+    if (idleTimer) {
+        clearTimeout(idleTimer);
+    }
+    if (autoAwayDelay > 0) {
+        idleTimer = setTimeout(() => {
+            if (!myAwayMessage) {
+                setPresence('idle');
+                autoAway = true;
+            }
+        }, autoAwayDelay);
+    }
+
+    clearTimeout(idleWarningTimer);
+    clearTimeout(idleDisconnectTimer);
+    if (idleDisconnectDelay > 0) {
+        idleWarningTimer = setTimeout(() => {
+            showLocalNotice(`You will be disconnected in ${Math.round(Math.min(IDLE_WARNING, idleDisconnectDelay) / 1000)} seconds unless you're active`);
+        }, Math.max(0, idleDisconnectDelay - IDLE_WARNING));
+        idleDisconnectTimer = setTimeout(() => {
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                showLocalNotice('Disconnected after being idle. Reload the page to reconnect.');
+                quitChat('idle');
+            }
+        }, idleDisconnectDelay);
+    }
+}
+
+// Create a one-time invite link and show it locally
+async function createInvite() {
+    let content;
+    try {
+        const response = await fetch('/api/invites', {
+            method: 'POST',
+            credentials: 'same-origin'
+        });
+        if (!response.ok) {
+            throw new Error(`HTTP ${response.status}`);
+        }
+        const invite = await response.json();
+        const link = `${window.location.origin}${invite.url}`;
+        const expires = new Date(invite.expires_at).toLocaleString();
+        content = `Invite link (${invite.single_use ? 'single use, ' : ''}expires ${expires}): ${link}`;
+    } catch (error) {
+        console.error('Failed to create invite:', error);
+        content = 'Failed to create invite link';
+    }
+    displayMessage({
+        type: MESSAGE_TYPES.SYSTEM,
+        content: content,
+        sender: 'System',
+        timestamp: Math.floor(Date.now() / 1000)
+    });
+}
+
+// Leave the chat, telling peers why
+function quitChat(reason) {
+    const leaveMsg = {
+        type: MESSAGE_TYPES.LEAVE,
+        content: reason,
+        sender: username,
+        timestamp: Math.floor(Date.now() / 1000)
+    };
+    ws.send(JSON.stringify(leaveMsg));
+    ws.close(1000, 'User quit');
+}
+
 function connect() {
     // Username will be provided by the server via session
-    // We'll get it from the WebSocket connection
-    username = "Loading..."; // Will be updated when WebSocket connects
+    // We'll get it from the WebSocket connection, keeping the known one while reconnecting
     
     // Update the title with the username
     updateTitle();
@@ -468,6 +1459,7 @@ function connect() {
     const connectionStatus = document.getElementById('connectionStatus');
     connectionStatus.querySelector('.connection-text').textContent = 'Connecting...';
     connectionStatus.className = 'connection-indicator';
+    updatePeerSummary();
     
     // Generate keys first
     generateKeyPair().then(() => {
@@ -500,6 +1492,9 @@ function connect() {
             // Share public key after connection to trigger key exchange with existing clients
             sharePublicKey();
             
+            // Persist public key server-side for offline peers
+            storePublicKey();
+            
             // Also request existing clients to share their keys
             setTimeout(() => {
                 if (ws && ws.readyState === WebSocket.OPEN) {
@@ -509,6 +1504,12 @@ function connect() {
                         timestamp: Math.floor(Date.now() / 1000)
                     };
                     ws.send(JSON.stringify(requestMsg));
+                    
+                    // Once peers have answered, send what was typed while disconnected or explain that nobody is here
+                    setTimeout(() => {
+                        flushOutbox();
+                        showAloneHint();
+                    }, OUTBOX_FLUSH_DELAY);
                 }
             }, 500); // Small delay to ensure connection is stable
         };
@@ -519,6 +1520,12 @@ function connect() {
             // Handle user_info message to get username from server
             if (message.type === MESSAGE_TYPES.USER_INFO) {
                 username = message.content;
+                loadMuted();
+                if (message.idle) {
+                    autoAwayDelay = message.idle.away_after * 1000;
+                    idleDisconnectDelay = message.idle.disconnect_after * 1000;
+                    resetIdleTimer();
+                }
                 updateTitle();
                 updateClientsList(); // Update clients list with correct username
                 return;
@@ -531,8 +1538,12 @@ function connect() {
             const connectionStatus = document.getElementById('connectionStatus');
             connectionStatus.querySelector('.connection-text').textContent = 'Disconnected';
             connectionStatus.className = 'connection-indicator status-disconnected';
-            document.getElementById('messageInput').disabled = true;
-            document.getElementById('sendButton').disabled = true;
+            updatePeerSummary();
+            
+            // Keep the input usable while reconnecting so messages can be queued in the outbox
+            const willReconnect = event.code !== 1000 && reconnectAttempts < maxReconnectAttempts && username !== "Loading...";
+            document.getElementById('messageInput').disabled = !willReconnect;
+            document.getElementById('sendButton').disabled = !willReconnect;
             
             // Attempt reconnection if not already reconnecting and not a normal closure
             if (!isReconnecting && event.code !== 1000) {
@@ -555,6 +1566,8 @@ function attemptReconnection() {
             console.error('Max reconnection attempts reached. Please refresh the page.');
             const connectionStatus = document.getElementById('connectionStatus');
             connectionStatus.querySelector('.connection-text').textContent = 'Connection failed';
+            updatePeerSummary();
+            closeOutbox();
         }
         return;
     }
@@ -565,10 +1578,18 @@ function attemptReconnection() {
     const connectionStatus = document.getElementById('connectionStatus');
     connectionStatus.querySelector('.connection-text').textContent = `Connecting...`;
     connectionStatus.className = 'connection-indicator';
+    updatePeerSummary();
     
 
     
-    reconnectTimer = setTimeout(() => {
+    reconnectTimer = setTimeout(async () => {
+        // A WebSocket handshake hides its 401, so ask the static server whether the session is still valid
+        if (!(await checkSession())) {
+            isReconnecting = false;
+            handleSessionExpired();
+            return;
+        }
+
         isReconnecting = false;
         connect();
         
@@ -577,6 +1598,31 @@ function attemptReconnection() {
     }, reconnectDelay);
 }
 
+// checkSession reports whether the session cookie is still accepted; network errors count as valid so reconnecting continues
+async function checkSession() {
+    try {
+        const response = await fetch('/api/session', { credentials: 'same-origin' });
+        return response.status !== 401;
+    } catch (error) {
+        return true;
+    }
+}
+
+// handleSessionExpired stops reconnecting and asks the user to log in again
+function handleSessionExpired() {
+    reconnectAttempts = maxReconnectAttempts;
+    const connectionStatus = document.getElementById('connectionStatus');
+    connectionStatus.querySelector('.connection-text').textContent = 'Session expired';
+    connectionStatus.className = 'connection-indicator status-disconnected';
+    updatePeerSummary();
+    showLocalNotice('Your session has expired. Log in again to reconnect.');
+    closeOutbox();
+
+    if (confirm('Your session has expired. Log in again now?')) {
+        window.location.href = '/login';
+    }
+}
+
 // Event listeners
 document.getElementById('sendButton').addEventListener('click', sendMessage);
 document.getElementById('messageInput').addEventListener('keypress', function(e) {
@@ -585,6 +1631,12 @@ document.getElementById('messageInput').addEventListener('keypress', function(e)
     }
 });
 
+// Track activity for automatic away
+['keydown', 'mousemove', 'click'].forEach(eventName => {
+    document.addEventListener(eventName, resetIdleTimer);
+});
+resetIdleTimer();
+
 // Logout functionality
 document.getElementById('logoutBtn').addEventListener('click', function() {
     // Close WebSocket connection
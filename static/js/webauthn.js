@@ -55,6 +55,16 @@ class WebAuthnClient {
             .replace(/=/g, '');
     }
 
+    // Name this device for the credentials list, e.g. "Firefox on Windows"
+    deviceLabel() {
+        const ua = navigator.userAgent;
+        const browsers = [['Edg/', 'Edge'], ['OPR/', 'Opera'], ['Firefox/', 'Firefox'], ['Chrome/', 'Chrome'], ['Safari/', 'Safari']];
+        const systems = [['Android', 'Android'], ['iPhone', 'iPhone'], ['iPad', 'iPad'], ['Windows', 'Windows'], ['Mac OS X', 'macOS'], ['CrOS', 'ChromeOS'], ['Linux', 'Linux']];
+        const browser = browsers.find(([token]) => ua.includes(token));
+        const system = systems.find(([token]) => ua.includes(token));
+        return [browser && browser[1], system && system[1]].filter(Boolean).join(' on ');
+    }
+
     // Begin passkey registration
     async beginRegistration(username) {
         try {
@@ -98,8 +108,8 @@ class WebAuthnClient {
         }
     }
 
-    // Finish passkey registration
-    async finishRegistration(username, credential) {
+    // Finish passkey registration, using up the invite it started from if there is one
+    async finishRegistration(credential, invite) {
         try {
             const response = await fetch(`${this.baseURL}/webauthn/finish-registration`, {
                 method: 'POST',
@@ -109,7 +119,8 @@ class WebAuthnClient {
                 body: JSON.stringify({
                     id: credential.id,
                     rawId: this.arrayBufferToBase64URL(credential.rawId),
-                    username: username, // Include username in request body
+                    deviceLabel: this.deviceLabel(),
+                    invite: invite || undefined,
                     response: {
                         attestationObject: this.arrayBufferToBase64URL(credential.response.attestationObject),
                         clientDataJSON: this.arrayBufferToBase64URL(credential.response.clientDataJSON),
@@ -176,6 +187,8 @@ class WebAuthnClient {
                         authenticatorData: this.arrayBufferToBase64URL(assertion.response.authenticatorData),
                         clientDataJSON: this.arrayBufferToBase64URL(assertion.response.clientDataJSON),
                         signature: this.arrayBufferToBase64URL(assertion.response.signature),
+                        // Discoverable credentials return the owner's user handle
+                        userHandle: assertion.response.userHandle ? this.arrayBufferToBase64URL(assertion.response.userHandle) : null,
                     },
                     type: assertion.type
                 })
@@ -195,10 +208,10 @@ class WebAuthnClient {
     }
 
     // Complete registration flow
-    async register(username) {
+    async register(username, invite) {
         try {
             const credential = await this.beginRegistration(username);
-            const result = await this.finishRegistration(username, credential);
+            const result = await this.finishRegistration(credential, invite);
             return result;
         } catch (error) {
             throw error;